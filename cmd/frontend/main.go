@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
@@ -9,12 +10,24 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/go-github/github"
-	"github.com/nats-io/nats"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/github/contents"
+	"github.com/nicolai86/sisyphus/github/repo"
+	"github.com/nicolai86/sisyphus/github/tree"
+	"github.com/nicolai86/sisyphus/registry"
+	"github.com/nicolai86/sisyphus/schedule"
 	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
 	"github.com/nicolai86/sisyphus/uuid"
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
@@ -47,12 +60,16 @@ type githubOrganization struct {
 type loggedIndexData struct {
 	Repositories  []*github.Repository
 	Organizations []*githubOrganization
+	Plugins       []registry.Available
 }
 
 var (
+	// plugins knows which plugins live workers serve
+	plugins               *registry.Registry
+	fetcher               = contents.NewFetcher()
 	natsURL               string
 	templatePath          string
-	fileStorage           storage.RepositoryReaderWriter
+	fileStorage           storage.RepositoryStore
 	temporaryAccessTokens map[string]string
 	conf                  *oauth2.Config
 )
@@ -156,26 +173,46 @@ func renderSignedInIndex(accessToken string, w http.ResponseWriter) {
 	var data = loggedIndexData{
 		Organizations: orgs,
 		Repositories:  repos,
+		Plugins:       plugins.Plugins(),
 	}
 
-	knownRepos, err := fileStorage.Load()
-	if err != nil {
-		log.Fatal(err)
+	// repositories are listed once per plugin the template asks for
+	enabledByPlugin := map[string]map[string]storage.Repository{}
+	enabled := func(plugin string) (map[string]storage.Repository, error) {
+		if repos, ok := enabledByPlugin[plugin]; ok {
+			return repos, nil
+		}
+		repos, err := fileStorage.ListByPlugin(plugin)
+		if err != nil {
+			return nil, err
+		}
+		byName := make(map[string]storage.Repository, len(repos))
+		for _, repo := range repos {
+			byName[repo.FullName] = repo
+		}
+		enabledByPlugin[plugin] = byName
+		return byName, nil
 	}
 
 	loggedInIndex, err := template.New("signed-in.tpl").Funcs(template.FuncMap{
-		"enabled": func(repoName, service string) bool {
-			for _, repo := range knownRepos {
-				if repo.FullName == repoName {
-					for _, plugin := range repo.Plugins {
-						if plugin == service {
-							return true
-						}
-					}
-					return false
-				}
+		"enabled": func(repoName, service string) (bool, error) {
+			repos, err := enabled(service)
+			if err != nil {
+				return false, err
+			}
+			_, ok := repos[repoName]
+			return ok, nil
+		},
+		"schedule": func(repoName, service string) (string, error) {
+			repos, err := enabled(service)
+			if err != nil {
+				return "", err
+			}
+			spec, ok := repos[repoName].Schedules[service]
+			if !ok {
+				return "default", nil
 			}
-			return false
+			return spec.String(), nil
 		},
 	}).ParseFiles(fmt.Sprintf("%s/index/signed-in.tpl", templatePath))
 	if err != nil {
@@ -193,16 +230,161 @@ func renderSignedInIndex(accessToken string, w http.ResponseWriter) {
 	io.Copy(w, &b)
 }
 
+// renderHistory lists the run events of ?repository=<full name> as JSON,
+// for the last ?since=<duration> (one week by default). Repositories the
+// signed in user cannot read are reported as unknown.
+func renderHistory(history storage.RunHistoryStore, accessToken string, req *http.Request, w http.ResponseWriter) {
+	since := 7 * 24 * time.Hour
+	if value := req.URL.Query().Get("since"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = d
+	}
+
+	fullName := req.URL.Query().Get("repository")
+	parts := strings.Split(fullName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return
+	}
+	accessible, err := repo.Accessible(accessToken, parts[0], parts[1])
+	if err != nil {
+		log.Printf("Failed to check access to %s: %q\n", fullName, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if !accessible {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return
+	}
+
+	stored, err := fileStorage.GetByFullName(fullName)
+	if err == storage.ErrNotFound {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load repository: %q\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := history.LoadRunEvents(stored.ID, time.Now().Add(-since))
+	if err != nil {
+		log.Printf("Failed to load run history of %s: %q\n", stored.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []storage.RunEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// configPreview is what the master would make of a repository's .sisyphus
+type configPreview struct {
+	Valid  bool          `json:"valid"`
+	Errors config.Errors `json:"errors,omitempty"`
+	// Plugins are enabled for the repository in sisyphus
+	Plugins []string          `json:"plugins"`
+	Entries []config.Resolved `json:"entries"`
+	// Unsupported entries have no live worker for their language
+	Unsupported []config.Resolved `json:"unsupported,omitempty"`
+}
+
+// renderConfigPreview validates the .sisyphus of ?repository=<full name>
+// with the schema used by the master, and lists the jobs it resolves to
+func renderConfigPreview(accessToken string, req *http.Request, w http.ResponseWriter) {
+	fullName := req.URL.Query().Get("repository")
+	parts := strings.Split(fullName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "repository must be a full name like owner/repo", http.StatusBadRequest)
+		return
+	}
+
+	preview := configPreview{Plugins: []string{}, Entries: []config.Resolved{}}
+	stored, err := fileStorage.GetByFullName(fullName)
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("Failed to load repository: %q\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err == nil && stored.Plugins != nil {
+		preview.Plugins = stored.Plugins
+	}
+
+	branch := stored.DefaultBranch
+	if branch == "" {
+		if branch, err = repo.DefaultBranch(accessToken, parts[0], parts[1]); err != nil {
+			log.Printf("Failed to detect the default branch of %s: %q\n", fullName, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	file, err := fetcher.Fetch(context.Background(), accessToken, parts[0], parts[1], branch, ".sisyphus")
+	if err == contents.ErrNotFound {
+		http.Error(w, fmt.Sprintf("%s has no .sisyphus", fullName), http.StatusNotFound)
+		return
+	}
+	if limit, ok := err.(*contents.RateLimitError); ok {
+		http.Error(w, limit.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch .sisyphus of %s: %q\n", fullName, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	f, err := config.Parse(file.Content)
+	if errs, ok := err.(config.Errors); ok {
+		preview.Errors = errs
+	} else if err != nil {
+		preview.Errors = config.Errors{{Message: err.Error()}}
+	} else {
+		if f.HasPatterns() {
+			files, err := tree.Files(accessToken, parts[0], parts[1], branch)
+			if err != nil {
+				log.Printf("Failed to list files of %s: %q\n", fullName, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			f = f.Expand(files)
+		}
+		preview.Valid = true
+		preview.Entries = f.Resolve(branch)
+		for _, e := range preview.Entries {
+			if !plugins.Serves(e.Plugin) {
+				preview.Unsupported = append(preview.Unsupported, e)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
 func init() {
 	var (
 		dataPath      string
 		bucket        string
 		encryptionKey string
+		keyringPath   string
+		sqlDriver     string
+		sqlDSN        string
 	)
 	flag.StringVar(&templatePath, "template-path", "", "path to templates")
 	flag.StringVar(&dataPath, "data-path", "", "path to store data")
 	flag.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flag.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
 	flag.StringVar(&encryptionKey, "encryption-key", "", "store everything encrypted")
+	flag.StringVar(&keyringPath, "keyring", "", "keyring file, store everything encrypted with its active key")
 	flag.StringVar(&natsURL, "nats", "tcp://127.0.0.1:4222", "nats server URL")
 	flag.Parse()
 
@@ -212,8 +394,25 @@ func init() {
 	if bucket != "" {
 		fileStorage = storage.NewS3Storage(bucket)
 	}
-	if encryptionKey != "" {
-		fileStorage = storage.NewAESStorage(encryptionKey, fileStorage)
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = sqlStorage
+	}
+	if keyringPath != "" {
+		keyring, err := storage.LoadKeyring(keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	} else if encryptionKey != "" {
+		keyring, err := storage.NewKeyring("default", storage.Key{ID: "default", Secret: []byte(encryptionKey)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
 	}
 	temporaryAccessTokens = make(map[string]string)
 	conf = &oauth2.Config{
@@ -230,12 +429,33 @@ func init() {
 func main() {
 	log.Printf("greenkeepr server listening")
 
-	nc, err := nats.Connect(natsURL)
+	nc, err := transport.Connect(natsURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer nc.Close()
 
+	plugins, err = registry.New(nc, registry.DefaultTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer plugins.Close()
+
+	// NotifyingStorage only passes repositories through
+	history, _ := fileStorage.(storage.RunHistoryStore)
+
+	// the scheduler updates its schedule whenever a repository changes
+	notifyingStorage := storage.NewNotifyingStorage(fileStorage)
+	fileStorage = notifyingStorage
+	changes, stopWatching := notifyingStorage.Watch()
+	defer stopWatching()
+	go func() {
+		for change := range changes {
+			nc.Publish("toggle-repository", []byte(change.Repository.ID))
+			nc.Flush()
+		}
+	}()
+
 	srv := http.Server{
 		ReadTimeout:  4 * time.Second,
 		WriteTimeout: 6 * time.Second,
@@ -260,29 +480,72 @@ func main() {
 				req.ParseForm()
 				vals := req.Form
 				repo := storage.Repository{
-					ID:          vals.Get("repository_id"),
-					FullName:    vals.Get("repository_name"),
-					AccessToken: temporaryAccessTokens[c.Value],
-					GitURL:      vals.Get("repository_git_url"),
+					ID:            vals.Get("repository_id"),
+					FullName:      vals.Get("repository_name"),
+					AccessToken:   temporaryAccessTokens[c.Value],
+					GitURL:        vals.Get("repository_git_url"),
+					DefaultBranch: vals.Get("repository_default_branch"),
 				}
 
 				if vals.Get("action") == "disable" {
 					repo.Plugins = []string{}
 				} else {
 					repo.Plugins = []string{vals.Get("service")}
+					if expr := vals.Get("schedule"); expr != "" {
+						spec, err := schedule.Parse(expr)
+						if err == nil {
+							spec.Timezone = vals.Get("timezone")
+							if start, end := vals.Get("window_start"), vals.Get("window_end"); start != "" || end != "" {
+								spec.Window = &schedule.Window{Start: start, End: end}
+							}
+							err = spec.Validate()
+						}
+						if err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+						repo.Schedules = map[string]schedule.Spec{vals.Get("service"): spec}
+					}
 				}
 
 				if err := fileStorage.Store(repo); err != nil {
 					log.Fatalf("Failed to store repo: %q\n", err)
 				}
 
-				nc.Publish("toggle-repository", []byte(repo.ID))
-				nc.Flush()
-
 				http.Redirect(w, req, "/", http.StatusFound)
 				return
 			}
 
+			if req.Method == "GET" && req.URL.Path == "/history" {
+				c, err := req.Cookie("id")
+				if err != nil || temporaryAccessTokens[c.Value] == "" {
+					http.Error(w, "sign in first", http.StatusUnauthorized)
+					return
+				}
+				if history == nil {
+					http.Error(w, fmt.Sprintf("%T does not store run events", fileStorage), http.StatusNotImplemented)
+					return
+				}
+				renderHistory(history, temporaryAccessTokens[c.Value], req, w)
+				return
+			}
+
+			if req.Method == "GET" && req.URL.Path == "/plugins" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(plugins.Plugins())
+				return
+			}
+
+			if req.Method == "GET" && req.URL.Path == "/config" {
+				c, err := req.Cookie("id")
+				if err != nil || temporaryAccessTokens[c.Value] == "" {
+					http.Error(w, "sign in first", http.StatusUnauthorized)
+					return
+				}
+				renderConfigPreview(temporaryAccessTokens[c.Value], req, w)
+				return
+			}
+
 			if req.URL.Path == "/logout" {
 				cookie := http.Cookie{
 					Name:    "id",
@@ -339,7 +602,21 @@ func main() {
 			}
 		})),
 	}
-	srv.ListenAndServe()
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down: %q\n", err)
+	}
 	// TODO add support to activate specific repositories
 	// TODO add support for webhooks -> schedule worker
 }
@@ -33,12 +33,28 @@
                 type="hidden"
                 value="{{ .FullName }}"
               >
+              <input
+                id="repository_default_branch"
+                name="repository_default_branch"
+                type="hidden"
+                value="{{ .DefaultBranch }}"
+              >
               <input
                   id="action"
                   name="action"
                   value="{{ if enabled .FullName "greenkeep" }}disable{{ else }}enable{{ end }}"
                   type="hidden"
               >
+              {{ if enabled .FullName "greenkeep" }}
+              runs {{ schedule .FullName "greenkeep" }}
+              (<a href="/history?repository={{ .FullName }}">history</a>, <a href="/config?repository={{ .FullName }}">config</a>)
+              {{ else }}
+              <input name="schedule" placeholder="1h or 0 3 * * 1-5">
+              <input name="timezone" placeholder="UTC">
+              <input name="window_start" placeholder="22:00">
+              <input name="window_end" placeholder="06:00">
+              (<a href="/config?repository={{ .FullName }}">check .sisyphus</a>)
+              {{ end }}
               <button>
               {{ if enabled .FullName "greenkeep" }}
                   Disable
@@ -88,12 +104,28 @@
                   value="{{ .FullName }}"
                   type="hidden"
                 >
+                <input
+                  id="repository_default_branch"
+                  name="repository_default_branch"
+                  value="{{ .DefaultBranch }}"
+                  type="hidden"
+                >
                 <input
                   id="action"
                   name="action"
                   value="{{ if enabled .FullName "greenkeep" }}disable{{ else }}enable{{ end }}"
                   type="hidden"
                 >
+                {{ if enabled .FullName "greenkeep" }}
+                runs {{ schedule .FullName "greenkeep" }}
+                (<a href="/history?repository={{ .FullName }}">history</a>, <a href="/config?repository={{ .FullName }}">config</a>)
+                {{ else }}
+                <input name="schedule" placeholder="1h or 0 3 * * 1-5">
+                <input name="timezone" placeholder="UTC">
+                <input name="window_start" placeholder="22:00">
+                <input name="window_end" placeholder="06:00">
+                (<a href="/config?repository={{ .FullName }}">check .sisyphus</a>)
+                {{ end }}
                 <button>
                 {{ if enabled .FullName "greenkeep" }}
                   Disable
@@ -110,6 +142,20 @@
       {{ end }}
     </div>
 
+    <div>
+      <h2>available plugins</h2>
+      <ul>
+        {{ range .Plugins }}
+        <li>
+          {{ .Subject }}{{ if .Languages }} ({{ range $i, $l := .Languages }}{{ if $i }}, {{ end }}{{ $l }}{{ end }}){{ end }},
+          {{ .Workers }} worker{{ if ne .Workers 1 }}s{{ end }}
+        </li>
+        {{ else }}
+        <li>no worker is running</li>
+        {{ end }}
+      </ul>
+    </div>
+
     <div>
       <a href="/logout">Logout</a>
     </div>
@@ -1,31 +1,57 @@
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/google/go-github/github"
-	"github.com/nats-io/nats"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/github/contents"
 	"github.com/nicolai86/sisyphus/github/pr"
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/registry"
 	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
 	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
 var (
 	natsURL     string
-	fileStorage storage.RepositoryReaderWriter
-	nc          *nats.Conn
+	fileStorage storage.RepositoryStore
+	credentials storage.CredentialProvider
+	// messageKeyring seals job payloads end to end if set
+	messageKeyring *storage.Keyring
+	concurrency    int
+	backlog        int
+	jobTimeout     time.Duration
+	drainTimeout   time.Duration
+	fetcher        = contents.NewFetcher()
+	// checks skips entries whose manifests are unchanged since their last check
+	checks = contents.NewChecks(nil, 24*time.Hour)
+	// npmRegistry lists the versions of packages whose latest version a
+	// policy refuses
+	npmRegistry string
 )
 
 func init() {
@@ -33,10 +59,24 @@ func init() {
 		dataPath      string
 		bucket        string
 		encryptionKey string
+		keyringPath   string
+		sqlDriver     string
+		sqlDSN        string
+		sealMessages  bool
 	)
 	flag.StringVar(&dataPath, "data-path", "", "data directory")
 	flag.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flag.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
 	flag.StringVar(&encryptionKey, "encryption-key", "", "store everything encrypted")
+	flag.StringVar(&keyringPath, "keyring", "", "keyring file, store everything encrypted with its active key")
+	flag.BoolVar(&sealMessages, "seal-messages", false, "encrypt job payloads with the storage key")
+	flag.IntVar(&concurrency, "concurrency", 2, "maximum number of jobs running at once")
+	flag.IntVar(&backlog, "backlog", 16, "number of received jobs waiting for a free slot")
+	flag.DurationVar(&jobTimeout, "job-timeout", 20*time.Minute, "cancel jobs running longer")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "time running jobs get to finish on SIGTERM")
+	flag.DurationVar(&checks.MaxAge, "recheck-after", 24*time.Hour, "check unchanged manifests again after this long")
+	flag.StringVar(&npmRegistry, "npm-registry", "https://registry.npmjs.org/", "npm registry to find versions allowed by policies, empty to use the wanted version of npm outdated")
 	flag.StringVar(&natsURL, "nats", "tcp://127.0.0.1:4222", "nats server URL")
 	flag.Parse()
 
@@ -46,14 +86,49 @@ func init() {
 	if bucket != "" {
 		fileStorage = storage.NewS3Storage(bucket)
 	}
-	if encryptionKey != "" {
-		fileStorage = storage.NewAESStorage(encryptionKey, fileStorage)
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = sqlStorage
+	}
+	var (
+		keyring storage.Keyring
+		err     error
+	)
+	if keyringPath != "" {
+		keyring, err = storage.LoadKeyring(keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	} else if encryptionKey != "" {
+		keyring, err = storage.NewKeyring("default", storage.Key{ID: "default", Secret: []byte(encryptionKey)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	}
+	credentials = storage.NewStoredCredentials(fileStorage)
+	// shared by all workers, so restarts and other workers skip checks as well
+	if store, ok := fileStorage.(storage.CheckStateStore); ok {
+		checks.Store = store
+	}
+
+	if sealMessages {
+		if keyringPath == "" && encryptionKey == "" {
+			log.Fatal("-seal-messages requires -keyring or -encryption-key")
+		}
+		messageKeyring = &keyring
 	}
 }
 
 type versionInfo struct {
-	Wanted string
-	Latest string
+	// Current is empty for dependencies which are not installed
+	Current string
+	Wanted  string
+	Latest  string
 }
 
 type packageJSON struct {
@@ -87,49 +162,117 @@ type packageJSON struct {
 	PublishConfig        interface{}       `json:"publishConfig,omitempty"`
 }
 
-type config struct {
-	Path     string
-	Language string
-}
-
-type repoConfig struct {
-	Config       config
-	RepositoryID string
-}
-
 var filesToExtract = []string{"package.json"}
 
-func checkDependencies(r storage.Repository, c config) {
+// checkDependencies works in a build directory of its own, which is removed
+// once the check is done
+func checkDependencies(ctx context.Context, r storage.Credentials, c config.Entry, report reporter) error {
 	log.Printf("looking for %q (%q): %q", c.Path, c.Language, filesToExtract)
 
 	owner := strings.Split(r.FullName, "/")[0]
 	repoName := strings.Split(r.FullName, "/")[1]
 
+	if err := os.MkdirAll(fmt.Sprintf("/tmp/build/%s", r.ID), 0700); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("%s-%s", c.Path, c.Language))
-	cachePath := fmt.Sprintf("/tmp/build/%s/%x", r.ID, md5.Sum(data))
-	os.MkdirAll(cachePath, 0700)
+	cachePath, err := ioutil.TempDir(fmt.Sprintf("/tmp/build/%s", r.ID), fmt.Sprintf("%x-", md5.Sum(data)))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(cachePath)
 
+	var files []contents.File
 	for _, file := range filesToExtract {
-		uri := fmt.Sprintf("https://%s@raw.githubusercontent.com/%s/%s/master/%s/%s", r.AccessToken, owner, repoName, c.Path, file)
-		resp, _ := http.Get(uri)
-		f, _ := os.OpenFile(fmt.Sprintf("%s/%s", cachePath, file), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-		io.Copy(f, resp.Body)
-		resp.Body.Close()
+		f, err := fetcher.Fetch(ctx, r.AccessToken, owner, repoName, c.Branch, path.Join(c.Path, file))
+		if err == contents.ErrNotFound {
+			log.Printf("no %s in %q of %s on %q, skipping\n", file, c.Path, r.ID, c.Branch)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to fetch %s: %q", file, err)
+		}
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%s", cachePath, file), f.Content, 0600); err != nil {
+			return err
+		}
+		files = append(files, f)
 	}
 
-	runDependencyCheck(r, c, cachePath)
+	unchanged, err := checks.Unchanged(r.ID, c, files, time.Now())
+	if err != nil {
+		log.Printf("Failed to load the last check of %q in %s: %q\n", c.Path, r.ID, err)
+	}
+	if unchanged {
+		log.Printf("%q of %s on %q is unchanged since its last check, skipping\n", c.Path, r.ID, c.Branch)
+		return nil
+	}
+	if err := runDependencyCheck(ctx, r, c, cachePath, report); err != nil {
+		return err
+	}
+	if err := checks.Succeeded(r.ID, c, files, time.Now()); err != nil {
+		log.Printf("Failed to record the check of %q in %s: %q\n", c.Path, r.ID, err)
+	}
+	return nil
 }
 
-func runDependencyCheck(r storage.Repository, c config, buildPath string) {
+// releases lists the published versions of a package without prereleases.
+// Without a registry, npm's wanted version is the only candidate.
+func releases(ctx context.Context, name string, dep versionInfo) []string {
+	if npmRegistry == "" {
+		return []string{dep.Wanted}
+	}
+	versions, err := registryVersions(ctx, name)
+	if err != nil {
+		log.Printf("Failed to list versions of %q, falling back to %s: %q\n", name, dep.Wanted, err)
+		return []string{dep.Wanted}
+	}
+	return versions
+}
+
+func registryVersions(ctx context.Context, name string) ([]string, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(npmRegistry, "/")+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the abbreviated metadata is enough to list versions
+	req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
+	resp, err := ctxhttp.Do(ctx, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch versions of %s: %s", name, resp.Status)
+	}
+
+	var metadata struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("Failed to decode versions of %s: %v", name, err)
+	}
+	var versions []string
+	for version := range metadata.Versions {
+		if !strings.ContainsAny(version, "-+") {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+func runDependencyCheck(ctx context.Context, r storage.Credentials, c config.Entry, buildPath string, report reporter) error {
 	// docker run --rm -v $(pwd)/outdated.json:/home/checker/outdated.json:rw -v $(pwd)/package.json:/home/checker/package.json:ro -t dep-check-js
-	f, _ := os.OpenFile(fmt.Sprintf("%s/outdated.json", buildPath), os.O_CREATE|os.O_TRUNC, 0600)
+	f, err := os.OpenFile(fmt.Sprintf("%s/outdated.json", buildPath), os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
 	f.Close()
 
 	cli, err := client.NewEnvClient()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	container, err := cli.ContainerCreate(context.Background(), &container.Config{
+	container, err := cli.ContainerCreate(ctx, &container.Config{
 		Image: "dep-check-js",
 	}, &container.HostConfig{
 		AutoRemove: true,
@@ -139,65 +282,202 @@ func runDependencyCheck(r storage.Repository, c config, buildPath string) {
 		},
 	}, nil, "")
 	if err != nil {
-		log.Fatalf(err.Error())
+		return err
 	}
+	// ctx may be done already, the container must go regardless
+	defer cli.ContainerRemove(context.Background(), types.ContainerRemoveOptions{
+		ContainerID: container.ID,
+		Force:       true,
+	})
 
-	if err := cli.ContainerStart(context.Background(), container.ID); err != nil {
-		log.Fatalf(err.Error())
+	if err := cli.ContainerStart(ctx, container.ID); err != nil {
+		return err
 	}
 
-	cli.ContainerWait(context.Background(), container.ID)
-
-	cli.ContainerRemove(context.Background(), types.ContainerRemoveOptions{
-		ContainerID: container.ID,
-	})
+	// npm outdated exits non-zero whenever something is outdated
+	if _, err := cli.ContainerWait(ctx, container.ID); err != nil {
+		return err
+	}
 
 	var dependencies = map[string]versionInfo{}
-	f2, _ := os.Open(fmt.Sprintf("%s/outdated.json", buildPath))
+	f2, err := os.Open(fmt.Sprintf("%s/outdated.json", buildPath))
+	if err != nil {
+		return err
+	}
 	defer f2.Close()
-	json.NewDecoder(f2).Decode(&dependencies)
+	if err := json.NewDecoder(f2).Decode(&dependencies); err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to parse outdated.json: %q", err)
+	}
 
-	f3, _ := os.Open(fmt.Sprintf("%s/package.json", buildPath))
+	f3, err := os.Open(fmt.Sprintf("%s/package.json", buildPath))
+	if err != nil {
+		return err
+	}
 	defer f3.Close()
 	var p packageJSON
-	json.NewDecoder(f3).Decode(&p)
+	if err := json.NewDecoder(f3).Decode(&p); err != nil {
+		return fmt.Errorf("Failed to parse package.json: %q", err)
+	}
 
 	var changedDependencies = []string{}
 	for name, dep := range dependencies {
-		if dep.Latest != dep.Wanted {
-			changedDependencies = append(changedDependencies, name)
+		if dep.Latest == dep.Wanted {
+			continue
 		}
+		if c.Ignored(name) {
+			log.Printf("ignoring %q in %q\n", name, c.Path)
+			continue
+		}
+		current := dep.Current
+		if current == "" {
+			current = dep.Wanted
+		}
+		target, ok := dep.Latest, true
+		if !c.Allows(current, dep.Latest) {
+			target, ok = c.Newest(current, dep.Latest, releases(ctx, name, dep))
+		}
+		if !ok {
+			log.Printf("%s policy of %q skips %q %s -> %s\n", c.Policy, c.Branch, name, current, dep.Latest)
+			continue
+		}
+		// the update targets the newest version the policy allows
+		dep.Latest = target
+		dependencies[name] = dep
+		changedDependencies = append(changedDependencies, name)
 	}
 	if len(changedDependencies) == 0 {
 		log.Printf("Nothing to do for %q %q %q", r.ID, c.Path, c.Language)
-		return
+		return nil
 	}
 
-	for _, name := range changedDependencies {
-		p.Dependencies[name] = dependencies[name].Latest
+	sort.Strings(changedDependencies)
+	report(storage.RunEvent{Type: storage.RunOutdatedFound, Dependencies: changedDependencies})
+
+	for i, group := range c.Groups(changedDependencies) {
+		if err := updateDependencies(ctx, r, c, fmt.Sprintf("%s/package.%d.json", buildPath, i), p, dependencies, group, report); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	f5, err := os.OpenFile(fmt.Sprintf("%s/package.new.json", buildPath), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+// updateDependencies opens a PR updating a group of dependencies, unless
+// there is one already
+func updateDependencies(ctx context.Context, r storage.Credentials, c config.Entry, source string, p packageJSON, dependencies map[string]versionInfo, group []string, report reporter) error {
+	exists, err := hasPR(r, c, group)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if exists {
+		log.Printf("%s has an open PR for %q\n", r.ID, group)
+		report(storage.RunEvent{Type: storage.RunSkippedExistingPR, Dependencies: group})
+		return nil
+	}
+
+	branch, pushed, err := groupBranch(ctx, r, c, dependencies, group)
+	if err != nil {
+		return err
+	}
+	if pushed {
+		// an earlier attempt of this job failed after pushing
+		log.Printf("%s was pushed already\n", branch)
+		return openPR(r, c, branch, group, true, report)
 	}
-	out, _ := json.MarshalIndent(p, "", "  ")
-	f5.Write(out)
 
-	if hasPR(r, c, changedDependencies) {
-		log.Printf("%s has an open PR for %q\n", r.ID, changedDependencies)
-		return
+	// other groups must not see these updates
+	updated := map[string]string{}
+	for name, version := range p.Dependencies {
+		updated[name] = version
 	}
+	for _, name := range group {
+		updated[name] = constraint(updated[name], dependencies[name].Latest, c.Strategy)
+	}
+	p.Dependencies = updated
+
+	f, err := os.OpenFile(source, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(p, "", "  ")
+	_, err = f.Write(out)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
 	log.Printf("pushing new branch to remote…\n")
-	branch := pushChangesToRemote(r, c, buildPath)
+	if err := pushChangesToRemote(ctx, r, c, source, branch); err != nil {
+		return err
+	}
+	return openPR(r, c, branch, group, false, report)
+}
+
+// groupBranch returns the branch updating a group to the latest versions,
+// and whether it was pushed already
+func groupBranch(ctx context.Context, r storage.Credentials, c config.Entry, dependencies map[string]versionInfo, group []string) (string, bool, error) {
+	owner := strings.Split(r.FullName, "/")[0]
+	repo := strings.Split(r.FullName, "/")[1]
+	var versions []string
+	for _, name := range group {
+		versions = append(versions, name+"@"+dependencies[name].Latest)
+	}
+	branch := pr.BranchName(r.FullName, c.Path, c.Branch, versions)
+	exists, err := pr.BranchExists(ctx, r.AccessToken, owner, repo, branch)
+	return branch, exists, err
+}
+
+// openPR opens the PR of a pushed branch. Branches pushed by earlier attempts
+// may have a PR already, which is kept even if closed.
+func openPR(r storage.Credentials, c config.Entry, branch string, group []string, retried bool, report reporter) error {
+	if retried {
+		owner := strings.Split(r.FullName, "/")[0]
+		repo := strings.Split(r.FullName, "/")[1]
+		opened, err := pr.BranchHasPullRequest(r.AccessToken, owner, repo, branch)
+		if err != nil {
+			return err
+		}
+		if opened {
+			log.Printf("%s has a PR for %s already\n", r.ID, branch)
+			report(storage.RunEvent{Type: storage.RunSkippedExistingPR, Dependencies: group, Branch: branch})
+			return nil
+		}
+	}
+
 	log.Printf("creating PR\n")
-	createPR(r, c, branch, changedDependencies)
+	number, err := createPR(r, c, branch, group)
+	if err != nil {
+		return err
+	}
+	report(storage.RunEvent{Type: storage.RunPRCreated, Dependencies: group, Branch: branch, PullRequest: number})
+	return nil
+}
+
+// constraint returns the version range written to package.json for the
+// latest version of a dependency
+func constraint(current, latest, strategy string) string {
+	prefix := ""
+	if strings.HasPrefix(current, "^") || strings.HasPrefix(current, "~") {
+		prefix = current[:1]
+	}
+	switch strategy {
+	case config.StrategyBump:
+		return prefix + latest
+	case config.StrategyWiden:
+		if current == "" {
+			return prefix + latest
+		}
+		return fmt.Sprintf("%s || %s%s", current, prefix, latest)
+	}
+	return latest
 }
 
-func hasPR(r storage.Repository, c config, modifications []string) bool {
+func hasPR(r storage.Credentials, c config.Entry, modifications []string) (bool, error) {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
 	return pr.PullRequestExists(r.AccessToken, owner, repo, func(pr *github.PullRequest) bool {
+		if pr.Body == nil || pr.Base == nil || pr.Base.Ref == nil || *pr.Base.Ref != c.Branch {
+			return false
+		}
 		index := strings.Index(*pr.Body, fmt.Sprintf("```\n# %s dependencies in %s\n", c.Language, c.Path))
 		if index == -1 {
 			return false
@@ -214,71 +494,163 @@ func hasPR(r storage.Repository, c config, modifications []string) bool {
 	})
 }
 
-func createPR(r storage.Repository, c config, branch string, modifications []string) {
+func createPR(r storage.Credentials, c config.Entry, branch string, modifications []string) (int, error) {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
 	out, _ := json.MarshalIndent(modifications, "", "\t")
-	pr.CreatePullRequest(
+	title := fmt.Sprintf("Update %s dependencies in %q", c.Language, c.Path)
+	if c.Group == config.GroupDependency {
+		title = fmt.Sprintf("Update %s in %q", modifications[0], c.Path)
+	}
+	created, err := pr.CreatePullRequest(
 		r.AccessToken,
 		owner,
 		repo,
-		fmt.Sprintf("Update %s dependencies in %q", c.Language, c.Path),
+		title,
 		branch,
+		c.Branch,
 		fmt.Sprintf(
 			`This PR updates dependencies, which have not been covered by your versions so far: %s`,
 			fmt.Sprintf("\n\n ```\n# %s dependencies in %s\n%s\n```", c.Language, c.Path, out),
 		),
 	)
+	if err != nil {
+		return 0, err
+	}
+	if created == nil || created.Number == nil {
+		return 0, fmt.Errorf("github returned no number for the PR of %s", branch)
+	}
+
+	// the PR exists already, so failing to decorate it must not fail the job
+	if len(c.Labels) > 0 {
+		if err := pr.AddLabels(r.AccessToken, owner, repo, *created.Number, c.Labels); err != nil {
+			log.Printf("Failed to label PR #%d of %s: %q\n", *created.Number, r.ID, err)
+		}
+	}
+	if len(c.Reviewers) > 0 {
+		if err := pr.RequestReviewers(r.AccessToken, owner, repo, *created.Number, c.Reviewers); err != nil {
+			log.Printf("Failed to request reviews for PR #%d of %s: %q\n", *created.Number, r.ID, err)
+		}
+	}
+	return *created.Number, nil
 }
 
-func pushChangesToRemote(r storage.Repository, c config, buildPath string) string {
+func pushChangesToRemote(ctx context.Context, r storage.Credentials, c config.Entry, source, branch string) error {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
-	branch, err := pr.PublishChanges(r.AccessToken, owner, repo, []pr.UpdateFile{
+	return pr.PublishChanges(ctx, r.AccessToken, owner, repo, c.Branch, branch, []pr.UpdateFile{
 		pr.UpdateFile{
-			Source:      fmt.Sprintf("%s/package.new.json", buildPath),
+			Source:      source,
 			Destination: fmt.Sprintf("%s/package.json", c.Path),
 		},
 	})
+}
+
+// reporter records the lifecycle of a single job
+type reporter func(storage.RunEvent)
+
+func newReporter(job jobs.Job, rc messages.DependencyCheck) reporter {
+	return func(event storage.RunEvent) {
+		history, ok := fileStorage.(storage.RunHistoryStore)
+		if !ok {
+			return
+		}
+
+		event.RepositoryID = rc.RepositoryID
+		event.JobID = job.JobID
+		event.CorrelationID = job.CorrelationID
+		event.Time = time.Now().UTC()
+		event.Plugin = "greenkeep"
+		event.Path = rc.Config.Path
+		event.Language = rc.Config.Language
+		if err := history.StoreRunEvent(event); err != nil {
+			log.Printf("Failed to record %s of job %s: %q\n", event.Type, job.JobID, err)
+		}
+	}
+}
+
+// handle checks the entry of a job for outdated dependencies
+func handle(ctx context.Context, job jobs.Job) error {
+	var rc messages.DependencyCheck
+	if err := job.Decode(&rc); err != nil {
+		return err
+	}
+	log.Printf("received request for %q (job %s, attempt %d)\n", rc.RepositoryID, job.JobID, job.Attempt)
+
+	r, err := credentials.Credentials(rc.RepositoryID)
+	if err == storage.ErrNotFound {
+		log.Printf("unknown repository %q, skipping\n", rc.RepositoryID)
+		return nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Failed to resolve credentials: %q", err)
+	}
+
+	// the master resolves the base branch of every entry
+	if rc.Config.Branch == "" {
+		rc.Config.Branch = r.DefaultBranch
+	}
+	if rc.Config.Branch == "" {
+		return fmt.Errorf("no base branch for %q in %s", rc.Config.Path, r.ID)
+	}
+
+	report := newReporter(job, rc)
+	report(storage.RunEvent{Type: storage.RunStarted})
+	if err := checkDependencies(ctx, r, rc.Config, report); err != nil {
+		report(storage.RunEvent{Type: storage.RunFailed, Error: err.Error()})
+		return err
 	}
-	return branch
+	return nil
+}
+
+// serve receives the dependency checks of the master on t
+func serve(t transport.Transport) (*jobs.Worker, error) {
+	worker := jobs.NewWorker("greenkeep-javascript", handle)
+	worker.Concurrency = concurrency
+	worker.Backlog = backlog
+	worker.Timeout = jobTimeout
+	worker.Keyring = messageKeyring
+	if err := worker.Subscribe(t, "greenkeep-javascript"); err != nil {
+		return nil, err
+	}
+	return worker, t.Flush()
 }
 
 func main() {
 	log.Printf("greenkeepr dependency worker for javascript running")
 
-	nc1, err := nats.Connect(natsURL)
+	nc, err := transport.Connect(natsURL)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer nc1.Close()
-	nc = nc1
-
-	nc.Subscribe("greenkeep-javascript", func(msg *nats.Msg) {
-		repos, err := fileStorage.Load()
-		if err != nil {
-			log.Fatalf("Failed to read repo storages: %q\n", err)
-		}
+	defer nc.Close()
 
-		var rc repoConfig
-		if err := json.NewDecoder(bytes.NewBuffer(msg.Data)).Decode(&rc); err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("received request for %q\n", rc.RepositoryID)
+	worker, err := serve(nc)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		var r storage.Repository
-		for _, repo := range repos {
-			if repo.ID == rc.RepositoryID {
-				r = repo
-				break
-			}
-		}
+	announcer, err := registry.Announce(nc, registry.Plugin{
+		Name:      "greenkeep",
+		Subject:   "greenkeep-javascript",
+		Languages: []string{"javascript"},
+	}, registry.DefaultInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		go checkDependencies(r, rc.Config)
-	})
-	nc.Flush()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
 
-	select {}
+	// stop receiving new jobs routed by the master before draining
+	if err := announcer.Close(); err != nil {
+		log.Printf("Failed to leave the registry: %q\n", err)
+	}
+	log.Printf("draining jobs…\n")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := worker.Drain(ctx); err != nil {
+		log.Printf("Failed to drain jobs: %q\n", err)
+	}
 }
@@ -1,99 +1,422 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/nats-io/nats"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/github/contents"
+	"github.com/nicolai86/sisyphus/github/issue"
+	"github.com/nicolai86/sisyphus/github/repo"
+	"github.com/nicolai86/sisyphus/github/tree"
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/registry"
 	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
 )
 
 var (
 	natsURL     string
-	fileStorage storage.RepositoryReaderWriter
-	nc          *nats.Conn
+	fileStorage storage.RepositoryStore
+	credentials storage.CredentialProvider
+	// messageKeyring seals job payloads end to end if set
+	messageKeyring *storage.Keyring
+	concurrency    int
+	backlog        int
+	jobTimeout     time.Duration
+	drainTimeout   time.Duration
+	// autodetect fans out every manifest found if .sisyphus is missing
+	autodetect bool
+	// queueName keeps the pending jobs of this master apart from others
+	queueName string
+	// fetcher revalidates .sisyphus files instead of downloading them again
+	fetcher = contents.NewFetcher()
 )
 
-func init() {
+// configure reads the flags. It runs from main rather than init, so the
+// tests of this package parse their own flags.
+func configure() {
 	var (
 		dataPath      string
 		bucket        string
 		encryptionKey string
+		keyringPath   string
+		sqlDriver     string
+		sqlDSN        string
+		sealMessages  bool
 	)
 	flag.StringVar(&dataPath, "data-path", "", "data directory")
 	flag.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flag.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
 	flag.StringVar(&encryptionKey, "encryption-key", "", "store everything encrypted")
+	flag.StringVar(&keyringPath, "keyring", "", "keyring file, store everything encrypted with its active key")
+	flag.BoolVar(&sealMessages, "seal-messages", false, "encrypt job payloads with the storage key")
+	flag.IntVar(&concurrency, "concurrency", 4, "maximum number of jobs running at once")
+	flag.IntVar(&backlog, "backlog", 16, "number of received jobs waiting for a free slot")
+	flag.DurationVar(&jobTimeout, "job-timeout", time.Minute, "cancel jobs running longer")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "time running jobs get to finish on SIGTERM")
+	flag.BoolVar(&autodetect, "autodetect", false, "detect manifests in repositories without .sisyphus")
 	flag.StringVar(&natsURL, "nats", "tcp://127.0.0.1:4222", "nats server URL")
+	flag.StringVar(&queueName, "queue", "", "name of the pending jobs in storage, unique for every master sharing a storage and stable across restarts")
 	flag.Parse()
 
+	if queueName == "" {
+		log.Fatal("-queue is required, as replicas sharing a name take over each other's jobs")
+	}
+
 	if dataPath != "" {
 		fileStorage = storage.NewFileStorage(dataPath)
 	}
 	if bucket != "" {
 		fileStorage = storage.NewS3Storage(bucket)
 	}
-	if encryptionKey != "" {
-		fileStorage = storage.NewAESStorage(encryptionKey, fileStorage)
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = sqlStorage
+	}
+	var (
+		keyring storage.Keyring
+		err     error
+	)
+	if keyringPath != "" {
+		keyring, err = storage.LoadKeyring(keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	} else if encryptionKey != "" {
+		keyring, err = storage.NewKeyring("default", storage.Key{ID: "default", Secret: []byte(encryptionKey)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	}
+	credentials = storage.NewStoredCredentials(fileStorage)
+
+	if sealMessages {
+		if keyringPath == "" && encryptionKey == "" {
+			log.Fatal("-seal-messages requires -keyring or -encryption-key")
+		}
+		messageKeyring = &keyring
 	}
 }
 
-type config struct {
-	Path     string
-	Language string
+// scheduleKey identifies the schedule state of a single entry
+func scheduleKey(c config.Entry) string {
+	return fmt.Sprintf("greenkeep:%s:%s", c.Language, c.Path)
+}
+
+// entryDue reports whether an entry is due, and returns the state to record
+// once its run was dispatched. Entries without a schedule of their own run
+// whenever the repository is scheduled.
+func entryDue(r storage.Credentials, c config.Entry, now time.Time) (bool, *storage.ScheduleState) {
+	if c.Schedule == nil {
+		return true, nil
+	}
+	stateStore, ok := fileStorage.(storage.ScheduleStateStore)
+	if !ok {
+		return true, nil
+	}
+
+	state, err := stateStore.LoadScheduleState(r.ID, scheduleKey(c))
+	found := err == nil
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("Failed to load schedule state: %q\n", err)
+		return true, nil
+	}
+
+	next, err := c.Schedule.Next(state.LastRun, now)
+	if err != nil {
+		log.Printf("invalid schedule for %q in %s: %q\n", c.Path, r.ID, err)
+		return false, nil
+	}
+	if found {
+		next = state.NextRun
+	}
+
+	due := !next.After(now)
+	update := storage.ScheduleState{
+		RepositoryID: r.ID,
+		Plugin:       scheduleKey(c),
+		LastRun:      state.LastRun,
+		NextRun:      next,
+	}
+	if due {
+		update.LastRun = now
+		update.NextRun, _ = c.Schedule.Next(now, now)
+	}
+	if due || !found {
+		return due, &update
+	}
+	return due, nil
 }
 
-type repoConfig struct {
-	Config       config
-	RepositoryID string
+// storeScheduleState records the state returned by entryDue, if any
+func storeScheduleState(r storage.Credentials, c config.Entry, state *storage.ScheduleState) {
+	if state == nil {
+		return
+	}
+	if err := fileStorage.(storage.ScheduleStateStore).StoreScheduleState(*state); err != nil {
+		log.Printf("Failed to persist schedule of %q in %s: %q\n", c.Path, r.ID, err)
+	}
 }
 
-type greenkeepConfig struct {
-	Greenkeep []config `json:"greenkeep"`
+// resolveDefaultBranch asks github for the default branch of repositories
+// stored before it was detected, and stores it
+func resolveDefaultBranch(r storage.Credentials) (string, error) {
+	if r.DefaultBranch != "" {
+		return r.DefaultBranch, nil
+	}
+
+	owner := strings.Split(r.FullName, "/")[0]
+	repoName := strings.Split(r.FullName, "/")[1]
+	branch, err := repo.DefaultBranch(r.AccessToken, owner, repoName)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := fileStorage.Get(r.ID)
+	if err != nil {
+		return "", err
+	}
+	stored.DefaultBranch = branch
+	if err := fileStorage.Store(stored); err != nil {
+		log.Printf("Failed to store the default branch of %s: %q\n", r.ID, err)
+	}
+	return branch, nil
 }
 
-func main() {
-	log.Printf("greenkeepr dependency worker running")
+// invalidConfigTitle is the title of issues opened for invalid .sisyphus files
+const invalidConfigTitle = "sisyphus: invalid .sisyphus configuration"
+
+// reportInvalidConfig tells the repository owner about an invalid .sisyphus
+// file through an issue and the run history
+func reportInvalidConfig(job jobs.Job, r storage.Credentials, configErr error) error {
+	if history, ok := fileStorage.(storage.RunHistoryStore); ok {
+		if err := history.StoreRunEvent(storage.RunEvent{
+			RepositoryID:  r.ID,
+			JobID:         job.JobID,
+			CorrelationID: job.CorrelationID,
+			Type:          storage.RunInvalidConfig,
+			Time:          time.Now().UTC(),
+			Plugin:        "greenkeep",
+			Path:          ".sisyphus",
+			Error:         configErr.Error(),
+		}); err != nil {
+			log.Printf("Failed to record invalid config of %s: %q\n", r.ID, err)
+		}
+	}
+
+	var problems []string
+	if errs, ok := configErr.(config.Errors); ok {
+		for _, err := range errs {
+			problems = append(problems, fmt.Sprintf("- `%s`", err))
+		}
+	} else {
+		problems = append(problems, fmt.Sprintf("- `%s`", configErr))
+	}
+	body := fmt.Sprintf(
+		"sisyphus skips this repository until its `.sisyphus` file is fixed:\n\n%s\n",
+		strings.Join(problems, "\n"),
+	)
 
-	nc1, err := nats.Connect(natsURL)
+	owner := strings.Split(r.FullName, "/")[0]
+	repoName := strings.Split(r.FullName, "/")[1]
+	number, err := issue.Report(r.AccessToken, owner, repoName, invalidConfigTitle, body)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Failed to report invalid .sisyphus: %q", err)
+	}
+	log.Printf("reported invalid .sisyphus of %s in issue #%d\n", r.ID, number)
+	return nil
+}
+
+// reportUnsupported records entries whose language no live worker serves
+func reportUnsupported(job jobs.Job, r storage.Credentials, c config.Entry) {
+	log.Printf("unsupported language %q for %q in %s, skipping\n", c.Language, c.Path, r.ID)
+	history, ok := fileStorage.(storage.RunHistoryStore)
+	if !ok {
+		return
 	}
-	defer nc1.Close()
-	nc = nc1
+	if err := history.StoreRunEvent(storage.RunEvent{
+		RepositoryID:  r.ID,
+		JobID:         job.JobID,
+		CorrelationID: job.CorrelationID,
+		Type:          storage.RunUnsupported,
+		Time:          time.Now().UTC(),
+		Plugin:        "greenkeep",
+		Path:          c.Path,
+		Language:      c.Language,
+		Branch:        c.Branch,
+		Error:         fmt.Sprintf("unsupported language: no live worker serves %s", c.Plugin()),
+	}); err != nil {
+		log.Printf("Failed to record unsupported language of %s: %q\n", r.ID, err)
+	}
+}
 
-	nc.Subscribe("greenkeep", func(msg *nats.Msg) {
-		var r storage.Repository
-		json.Unmarshal(msg.Data, &r)
+// fanOut dispatches a job to the language worker of every due entry in the
+// .sisyphus of a repository
+func fanOut(dispatcher *jobs.Dispatcher, plugins *registry.Registry) jobs.Handler {
+	return func(ctx context.Context, job jobs.Job) error {
+		var run messages.PluginRun
+		if err := job.Decode(&run); err != nil {
+			return err
+		}
+		r, err := credentials.Credentials(run.RepositoryID)
+		if err == storage.ErrNotFound {
+			log.Printf("unknown repository %q, skipping\n", run.RepositoryID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to resolve credentials: %q", err)
+		}
 
 		owner := strings.Split(r.FullName, "/")[0]
 		repoName := strings.Split(r.FullName, "/")[1]
-		uri := fmt.Sprintf("https://%s@raw.githubusercontent.com/%s/%s/master/.sisyphus", r.AccessToken, owner, repoName)
-		resp, _ := http.Get(uri)
-		bs, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		var m greenkeepConfig
-		json.Unmarshal(bs, &m)
+		defaultBranch, err := resolveDefaultBranch(r)
+		if err != nil {
+			return fmt.Errorf("Failed to detect the default branch: %q", err)
+		}
+		file, err := fetcher.Fetch(ctx, r.AccessToken, owner, repoName, defaultBranch, ".sisyphus")
+		var m config.File
+		switch {
+		case err == contents.ErrNotFound && !autodetect:
+			log.Printf("%s has no .sisyphus, skipping\n", r.ID)
+			return nil
+		case err == contents.ErrNotFound:
+			files, err := tree.Files(r.AccessToken, owner, repoName, defaultBranch)
+			if err != nil {
+				return fmt.Errorf("Failed to list files: %q", err)
+			}
+			m = config.Detect(files)
+			log.Printf("%s has no .sisyphus, detected %d entries\n", r.ID, len(m.Greenkeep))
+		case err != nil:
+			return fmt.Errorf("Failed to fetch .sisyphus: %q", err)
+		default:
+			m, err = config.Parse(file.Content)
+			if err != nil {
+				log.Printf("invalid .sisyphus in %s: %q\n", r.ID, err)
+				// retrying won't help, the owner has to fix the file
+				return reportInvalidConfig(job, r, err)
+			}
+			if m.HasPatterns() {
+				files, err := tree.Files(r.AccessToken, owner, repoName, defaultBranch)
+				if err != nil {
+					return fmt.Errorf("Failed to list files: %q", err)
+				}
+				m = m.Expand(files)
+			}
+		}
 
 		for _, c := range m.Greenkeep {
-			log.Printf("fan-out for %q and %q (%q)", r.ID, c.Language, c.Path)
-			b, err := json.Marshal(&repoConfig{
-				Config:       c,
-				RepositoryID: r.ID,
-			})
-			if err != nil {
-				log.Fatal(err)
+			// checked first, so unsupported entries keep their schedule
+			if !plugins.Serves(c.Plugin()) {
+				reportUnsupported(job, r, c)
+				continue
+			}
+			due, state := entryDue(r, c, time.Now())
+			if !due {
+				storeScheduleState(r, c, state)
+				continue
 			}
-			nc.Publish(fmt.Sprintf("greenkeep-%s", c.Language), b)
-			nc.Flush()
+			for _, target := range c.Targets(defaultBranch) {
+				id, err := dispatcher.DispatchFrom(job, target.Plugin(), &messages.DependencyCheck{
+					Config:       target,
+					RepositoryID: r.ID,
+				})
+				if err != nil {
+					return err
+				}
+				log.Printf("fan-out for %q and %q (%q on %q) as job %s", r.ID, target.Language, target.Path, target.Branch, id)
+			}
+			// only recorded now, so failed dispatches are retried with the job
+			storeScheduleState(r, c, state)
 		}
-	})
-	nc.Flush()
+		return nil
+	}
+}
+
+// serve receives the jobs of the scheduler on t, and dispatches their fan-out
+// on t as well
+func serve(t transport.Transport, plugins *registry.Registry) (*jobs.Worker, *jobs.Dispatcher, error) {
+	dispatcher := jobs.NewDispatcher(t)
+	dispatcher.Keyring = messageKeyring
+	if queue, ok := fileStorage.(storage.JobQueueStore); ok {
+		dispatcher.Queue, dispatcher.QueueName = queue, queueName
+	}
+
+	worker := jobs.NewWorker("greenkeep", fanOut(dispatcher, plugins))
+	worker.Concurrency = concurrency
+	worker.Backlog = backlog
+	worker.Timeout = jobTimeout
+	worker.Keyring = messageKeyring
+	if err := worker.Subscribe(t, "greenkeep"); err != nil {
+		return nil, nil, err
+	}
+	return worker, dispatcher, t.Flush()
+}
+
+func main() {
+	configure()
+	log.Printf("greenkeepr dependency worker running")
+
+	nc, err := transport.Connect(natsURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nc.Close()
+
+	plugins, err := registry.New(nc, registry.DefaultTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer plugins.Close()
+
+	worker, dispatcher, err := serve(nc, plugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	announcer, err := registry.Announce(nc, registry.Plugin{Name: "greenkeep", Subject: "greenkeep"}, registry.DefaultInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	select {}
+	// fan-outs of a previous run which were not acknowledged yet
+	if n, err := dispatcher.Resume(); err != nil {
+		log.Printf("Failed to resume pending jobs: %q\n", err)
+	} else if n > 0 {
+		log.Printf("resumed %d pending jobs\n", n)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if err := announcer.Close(); err != nil {
+		log.Printf("Failed to leave the registry: %q\n", err)
+	}
+	log.Printf("draining jobs…\n")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := worker.Drain(ctx); err != nil {
+		log.Printf("Failed to drain jobs: %q\n", err)
+	}
+	// the fan-out of drained jobs still has to reach the language workers
+	if err := dispatcher.Drain(ctx); err != nil {
+		log.Printf("Failed to drain fan-out: %q\n", err)
+	}
 }
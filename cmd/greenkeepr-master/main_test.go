@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/github/contents"
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/registry"
+	"github.com/nicolai86/sisyphus/schedule"
+	"github.com/nicolai86/sisyphus/scheduler"
+	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
+)
+
+// Test_Pipeline runs the scheduler, the master and a fake ruby worker on a
+// single in-memory transport
+func Test_Pipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greenkeepr-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStorage = storage.NewFileStorage(dir)
+	credentials = storage.NewStoredCredentials(fileStorage)
+	concurrency, backlog = 1, 1
+	if err := fileStorage.Store(storage.Repository{
+		ID:            "1",
+		FullName:      "nicolai86/sisyphus",
+		AccessToken:   "token",
+		DefaultBranch: "master",
+		Plugins:       []string{"greenkeep"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/nicolai86/sisyphus/contents/.sisyphus" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("greenkeep:\n  - path: .\n    language: ruby\n"))
+	}))
+	defer github.Close()
+	fetcher = &contents.Fetcher{BaseURL: github.URL + "/"}
+
+	m := transport.NewMemory()
+	defer m.Close()
+
+	checks := make(chan messages.DependencyCheck, 1)
+	ruby := jobs.NewWorker("greenkeep-ruby", func(ctx context.Context, job jobs.Job) error {
+		var check messages.DependencyCheck
+		if err := job.Decode(&check); err != nil {
+			return err
+		}
+		checks <- check
+		return nil
+	})
+	if err := ruby.Subscribe(m, "greenkeep-ruby"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []registry.Plugin{
+		{Name: "greenkeep", Subject: "greenkeep"},
+		{Name: "greenkeep", Subject: "greenkeep-ruby", Languages: []string{"ruby"}},
+	} {
+		announcer, err := registry.Announce(m, p, registry.DefaultInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer announcer.Close()
+	}
+	plugins, err := registry.New(m, registry.DefaultTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugins.Close()
+
+	if _, _, err := serve(m, plugins); err != nil {
+		t.Fatal(err)
+	}
+	s, err := scheduler.New(fileStorage, jobs.NewDispatcher(m), plugins, schedule.Spec{Interval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Dispatch(time.Now())
+
+	select {
+	case check := <-checks:
+		if check.RepositoryID != "1" || check.Config.Path != "." || check.Config.Branch != "master" {
+			t.Fatalf("Expected a check of . in 1 on master, but got %#v", check)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the ruby worker to receive a dependency check, but it never did")
+	}
+}
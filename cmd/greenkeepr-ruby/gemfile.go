@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Gemfile is a tokenized Gemfile. Edits only touch the version constraints
+// of gem statements, everything else is kept byte for byte.
+type Gemfile struct {
+	src  []byte
+	Gems []Gem
+	// edits of every gem statement, by its index
+	edits map[int][]edit
+}
+
+// Gem is a single gem statement
+type Gem struct {
+	Name string
+	// Requirements are the version constraints, like "~> 2.1"
+	Requirements []string
+	// Groups are set by the group blocks around the statement
+	Groups []string
+	Line   int
+
+	name         literal
+	requirements []literal
+}
+
+// literal is a string literal of the source, including its quotes
+type literal struct {
+	start, end int
+	quote      byte
+	value      string
+}
+
+type tokenKind int
+
+const (
+	tokenString tokenKind = iota
+	tokenIdent
+	tokenLabel
+	tokenSymbol
+	tokenArrow
+	tokenComma
+	tokenOpen
+	tokenClose
+	tokenNewline
+	tokenComment
+	tokenOther
+)
+
+type token struct {
+	kind tokenKind
+	literal
+	line int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// tokenize splits src into the tokens needed to find gem statements
+func tokenize(src []byte) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		start := i
+		emit := func(kind tokenKind, end int) {
+			tokens = append(tokens, token{kind: kind, literal: literal{start: start, end: end, value: string(src[start:end])}, line: line})
+			i = end
+		}
+
+		switch {
+		case c == '\n':
+			emit(tokenNewline, i+1)
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			end := i
+			for end < len(src) && src[end] != '\n' {
+				end++
+			}
+			emit(tokenComment, end)
+		case c == '\'' || c == '"':
+			end := i + 1
+			startLine := line
+			var value []byte
+			for ; end < len(src) && src[end] != c; end++ {
+				if src[end] == '\n' {
+					line++
+				}
+				if src[end] == '\\' && end+1 < len(src) {
+					end++
+				}
+				value = append(value, src[end])
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", startLine)
+			}
+			tokens = append(tokens, token{kind: tokenString, literal: literal{start: start, end: end + 1, quote: c, value: string(value)}, line: startLine})
+			i = end + 1
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(src) && isIdent(src[end]) {
+				end++
+			}
+			if end < len(src) && (src[end] == '?' || src[end] == '!') {
+				end++
+			}
+			if end < len(src) && src[end] == ':' && (end+1 >= len(src) || src[end+1] != ':') {
+				emit(tokenLabel, end+1)
+				continue
+			}
+			emit(tokenIdent, end)
+		case c == ':' && i+1 < len(src) && isIdentStart(src[i+1]):
+			end := i + 1
+			for end < len(src) && isIdent(src[end]) {
+				end++
+			}
+			emit(tokenSymbol, end)
+		case c == '=' && i+1 < len(src) && src[i+1] == '>':
+			emit(tokenArrow, i+2)
+		case c == ',':
+			emit(tokenComma, i+1)
+		case c == '(' || c == '[' || c == '{':
+			emit(tokenOpen, i+1)
+		case c == ')' || c == ']' || c == '}':
+			emit(tokenClose, i+1)
+		case c == ';':
+			// statements separated by semicolons behave like lines
+			emit(tokenNewline, i+1)
+		default:
+			emit(tokenOther, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+// ParseGemfile finds all gem statements of src
+func ParseGemfile(src []byte) (*Gemfile, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gemfile{src: src, edits: map[int][]edit{}}
+	// every open block holds the groups it adds
+	var stack [][]string
+	for i := 0; i < len(tokens); {
+		t := tokens[i]
+		if t.kind == tokenNewline || t.kind == tokenComment {
+			i++
+			continue
+		}
+
+		if t.kind == tokenIdent && t.value == "gem" {
+			gem, next := parseGem(tokens[i:], stack)
+			if gem != nil {
+				g.Gems = append(g.Gems, *gem)
+			}
+			i += next
+			continue
+		}
+
+		statement := i
+		for i < len(tokens) && tokens[i].kind != tokenNewline {
+			i++
+		}
+		tokens := tokens[statement:i]
+
+		switch {
+		case t.kind == tokenIdent && t.value == "end":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case opensBlock(tokens):
+			// every block is closed by an end, but only group blocks add groups
+			var groups []string
+			if t.kind == tokenIdent && t.value == "group" {
+				for _, arg := range tokens[1:] {
+					if arg.kind == tokenSymbol {
+						groups = append(groups, arg.value[1:])
+					}
+					if arg.kind == tokenString {
+						groups = append(groups, arg.value)
+					}
+				}
+			}
+			stack = append(stack, groups)
+		}
+	}
+	return g, nil
+}
+
+// keywords opening a block when they start a statement
+var keywords = []string{"if", "unless", "case", "begin", "def", "while", "until", "class", "module"}
+
+// opensBlock reports whether a statement needs an end, like group … do or
+// a leading if
+func opensBlock(tokens []token) bool {
+	if tokens[0].kind == tokenIdent && contains(keywords, tokens[0].value) {
+		return true
+	}
+	for _, t := range tokens {
+		if t.kind == tokenIdent && t.value == "do" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGem reads a gem statement, which continues on the next line after a
+// trailing comma. It returns the number of tokens consumed.
+func parseGem(tokens []token, stack [][]string) (*Gem, int) {
+	i := 1
+	if i < len(tokens) && tokens[i].kind == tokenOpen && tokens[i].value == "(" {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].kind != tokenString {
+		for i < len(tokens) && tokens[i].kind != tokenNewline {
+			i++
+		}
+		return nil, i
+	}
+
+	gem := &Gem{Name: tokens[i].value, Line: tokens[i].line, name: tokens[i].literal}
+	for _, groups := range stack {
+		gem.Groups = append(gem.Groups, groups...)
+	}
+	i++
+
+	// constraints are the strings up to the first option
+	options := false
+	for i < len(tokens) && tokens[i].kind == tokenComma {
+		i++
+		for i < len(tokens) && (tokens[i].kind == tokenNewline || tokens[i].kind == tokenComment) {
+			i++
+		}
+		if i >= len(tokens) {
+			return gem, i
+		}
+		arg := tokens[i]
+		if !options && arg.kind == tokenString && (i+1 >= len(tokens) || tokens[i+1].kind != tokenArrow) {
+			gem.Requirements = append(gem.Requirements, arg.value)
+			gem.requirements = append(gem.requirements, arg.literal)
+			i++
+			continue
+		}
+		options = true
+		// skip the option, including nested lists and hashes
+		depth := 0
+		for ; i < len(tokens); i++ {
+			if tokens[i].kind == tokenOpen {
+				depth++
+			}
+			if tokens[i].kind == tokenClose {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+			if (tokens[i].kind == tokenComma || tokens[i].kind == tokenNewline) && depth == 0 {
+				break
+			}
+		}
+	}
+	return gem, i
+}
+
+// Bytes returns the Gemfile with all edits applied
+func (g *Gemfile) Bytes() []byte {
+	var edits []edit
+	for _, e := range g.edits {
+		edits = append(edits, e...)
+	}
+	// later edits first, so earlier offsets stay valid
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+
+	src := append([]byte{}, g.src...)
+	for _, e := range edits {
+		src = append(src[:e.start], append([]byte(e.replacement), src[e.end:]...)...)
+	}
+	return src
+}
+
+type edit struct {
+	start, end  int
+	replacement string
+}
+
+func quote(s string, q byte) string {
+	if q == '"' {
+		s = strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1)
+	} else {
+		s = strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1)
+	}
+	return string(q) + s + string(q)
+}
+
+func quoteAll(requirements []string, q byte) string {
+	quoted := make([]string, len(requirements))
+	for i, r := range requirements {
+		quoted[i] = quote(r, q)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// SetRequirements replaces the version constraints of all gem statements
+// of name, keeping the quotes used. It reports whether a statement was found.
+func (g *Gemfile) SetRequirements(name string, requirements []string) bool {
+	return g.UpdateRequirements(name, func([]string) []string { return requirements })
+}
+
+// UpdateRequirements replaces the version constraints of every gem statement
+// of name with the result of update. It reports whether a statement was found.
+func (g *Gemfile) UpdateRequirements(name string, update func(current []string) []string) bool {
+	found := false
+	for i := range g.Gems {
+		gem := &g.Gems[i]
+		if gem.Name != name {
+			continue
+		}
+		found = true
+		requirements := update(gem.Requirements)
+
+		var edits []edit
+		old := gem.requirements
+		switch {
+		case len(old) == len(requirements):
+			for j, r := range old {
+				edits = append(edits, edit{r.start, r.end, quote(requirements[j], r.quote)})
+			}
+		case len(old) == 0:
+			edits = append(edits, edit{gem.name.end, gem.name.end, ", " + quoteAll(requirements, gem.name.quote)})
+		case len(requirements) == 0:
+			edits = append(edits, edit{gem.name.end, old[len(old)-1].end, ""})
+		default:
+			edits = append(edits, edit{old[0].start, old[len(old)-1].end, quoteAll(requirements, old[0].quote)})
+		}
+		g.edits[i] = edits
+		gem.Requirements = append([]string{}, requirements...)
+	}
+	return found
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseGemfile_Statements(t *testing.T) {
+	bs, err := ioutil.ReadFile("./fakes/Gemfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gemfile, err := ParseGemfile(bs)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	gems := map[string]Gem{}
+	for _, gem := range gemfile.Gems {
+		gems[gem.Name] = gem
+	}
+	cases := []struct {
+		name         string
+		requirements []string
+		groups       []string
+	}{
+		{"rails", nil, nil},
+		{"rvm-capistrano", []string{">= 1.2.0"}, nil},
+		{"rack-cors", nil, nil},
+		{"capybara", nil, []string{"test"}},
+		{"byebug", nil, []string{"test", "development"}},
+		{"font-awesome-rails", []string{"~> 3.1.1.1"}, []string{"assets"}},
+		{"globalize", []string{"~> 3.0.0"}, nil},
+		{"Ascii85", nil, nil},
+	}
+	for _, c := range cases {
+		gem, ok := gems[c.name]
+		if !ok {
+			t.Fatalf("Expected %q to be found, but it was not", c.name)
+		}
+		if !reflect.DeepEqual(gem.Requirements, c.requirements) {
+			t.Fatalf("Expected %q to require %q, but got %q", c.name, c.requirements, gem.Requirements)
+		}
+		if !reflect.DeepEqual(gem.Groups, c.groups) {
+			t.Fatalf("Expected %q to be in groups %q, but got %q", c.name, c.groups, gem.Groups)
+		}
+	}
+}
+
+func Test_ParseGemfile_Blocks(t *testing.T) {
+	gemfile, err := ParseGemfile([]byte(`group :development do
+  if ENV['DEBUGGER']; gem 'byebug'; end
+  %w[guard guard-rspec].each do |name|
+    gem name
+  end
+  gem 'pry'
+end
+unless RUBY_PLATFORM =~ /java/
+  gem 'pg'
+end
+gem 'rake'
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := map[string][]string{
+		"byebug": {"development"},
+		"pry":    {"development"},
+		"pg":     nil,
+		"rake":   nil,
+	}
+	if len(gemfile.Gems) != len(expected) {
+		t.Fatalf("Expected %d gems, but got %#v", len(expected), gemfile.Gems)
+	}
+	for _, gem := range gemfile.Gems {
+		if !reflect.DeepEqual(gem.Groups, expected[gem.Name]) {
+			t.Fatalf("Expected %q to be in groups %q, but got %q", gem.Name, expected[gem.Name], gem.Groups)
+		}
+	}
+}
+
+func Test_Gemfile_SetRequirements(t *testing.T) {
+	cases := []struct {
+		source       string
+		requirements []string
+		expected     string
+	}{
+		{"  gem 'rake', '~> 10.0' # build\n", []string{"~> 11.0"}, "  gem 'rake', '~> 11.0' # build\n"},
+		{"gem \"rake\", require: false\n", []string{"11.2.2"}, "gem \"rake\", \"11.2.2\", require: false\n"},
+		{"gem 'rake','>= 10', '< 11', :require => false\n", []string{"~> 11.2"}, "gem 'rake','~> 11.2', :require => false\n"},
+		{"gem 'rake', '>= 10'\n", []string{">= 10", "< 12"}, "gem 'rake', '>= 10', '< 12'\n"},
+		{"gem 'rake', '10.0.0'\n", nil, "gem 'rake'\n"},
+		{"gem('rake', '10.0.0')\n", []string{"11.2.2"}, "gem('rake', '11.2.2')\n"},
+		{"gem 'rake',\n    '~> 10.0',\n    platforms: [:ruby, :jruby]\n", []string{"~> 11.2"}, "gem 'rake',\n    '~> 11.2',\n    platforms: [:ruby, :jruby]\n"},
+		{"gem 'rake', github: 'ruby/rake', branch: 'master'\ngem 'rack'\n", []string{"11.2.2"}, "gem 'rake', '11.2.2', github: 'ruby/rake', branch: 'master'\ngem 'rack'\n"},
+		{"platforms :ruby do\n\tgem 'rake' if true\nend\n", []string{"11.2.2"}, "platforms :ruby do\n\tgem 'rake', '11.2.2' if true\nend\n"},
+	}
+	for _, c := range cases {
+		gemfile, err := ParseGemfile([]byte(c.source))
+		if err != nil {
+			t.Fatalf("Expected no error for %q, but got %v", c.source, err)
+		}
+		if !gemfile.SetRequirements("rake", c.requirements) {
+			t.Fatalf("Expected rake to be found in %q, but it was not", c.source)
+		}
+		if actual := string(gemfile.Bytes()); actual != c.expected {
+			t.Fatalf("Expected %q, but got %q", c.expected, actual)
+		}
+	}
+}
+
+func Test_ParseGemfile_UnterminatedString(t *testing.T) {
+	_, err := ParseGemfile([]byte("source 'https://rubygems.org'\ngem 'rake\n"))
+	if err == nil || err.Error() != "line 2: unterminated string" {
+		t.Fatalf("Expected an unterminated string error, but got %v", err)
+	}
+}
@@ -6,183 +6,462 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/strslice"
 	"github.com/google/go-github/github"
-	"github.com/nats-io/nats"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/github/contents"
 	"github.com/nicolai86/sisyphus/github/pr"
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/registry"
+	"github.com/nicolai86/sisyphus/rubygems"
 	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
 	"golang.org/x/net/context"
 )
 
 var (
 	natsURL     string
-	fileStorage storage.RepositoryReaderWriter
-	nc          *nats.Conn
+	fileStorage storage.RepositoryStore
+	credentials storage.CredentialProvider
+	// messageKeyring seals job payloads end to end if set
+	messageKeyring *storage.Keyring
+	concurrency    int
+	backlog        int
+	jobTimeout     time.Duration
+	drainTimeout   time.Duration
+	fetcher        = contents.NewFetcher()
+	// index finds outdated gems without docker, unless -index is empty
+	index *rubygems.Index
+	// checks skips entries whose manifests are unchanged since their last check
+	checks = contents.NewChecks(nil, 24*time.Hour)
 )
 
-type config struct {
-	Path     string
-	Language string
-}
-
-type repoConfig struct {
-	Config       config
-	RepositoryID string
-}
-
-func init() {
+// configure reads the flags. It runs from main rather than init, so the
+// tests of this package parse their own flags.
+func configure() {
 	var (
 		dataPath      string
 		bucket        string
 		encryptionKey string
+		keyringPath   string
+		sqlDriver     string
+		sqlDSN        string
+		sealMessages  bool
+		indexURL      string
 	)
 	flag.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
 	flag.StringVar(&dataPath, "data-path", "", "data directory")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flag.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
 	flag.StringVar(&encryptionKey, "encryption-key", "", "store everything encrypted")
+	flag.StringVar(&keyringPath, "keyring", "", "keyring file, store everything encrypted with its active key")
+	flag.BoolVar(&sealMessages, "seal-messages", false, "encrypt job payloads with the storage key")
+	flag.IntVar(&concurrency, "concurrency", 2, "maximum number of jobs running at once")
+	flag.IntVar(&backlog, "backlog", 16, "number of received jobs waiting for a free slot")
+	flag.DurationVar(&jobTimeout, "job-timeout", 20*time.Minute, "cancel jobs running longer")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "time running jobs get to finish on SIGTERM")
+	flag.DurationVar(&checks.MaxAge, "recheck-after", 24*time.Hour, "check unchanged manifests again after this long")
+	flag.StringVar(&indexURL, "index", rubygems.DefaultIndexURL, "rubygems compatible index to find outdated gems, empty to run bundle outdated in docker")
 	flag.StringVar(&natsURL, "nats", "tcp://127.0.0.1:4222", "nats server URL")
 	flag.Parse()
 
+	if indexURL != "" {
+		index = rubygems.NewIndex(indexURL)
+	}
+
 	if dataPath != "" {
 		fileStorage = storage.NewFileStorage(dataPath)
 	}
 	if bucket != "" {
 		fileStorage = storage.NewS3Storage(bucket)
 	}
-	if encryptionKey != "" {
-		fileStorage = storage.NewAESStorage(encryptionKey, fileStorage)
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = sqlStorage
+	}
+	var (
+		keyring storage.Keyring
+		err     error
+	)
+	if keyringPath != "" {
+		keyring, err = storage.LoadKeyring(keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	} else if encryptionKey != "" {
+		keyring, err = storage.NewKeyring("default", storage.Key{ID: "default", Secret: []byte(encryptionKey)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	}
+	credentials = storage.NewStoredCredentials(fileStorage)
+	// shared by all workers, so restarts and other workers skip checks as well
+	if store, ok := fileStorage.(storage.CheckStateStore); ok {
+		checks.Store = store
+	}
+
+	if sealMessages {
+		if keyringPath == "" && encryptionKey == "" {
+			log.Fatal("-seal-messages requires -keyring or -encryption-key")
+		}
+		messageKeyring = &keyring
 	}
 }
 
 var filesToExtract = []string{"Gemfile", "Gemfile.lock"}
 
-func checkDependencies(r storage.Repository, c config) {
+// checkDependencies works in a build directory of its own, which is removed
+// once the check is done
+func checkDependencies(ctx context.Context, r storage.Credentials, c config.Entry, report reporter) error {
 	log.Printf("looking for %q (%q): %q", c.Path, c.Language, filesToExtract)
 
 	owner := strings.Split(r.FullName, "/")[0]
 	repoName := strings.Split(r.FullName, "/")[1]
 
+	if err := os.MkdirAll(fmt.Sprintf("/tmp/build/%s", r.ID), 0700); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("%s-%s", c.Path, c.Language))
-	cachePath := fmt.Sprintf("/tmp/build/%s/%x", r.ID, md5.Sum(data))
-	os.MkdirAll(cachePath, 0700)
+	cachePath, err := ioutil.TempDir(fmt.Sprintf("/tmp/build/%s", r.ID), fmt.Sprintf("%x-", md5.Sum(data)))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(cachePath)
+	var files []contents.File
 	for _, file := range filesToExtract {
-		uri := fmt.Sprintf("https://%s@raw.githubusercontent.com/%s/%s/master/%s/%s", r.AccessToken, owner, repoName, c.Path, file)
-		resp, _ := http.Get(uri)
-		f, _ := os.OpenFile(fmt.Sprintf("%s/%s", cachePath, file), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-		io.Copy(f, resp.Body)
-		resp.Body.Close()
+		f, err := fetcher.Fetch(ctx, r.AccessToken, owner, repoName, c.Branch, path.Join(c.Path, file))
+		if err == contents.ErrNotFound {
+			log.Printf("no %s in %q of %s on %q, skipping\n", file, c.Path, r.ID, c.Branch)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to fetch %s: %q", file, err)
+		}
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%s", cachePath, file), f.Content, 0600); err != nil {
+			return err
+		}
+		files = append(files, f)
 	}
 
-	runDependencyCheck(r, c, cachePath)
+	unchanged, err := checks.Unchanged(r.ID, c, files, time.Now())
+	if err != nil {
+		log.Printf("Failed to load the last check of %q in %s: %q\n", c.Path, r.ID, err)
+	}
+	if unchanged {
+		log.Printf("%q of %s on %q is unchanged since its last check, skipping\n", c.Path, r.ID, c.Branch)
+		return nil
+	}
+	if err := runDependencyCheck(ctx, r, c, cachePath, report); err != nil {
+		return err
+	}
+	if err := checks.Succeeded(r.ID, c, files, time.Now()); err != nil {
+		log.Printf("Failed to record the check of %q in %s: %q\n", c.Path, r.ID, err)
+	}
+	return nil
 }
 
-func runDependencyCheck(r storage.Repository, c config, buildPath string) {
-	// docker run --rm -v $(pwd)/outdated.log:/home/checker/outdated.log:rw -v $(pwd)/Gemfile:/home/checker/Gemfile:ro -v $(pwd)/Gemfile.lock:/home/checker/Gemfile.lock -it dep-check-rb
-	f, _ := os.OpenFile(fmt.Sprintf("%s/outdated.log", buildPath), os.O_CREATE|os.O_TRUNC, 0600)
-	f.Close()
+// runContainer runs a dep-check-rb container to completion and returns its
+// exit code. The container is killed once ctx is done.
+func runContainer(ctx context.Context, cli *client.Client, config *container.Config, hostConfig *container.HostConfig) (int, error) {
+	c, err := cli.ContainerCreate(ctx, config, hostConfig, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	// ctx may be done already, the container must go regardless
+	defer cli.ContainerRemove(context.Background(), types.ContainerRemoveOptions{
+		ContainerID: c.ID,
+		Force:       true,
+	})
 
-	cli, err := client.NewEnvClient()
+	if err := cli.ContainerStart(ctx, c.ID); err != nil {
+		return 0, err
+	}
+
+	return cli.ContainerWait(ctx, c.ID)
+}
+
+// outdatedFromIndex compares Gemfile.lock with the gem index
+func outdatedFromIndex(ctx context.Context, buildPath string) (logOutput, error) {
+	f, err := os.Open(fmt.Sprintf("%s/Gemfile.lock", buildPath))
 	if err != nil {
-		panic(err)
-	}
-
-	func() {
-		container, err := cli.ContainerCreate(context.Background(), &container.Config{
-			Image: "dep-check-rb",
-		}, &container.HostConfig{
-			AutoRemove: true,
-			Binds: []string{
-				fmt.Sprintf("%s/outdated.log:/home/checker/outdated.log:rw", buildPath),
-				fmt.Sprintf("%s/Gemfile:/home/checker/Gemfile:ro", buildPath),
-				fmt.Sprintf("%s/Gemfile.lock:/home/checker/Gemfile.lock:ro", buildPath),
-			},
-		}, nil, "")
-		if err != nil {
-			log.Fatalf(err.Error())
+		return logOutput{}, err
+	}
+	defer f.Close()
+	lockfile, err := rubygems.ParseLockfile(f)
+	if err != nil {
+		return logOutput{}, fmt.Errorf("Failed to parse Gemfile.lock: %q", err)
+	}
+	// bundle outdated knows the other gem servers, the index does not
+	for _, source := range lockfile.Sources {
+		if source.Type == "GEM" && !index.Serves(source) {
+			return logOutput{}, fmt.Errorf("gems from %s are not served by the index", strings.Join(source.Remotes, ", "))
 		}
+	}
 
-		if err := cli.ContainerStart(context.Background(), container.ID); err != nil {
-			log.Fatalf(err.Error())
+	updates, err := index.Outdated(ctx, lockfile)
+	if err != nil {
+		return logOutput{}, err
+	}
+	dependencies := logOutput{Updates: map[string]versionInfo{}}
+	for _, u := range updates {
+		info := versionInfo{Wanted: u.Locked.String(), Latest: u.Latest.String()}
+		for _, release := range u.Releases {
+			info.Releases = append(info.Releases, release.String())
 		}
+		dependencies.Updates[u.Name] = info
+	}
+	return dependencies, nil
+}
 
-		cli.ContainerWait(context.Background(), container.ID)
+// outdatedFromContainer runs bundle outdated in a dep-check-rb container
+func outdatedFromContainer(ctx context.Context, cli *client.Client, buildPath string) (logOutput, error) {
+	// docker run --rm -v $(pwd)/outdated.log:/home/checker/outdated.log:rw -v $(pwd)/Gemfile:/home/checker/Gemfile:ro -v $(pwd)/Gemfile.lock:/home/checker/Gemfile.lock -it dep-check-rb
+	f, err := os.OpenFile(fmt.Sprintf("%s/outdated.log", buildPath), os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return logOutput{}, err
+	}
+	f.Close()
 
-		cli.ContainerRemove(context.Background(), types.ContainerRemoveOptions{
-			ContainerID: container.ID,
-		})
-	}()
+	// bundle outdated exits non-zero whenever something is outdated
+	if _, err := runContainer(ctx, cli, &container.Config{
+		Image: "dep-check-rb",
+	}, &container.HostConfig{
+		AutoRemove: true,
+		Binds: []string{
+			fmt.Sprintf("%s/outdated.log:/home/checker/outdated.log:rw", buildPath),
+			fmt.Sprintf("%s/Gemfile:/home/checker/Gemfile:ro", buildPath),
+			fmt.Sprintf("%s/Gemfile.lock:/home/checker/Gemfile.lock:ro", buildPath),
+		},
+	}); err != nil {
+		return logOutput{}, err
+	}
 
-	f2, _ := os.Open(fmt.Sprintf("%s/outdated.log", buildPath))
+	f2, err := os.Open(fmt.Sprintf("%s/outdated.log", buildPath))
+	if err != nil {
+		return logOutput{}, err
+	}
 	defer f2.Close()
-	var dependencies = ParseLog(f2)
+	return ParseLog(f2), nil
+}
+
+// findOutdated asks the gem index for newer versions of the locked gems, and
+// falls back to bundle outdated if that fails
+func findOutdated(ctx context.Context, cli *client.Client, buildPath string) (logOutput, error) {
+	if index != nil {
+		dependencies, err := outdatedFromIndex(ctx, buildPath)
+		if err == nil {
+			return dependencies, nil
+		}
+		log.Printf("Failed to check against %s, falling back to bundle outdated: %q\n", index.BaseURL, err)
+	}
+	return outdatedFromContainer(ctx, cli, buildPath)
+}
+
+func runDependencyCheck(ctx context.Context, r storage.Credentials, c config.Entry, buildPath string, report reporter) error {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	dependencies, err := findOutdated(ctx, cli, buildPath)
+	if err != nil {
+		return err
+	}
+
+	bs, err := ioutil.ReadFile(fmt.Sprintf("%s/Gemfile", buildPath))
+	if err != nil {
+		return err
+	}
+	gemfile, err := ParseGemfile(bs)
+	if err != nil {
+		return fmt.Errorf("Failed to parse Gemfile: %q", err)
+	}
+	for name, dep := range dependencies.Updates {
+		if c.Ignored(name) {
+			log.Printf("ignoring %q in %q\n", name, c.Path)
+			delete(dependencies.Updates, name)
+			continue
+		}
+		target, ok := c.Newest(dep.Wanted, dep.Latest, dep.Releases)
+		if !ok {
+			log.Printf("%s policy of %q skips %q %s -> %s\n", c.Policy, c.Branch, name, dep.Wanted, dep.Latest)
+			delete(dependencies.Updates, name)
+			continue
+		}
+		// the update targets the newest version the policy allows
+		dep.Latest = target
+		dependencies.Updates[name] = dep
+		if allowsLatest(gemfile, name, dep.Latest) {
+			log.Printf("Gemfile of %q already allows %q %s\n", c.Path, name, dep.Latest)
+			delete(dependencies.Updates, name)
+		}
+	}
 
 	if len(dependencies.Updates) == 0 {
 		log.Printf("Nothing to do for %q %q %q", r.ID, c.Path, c.Language)
-		return
+		return nil
 	}
 
-	f3, _ := os.Open(fmt.Sprintf("%s/Gemfile", buildPath))
-	defer f3.Close()
-	var b = bytes.Buffer{}
-	UpdateGemfile(dependencies, f3, &b)
-
 	var changedDependencies = []string{}
 	for dep := range dependencies.Updates {
 		changedDependencies = append(changedDependencies, dep)
 	}
-	if hasPR(r, c, changedDependencies) {
-		log.Printf("%s has an open PR for %q\n", r.ID, changedDependencies)
-		return
-	}
-
-	f4, _ := os.OpenFile(fmt.Sprintf("%s/Gemfile", buildPath), os.O_TRUNC|os.O_WRONLY, 0600)
-	defer f4.Close()
-	b.WriteTo(f4)
-
-	func() {
-		container, err := cli.ContainerCreate(context.Background(), &container.Config{
-			Image:      "dep-check-rb",
-			Entrypoint: strslice.StrSlice([]string{"bundle", "update"}),
-		}, &container.HostConfig{
-			AutoRemove: true,
-			Binds: []string{
-				fmt.Sprintf("%s/Gemfile:/home/checker/Gemfile:rw", buildPath),
-				fmt.Sprintf("%s/Gemfile.lock:/home/checker/Gemfile.lock:rw", buildPath),
-			},
-		}, nil, "")
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
+	sort.Strings(changedDependencies)
+	report(storage.RunEvent{Type: storage.RunOutdatedFound, Dependencies: changedDependencies})
 
-		if err := cli.ContainerStart(context.Background(), container.ID); err != nil {
-			log.Fatalf(err.Error())
+	for _, group := range c.Groups(changedDependencies) {
+		if err := updateDependencies(ctx, cli, r, c, buildPath, dependencies, group, report); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		cli.ContainerWait(context.Background(), container.ID)
+// updateDependencies opens a PR updating a group of dependencies, unless
+// there is one already. Every group is bundled in a directory of its own.
+func updateDependencies(ctx context.Context, cli *client.Client, r storage.Credentials, c config.Entry, buildPath string, dependencies logOutput, group []string, report reporter) error {
+	exists, err := hasPR(r, c, group)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("%s has an open PR for %q\n", r.ID, group)
+		report(storage.RunEvent{Type: storage.RunSkippedExistingPR, Dependencies: group})
+		return nil
+	}
 
-		cli.ContainerRemove(context.Background(), types.ContainerRemoveOptions{
-			ContainerID: container.ID,
-		})
-	}()
+	branch, pushed, err := groupBranch(ctx, r, c, dependencies, group)
+	if err != nil {
+		return err
+	}
+	if pushed {
+		// an earlier attempt of this job failed after pushing
+		log.Printf("%s was pushed already\n", branch)
+		return openPR(r, c, branch, group, true, report)
+	}
+
+	groupPath, err := ioutil.TempDir(buildPath, "group-")
+	if err != nil {
+		return err
+	}
+	if err := copyFile(fmt.Sprintf("%s/Gemfile.lock", buildPath), fmt.Sprintf("%s/Gemfile.lock", groupPath)); err != nil {
+		return err
+	}
+
+	updates := logOutput{Updates: map[string]versionInfo{}}
+	for _, name := range group {
+		updates.Updates[name] = dependencies.Updates[name]
+	}
+	f, err := os.Open(fmt.Sprintf("%s/Gemfile", buildPath))
+	if err != nil {
+		return err
+	}
+	var b = bytes.Buffer{}
+	err = UpdateGemfile(updates, c.Strategy, f, &b)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to update Gemfile: %q", err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/Gemfile", groupPath), b.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	status, err := runContainer(ctx, cli, &container.Config{
+		Image:      "dep-check-rb",
+		Entrypoint: strslice.StrSlice([]string{"bundle", "update"}),
+	}, &container.HostConfig{
+		AutoRemove: true,
+		Binds: []string{
+			fmt.Sprintf("%s/Gemfile:/home/checker/Gemfile:rw", groupPath),
+			fmt.Sprintf("%s/Gemfile.lock:/home/checker/Gemfile.lock:rw", groupPath),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("bundle update exited with %d", status)
+	}
 
 	log.Printf("pushing new branch to remote…\n")
-	branch := pushChangesToRemote(r, c, buildPath)
+	if err := pushChangesToRemote(ctx, r, c, groupPath, branch); err != nil {
+		return err
+	}
+	return openPR(r, c, branch, group, false, report)
+}
+
+// groupBranch returns the branch updating a group to the latest versions,
+// and whether it was pushed already
+func groupBranch(ctx context.Context, r storage.Credentials, c config.Entry, dependencies logOutput, group []string) (string, bool, error) {
+	owner := strings.Split(r.FullName, "/")[0]
+	repo := strings.Split(r.FullName, "/")[1]
+	var versions []string
+	for _, name := range group {
+		versions = append(versions, name+"@"+dependencies.Updates[name].Latest)
+	}
+	branch := pr.BranchName(r.FullName, c.Path, c.Branch, versions)
+	exists, err := pr.BranchExists(ctx, r.AccessToken, owner, repo, branch)
+	return branch, exists, err
+}
+
+// openPR opens the PR of a pushed branch. Branches pushed by earlier attempts
+// may have a PR already, which is kept even if closed.
+func openPR(r storage.Credentials, c config.Entry, branch string, group []string, retried bool, report reporter) error {
+	if retried {
+		owner := strings.Split(r.FullName, "/")[0]
+		repo := strings.Split(r.FullName, "/")[1]
+		opened, err := pr.BranchHasPullRequest(r.AccessToken, owner, repo, branch)
+		if err != nil {
+			return err
+		}
+		if opened {
+			log.Printf("%s has a PR for %s already\n", r.ID, branch)
+			report(storage.RunEvent{Type: storage.RunSkippedExistingPR, Dependencies: group, Branch: branch})
+			return nil
+		}
+	}
+
 	log.Printf("creating PR\n")
-	createPR(r, c, branch, changedDependencies)
+	number, err := createPR(r, c, branch, group)
+	if err != nil {
+		return err
+	}
+	report(storage.RunEvent{Type: storage.RunPRCreated, Dependencies: group, Branch: branch, PullRequest: number})
+	return nil
 }
 
-func pushChangesToRemote(r storage.Repository, c config, buildPath string) string {
+func copyFile(source, destination string) error {
+	bs, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(destination, bs, 0600)
+}
+
+func pushChangesToRemote(ctx context.Context, r storage.Credentials, c config.Entry, buildPath, branch string) error {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
-	branch, err := pr.PublishChanges(r.AccessToken, owner, repo, []pr.UpdateFile{
+	return pr.PublishChanges(ctx, r.AccessToken, owner, repo, c.Branch, branch, []pr.UpdateFile{
 		pr.UpdateFile{
 			Source:      fmt.Sprintf("%s/Gemfile", buildPath),
 			Destination: fmt.Sprintf("%s/Gemfile", c.Path),
@@ -192,16 +471,15 @@ func pushChangesToRemote(r storage.Repository, c config, buildPath string) strin
 			Destination: fmt.Sprintf("%s/Gemfile.lock", c.Path),
 		},
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return branch
 }
 
-func hasPR(r storage.Repository, c config, modifications []string) bool {
+func hasPR(r storage.Credentials, c config.Entry, modifications []string) (bool, error) {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
 	return pr.PullRequestExists(r.AccessToken, owner, repo, func(pr *github.PullRequest) bool {
+		if pr.Body == nil || pr.Base == nil || pr.Base.Ref == nil || *pr.Base.Ref != c.Branch {
+			return false
+		}
 		index := strings.Index(*pr.Body, fmt.Sprintf("```\n# %s dependencies in %s\n", c.Language, c.Path))
 		if index == -1 {
 			return false
@@ -218,56 +496,153 @@ func hasPR(r storage.Repository, c config, modifications []string) bool {
 	})
 }
 
-func createPR(r storage.Repository, c config, branch string, modifications []string) {
+func createPR(r storage.Credentials, c config.Entry, branch string, modifications []string) (int, error) {
 	owner := strings.Split(r.FullName, "/")[0]
 	repo := strings.Split(r.FullName, "/")[1]
 	out, _ := json.MarshalIndent(modifications, "", "\t")
-	pr.CreatePullRequest(
+	title := fmt.Sprintf("Update %s dependencies in %q", c.Language, c.Path)
+	if c.Group == config.GroupDependency {
+		title = fmt.Sprintf("Update %s in %q", modifications[0], c.Path)
+	}
+	created, err := pr.CreatePullRequest(
 		r.AccessToken,
 		owner,
 		repo,
-		fmt.Sprintf("Update %s dependencies in %q", c.Language, c.Path),
+		title,
 		branch,
+		c.Branch,
 		fmt.Sprintf(
 			`This PR updates dependencies, which have not been covered by your versions so far: %s`,
 			fmt.Sprintf("\n\n ```\n# %s dependencies in %s\n%s\n```", c.Language, c.Path, out),
 		),
 	)
+	if err != nil {
+		return 0, err
+	}
+	if created == nil || created.Number == nil {
+		return 0, fmt.Errorf("github returned no number for the PR of %s", branch)
+	}
+
+	// the PR exists already, so failing to decorate it must not fail the job
+	if len(c.Labels) > 0 {
+		if err := pr.AddLabels(r.AccessToken, owner, repo, *created.Number, c.Labels); err != nil {
+			log.Printf("Failed to label PR #%d of %s: %q\n", *created.Number, r.ID, err)
+		}
+	}
+	if len(c.Reviewers) > 0 {
+		if err := pr.RequestReviewers(r.AccessToken, owner, repo, *created.Number, c.Reviewers); err != nil {
+			log.Printf("Failed to request reviews for PR #%d of %s: %q\n", *created.Number, r.ID, err)
+		}
+	}
+	return *created.Number, nil
+}
+
+// reporter records the lifecycle of a single job
+type reporter func(storage.RunEvent)
+
+func newReporter(job jobs.Job, rc messages.DependencyCheck) reporter {
+	return func(event storage.RunEvent) {
+		history, ok := fileStorage.(storage.RunHistoryStore)
+		if !ok {
+			return
+		}
+
+		event.RepositoryID = rc.RepositoryID
+		event.JobID = job.JobID
+		event.CorrelationID = job.CorrelationID
+		event.Time = time.Now().UTC()
+		event.Plugin = "greenkeep"
+		event.Path = rc.Config.Path
+		event.Language = rc.Config.Language
+		if err := history.StoreRunEvent(event); err != nil {
+			log.Printf("Failed to record %s of job %s: %q\n", event.Type, job.JobID, err)
+		}
+	}
+}
+
+// handle checks the entry of a job for outdated dependencies
+func handle(ctx context.Context, job jobs.Job) error {
+	var rc messages.DependencyCheck
+	if err := job.Decode(&rc); err != nil {
+		return err
+	}
+	log.Printf("received request for %q (job %s, attempt %d)\n", rc.RepositoryID, job.JobID, job.Attempt)
+
+	r, err := credentials.Credentials(rc.RepositoryID)
+	if err == storage.ErrNotFound {
+		log.Printf("unknown repository %q, skipping\n", rc.RepositoryID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to resolve credentials: %q", err)
+	}
+
+	// the master resolves the base branch of every entry
+	if rc.Config.Branch == "" {
+		rc.Config.Branch = r.DefaultBranch
+	}
+	if rc.Config.Branch == "" {
+		return fmt.Errorf("no base branch for %q in %s", rc.Config.Path, r.ID)
+	}
+
+	report := newReporter(job, rc)
+	report(storage.RunEvent{Type: storage.RunStarted})
+	if err := checkDependencies(ctx, r, rc.Config, report); err != nil {
+		report(storage.RunEvent{Type: storage.RunFailed, Error: err.Error()})
+		return err
+	}
+	return nil
+}
+
+// serve receives the dependency checks of the master on t
+func serve(t transport.Transport) (*jobs.Worker, error) {
+	worker := jobs.NewWorker("greenkeep-ruby", handle)
+	worker.Concurrency = concurrency
+	worker.Backlog = backlog
+	worker.Timeout = jobTimeout
+	worker.Keyring = messageKeyring
+	if err := worker.Subscribe(t, "greenkeep-ruby"); err != nil {
+		return nil, err
+	}
+	return worker, t.Flush()
 }
 
 func main() {
+	configure()
 	log.Printf("greenkeepr dependency worker for ruby running")
 
-	nc1, err := nats.Connect(natsURL)
+	nc, err := transport.Connect(natsURL)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer nc1.Close()
-	nc = nc1
+	defer nc.Close()
 
-	nc.Subscribe("greenkeep-ruby", func(msg *nats.Msg) {
-		repos, err := fileStorage.Load()
-		if err != nil {
-			log.Fatalf("Failed to read repo storages: %q\n", err)
-		}
-
-		var rc repoConfig
-		if err := json.NewDecoder(bytes.NewBuffer(msg.Data)).Decode(&rc); err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("received request for %q\n", rc.RepositoryID)
+	worker, err := serve(nc)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		var r storage.Repository
-		for _, repo := range repos {
-			if repo.ID == rc.RepositoryID {
-				r = repo
-				break
-			}
-		}
+	announcer, err := registry.Announce(nc, registry.Plugin{
+		Name:      "greenkeep",
+		Subject:   "greenkeep-ruby",
+		Languages: []string{"ruby"},
+	}, registry.DefaultInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		go checkDependencies(r, rc.Config)
-	})
-	nc.Flush()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
 
-	select {}
+	// stop receiving new jobs routed by the master before draining
+	if err := announcer.Close(); err != nil {
+		log.Printf("Failed to leave the registry: %q\n", err)
+	}
+	log.Printf("draining jobs…\n")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := worker.Drain(ctx); err != nil {
+		log.Printf("Failed to drain jobs: %q\n", err)
+	}
 }
@@ -4,13 +4,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"regexp"
 	"strings"
+
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/rubygems"
 )
 
 type versionInfo struct {
 	Wanted string
 	Latest string
+	// Releases newer than Wanted are only known when checking the gem index
+	Releases []string
 }
 
 type logOutput struct {
@@ -52,29 +56,67 @@ func ParseLog(r io.Reader) logOutput {
 	}
 }
 
-func UpdateGemfile(deps logOutput, r io.Reader, w io.Writer) {
-	bs, _ := ioutil.ReadAll(r)
-	gemfile := string(bs)
-
-	lines := strings.Split(gemfile, "\n")
-	for i := range lines {
-		lines[i] = strings.TrimSpace(lines[i])
+// UpdateGemfile moves the version constraints of the gems of deps to their
+// latest version, following strategy. Everything else is kept as is.
+func UpdateGemfile(deps logOutput, strategy string, r io.Reader, w io.Writer) error {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	gemfile, err := ParseGemfile(bs)
+	if err != nil {
+		return err
 	}
 
 	for name, dep := range deps.Updates {
-		exp := regexp.MustCompile(
-			fmt.Sprintf(
-				`gem ['"]%s['"]`,
-				name,
-			),
-		)
-		for i, line := range lines {
-			if exp.MatchString(line) {
-				lines[i] = fmt.Sprintf(`gem '%s', '%s'`, name, dep.Latest)
-				break
-			}
+		latest, err := rubygems.ParseVersion(dep.Latest)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		gemfile.UpdateRequirements(name, func(current []string) []string {
+			return updateRequirement(current, latest, strategy)
+		})
+	}
+
+	_, err = w.Write(gemfile.Bytes())
+	return err
+}
+
+// updateRequirement applies strategy to the constraints of a gem statement.
+// Constraints rubygems wouldn't accept either are pinned.
+func updateRequirement(current []string, latest rubygems.Version, strategy string) []string {
+	r, err := rubygems.ParseRequirement(current)
+	if err != nil {
+		return r.Pin(latest).Strings()
+	}
+	switch strategy {
+	case config.StrategyBump:
+		if len(r) > 0 {
+			return r.Bump(latest).Strings()
+		}
+	case config.StrategyWiden:
+		if len(r) > 0 {
+			return r.Widen(latest).Strings()
 		}
 	}
+	return r.Pin(latest).Strings()
+}
 
-	w.Write([]byte(strings.Join(lines, "\n")))
+// allowsLatest reports whether every statement of a gem already allows its
+// latest version, so only Gemfile.lock is behind
+func allowsLatest(gemfile *Gemfile, name, latest string) bool {
+	v, err := rubygems.ParseVersion(latest)
+	if err != nil {
+		return false
+	}
+	for _, gem := range gemfile.Gems {
+		if gem.Name != name {
+			continue
+		}
+		r, err := rubygems.ParseRequirement(gem.Requirements)
+		if err != nil || !r.Allows(v) {
+			return false
+		}
+	}
+	return true
 }
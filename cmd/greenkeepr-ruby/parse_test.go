@@ -2,30 +2,71 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/nicolai86/sisyphus/config"
 )
 
-func Test_UpdateGemfile_Rewrite(t *testing.T) {
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func Test_UpdateGemfile_Golden(t *testing.T) {
 	f, err := os.Open("./fakes/outdated.log")
 	if err != nil {
 		t.Fatal(err)
 	}
 	output := ParseLog(f)
+	f.Close()
 
-	f2, err := os.Open("./fakes/Gemfile")
+	gemfile, err := ioutil.ReadFile("./fakes/Gemfile")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var b = bytes.Buffer{}
-	io.Copy(&b, f2)
+	for _, strategy := range []string{config.StrategyPin, config.StrategyBump, config.StrategyWiden} {
+		var b = bytes.Buffer{}
+		if err := UpdateGemfile(output, strategy, bytes.NewReader(gemfile), &b); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+
+		path := fmt.Sprintf("./fakes/Gemfile.%s.golden", strategy)
+		if *update {
+			if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), golden) {
+			t.Fatalf("Expected the Gemfile to match %s, but got\n%s", path, b.String())
+		}
+	}
+}
 
-	var b2 = bytes.Buffer{}
-	UpdateGemfile(output, &b, &b2)
-	fmt.Printf("%#v\n\n", b2.String())
+func Test_AllowsLatest(t *testing.T) {
+	gemfile, err := ParseGemfile([]byte("gem 'gmaps4rails', '~> 2.1'\ngem 'turbolinks', '~> 2.3'\ngem 'rake'\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	cases := []struct {
+		name, latest string
+		expected     bool
+	}{
+		{"gmaps4rails", "2.1.2", true},
+		{"turbolinks", "5.0.1", false},
+		{"rake", "11.2.2", true},
+		{"rack", "2.0.1", true},
+	}
+	for _, c := range cases {
+		if actual := allowsLatest(gemfile, c.name, c.latest); actual != c.expected {
+			t.Fatalf("Expected %q to allow %s: %v, but got %v", c.name, c.latest, c.expected, actual)
+		}
+	}
 }
 
 func Test_ParseLog_DetectUpdates(t *testing.T) {
@@ -1,71 +1,220 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/nats-io/nats"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/election"
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/registry"
+	"github.com/nicolai86/sisyphus/schedule"
+	"github.com/nicolai86/sisyphus/scheduler"
 	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
 )
 
 var (
-	fileStorage storage.RepositoryReaderWriter
-	natsURL     string
+	fileStorage storage.RepositoryStore
+	// messageKeyring seals job payloads end to end if set
+	messageKeyring  *storage.Keyring
+	natsURL         string
+	defaultSchedule schedule.Spec
+	lockSpec        string
+	lockTTL         time.Duration
+	drainTimeout    time.Duration
 )
 
-func init() {
+// configure reads the flags. It runs from main rather than init, so the
+// tests of this package parse their own flags.
+func configure() {
 	var (
 		dataPath      string
 		bucket        string
 		encryptionKey string
+		keyringPath   string
+		sqlDriver     string
+		sqlDSN        string
+		sealMessages  bool
+		fallback      string
 	)
 	flag.StringVar(&dataPath, "data-path", "", "path to store data")
 	flag.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flag.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
 	flag.StringVar(&encryptionKey, "encryption-key", "", "store everything encrypted")
+	flag.StringVar(&keyringPath, "keyring", "", "keyring file, store everything encrypted with its active key")
+	flag.BoolVar(&sealMessages, "seal-messages", false, "encrypt job payloads with the storage key")
 	flag.StringVar(&natsURL, "nats", "tcp://127.0.0.1:4222", "nats server URL")
+	flag.StringVar(&fallback, "default-schedule", "1h", "interval or cron expression for plugins without schedule")
+	flag.StringVar(&lockSpec, "lock", "", "coordinate multiple schedulers with either nats or file:<path>")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "time scheduled jobs get to be acknowledged on SIGTERM")
+	flag.DurationVar(&lockTTL, "lock-ttl", 20*time.Second, "time until the nats lock of a silent leader expires")
 	flag.Parse()
 
+	spec, err := schedule.Parse(fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaultSchedule = spec
+
 	if dataPath != "" {
 		fileStorage = storage.NewFileStorage(dataPath)
 	}
 	if bucket != "" {
 		fileStorage = storage.NewS3Storage(bucket)
 	}
-	if encryptionKey != "" {
-		fileStorage = storage.NewAESStorage(encryptionKey, fileStorage)
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = sqlStorage
+	}
+	var keyring storage.Keyring
+	if keyringPath != "" {
+		keyring, err = storage.LoadKeyring(keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	} else if encryptionKey != "" {
+		keyring, err = storage.NewKeyring("default", storage.Key{ID: "default", Secret: []byte(encryptionKey)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileStorage = storage.NewAESStorage(keyring, fileStorage)
+	}
+
+	if sealMessages {
+		if keyringPath == "" && encryptionKey == "" {
+			log.Fatal("-seal-messages requires -keyring or -encryption-key")
+		}
+		messageKeyring = &keyring
 	}
 }
 
+// newLocker returns nil if only a single scheduler is running
+func newLocker(nc transport.Transport) (election.Locker, error) {
+	switch {
+	case lockSpec == "":
+		return nil, nil
+	case lockSpec == "nats":
+		return election.NewTransportLock(nc, "repository-scheduler.leader", lockTTL)
+	case strings.HasPrefix(lockSpec, "file:"):
+		return election.NewFileLock(strings.TrimPrefix(lockSpec, "file:")), nil
+	}
+	return nil, fmt.Errorf("unknown lock %q", lockSpec)
+}
+
 func main() {
+	configure()
 	log.Printf("greenkeepr repo schedule worker running")
 
-	nc, err := nats.Connect(natsURL)
+	nc, err := transport.Connect(natsURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer nc.Close()
 
+	locker, err := newLocker(nc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plugins, err := registry.New(nc, registry.DefaultTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer plugins.Close()
+
+	dispatcher := jobs.NewDispatcher(nc)
+	dispatcher.Keyring = messageKeyring
+	if queue, ok := fileStorage.(storage.JobQueueStore); ok {
+		// only the leader dispatches, so all schedulers share a queue
+		dispatcher.Queue, dispatcher.QueueName = queue, "repository-scheduler"
+	}
+	s, err := scheduler.New(fileStorage, dispatcher, plugins, defaultSchedule)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := s.Subscribe(nc); err != nil {
+		log.Fatal(err)
+	}
+	nc.Flush()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	leader := locker == nil
+	// jobs left by a previous leader are resumed once, when leading first.
+	// A previous leader still delivering them leads to duplicate runs, which
+	// the plugins tolerate.
+	resumed := false
+	resume := func() {
+		if resumed {
+			return
+		}
+		resumed = true
+		if n, err := dispatcher.Resume(); err != nil {
+			log.Printf("Failed to resume pending jobs: %q\n", err)
+		} else if n > 0 {
+			log.Printf("resumed %d pending jobs\n", n)
+		}
+	}
+	if leader {
+		resume()
+	}
 	for {
 		select {
-		case <-time.After(time.Second * 5):
-			// this is a horrible inefficient design, and it also leads to periods of extremly high
-			// and low usage.
-			repos, err := fileStorage.Load()
-			if err != nil {
-				log.Fatal(err)
+		case <-signals:
+			log.Printf("draining jobs…\n")
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			if err := dispatcher.Drain(ctx); err != nil {
+				log.Printf("Failed to drain jobs: %q\n", err)
 			}
-
-			for _, repo := range repos {
-				for _, plugin := range repo.Plugins {
-					log.Printf("scheduling %q for %s\n", plugin, repo.ID)
-					out, _ := json.Marshal(repo)
-					nc.Publish(plugin, out)
+			cancel()
+			if locker != nil {
+				if err := locker.Unlock(); err != nil {
+					log.Printf("Failed to release scheduler lock: %q\n", err)
+				}
+			}
+			return
+		case <-time.After(time.Second * 5):
+			if locker != nil {
+				held, err := locker.TryLock()
+				if err != nil {
+					log.Printf("Failed to acquire scheduler lock: %q\n", err)
+				}
+				if !held {
+					if leader {
+						log.Printf("lost scheduler leadership\n")
+					}
+					leader = false
+					continue
+				}
+				if !leader {
+					// the previous leader may have run plugins in the meantime
+					log.Printf("became scheduler leader\n")
+					if err := s.Reload(time.Now()); err != nil {
+						log.Printf("Failed to reload schedule: %q\n", err)
+						continue
+					}
+					leader = true
+					resume()
 				}
-				nc.Flush()
 			}
 
+			s.Dispatch(time.Now())
+			nc.Flush()
 		}
 	}
 }
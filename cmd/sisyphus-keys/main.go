@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+const usage = `usage: sisyphus-keys <command> [flags]
+
+commands:
+  rotate    re-encrypt every repository with the active key of the keyring
+`
+
+// rotate re-encrypts all repositories by reading and writing them through
+// store. Nothing is written if a single repository can't be decrypted.
+func rotate(store storage.RepositoryReaderWriter) (int, error) {
+	repos, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, repo := range repos {
+		if err := store.Store(repo); err != nil {
+			return i, fmt.Errorf("Failed to store %q: %v", repo.ID, err)
+		}
+	}
+
+	return len(repos), nil
+}
+
+func rotateCommand(args []string) {
+	var (
+		dataPath    string
+		bucket      string
+		keyringPath string
+		sqlDriver   string
+		sqlDSN      string
+		backend     storage.RepositoryStore
+	)
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	flags.StringVar(&dataPath, "data-path", "", "path to store data")
+	flags.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flags.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flags.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
+	flags.StringVar(&keyringPath, "keyring", "", "keyring file; every key is used for reads, the active key for writes")
+	flags.Parse(args)
+
+	if dataPath != "" {
+		backend = storage.NewFileStorage(dataPath)
+	}
+	if bucket != "" {
+		backend = storage.NewS3Storage(bucket)
+	}
+	if sqlDSN != "" {
+		sqlStorage, err := storage.NewSQLStorage(sqlDriver, sqlDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend = sqlStorage
+	}
+	if backend == nil || keyringPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	keyring, err := storage.LoadKeyring(keyringPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := rotate(storage.NewAESStorage(keyring, backend))
+	if err != nil {
+		log.Fatalf("rotation aborted after %d repositories: %v", n, err)
+	}
+	log.Printf("re-encrypted %d repositories with key %q", n, keyring.Active().ID)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "rotate":
+		rotateCommand(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
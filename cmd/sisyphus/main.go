@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+const usage = `usage: sisyphus <command> [flags]
+
+commands:
+  history   list what sisyphus did to a repository
+  reindex   write the lookup index of an s3 bucket
+  validate  check a .sisyphus file and list the jobs it resolves to
+`
+
+// backendFlags registers the storage flags shared by all commands. The
+// returned function opens the chosen backend after flags were parsed.
+func backendFlags(flags *flag.FlagSet) func() (storage.RepositoryStore, error) {
+	var (
+		dataPath  string
+		bucket    string
+		sqlDriver string
+		sqlDSN    string
+	)
+	flags.StringVar(&dataPath, "data-path", "", "path to store data")
+	flags.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flags.StringVar(&sqlDriver, "sql-driver", "sqlite3", "sql storage driver, sqlite3 or postgres")
+	flags.StringVar(&sqlDSN, "sql-dsn", "", "sql storage data source name")
+
+	return func() (storage.RepositoryStore, error) {
+		switch {
+		case sqlDSN != "":
+			return storage.NewSQLStorage(sqlDriver, sqlDSN)
+		case bucket != "":
+			return storage.NewS3Storage(bucket), nil
+		case dataPath != "":
+			return storage.NewFileStorage(dataPath), nil
+		}
+		return nil, fmt.Errorf("one of -data-path, -s3-bucket or -sql-dsn is required")
+	}
+}
+
+// findRepository accepts a full name like nicolai86/sisyphus or an ID
+func findRepository(store storage.RepositoryStore, name string) (storage.Repository, error) {
+	if strings.Contains(name, "/") {
+		return store.GetByFullName(name)
+	}
+	return store.Get(name)
+}
+
+func historyCommand(args []string) {
+	var (
+		repository string
+		since      time.Duration
+	)
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	open := backendFlags(flags)
+	flags.StringVar(&repository, "repository", "", "full name or ID of the repository")
+	flags.DurationVar(&since, "since", 7*24*time.Hour, "how far to look back")
+	flags.Parse(args)
+
+	backend, err := open()
+	if err != nil || repository == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	history, ok := backend.(storage.RunHistoryStore)
+	if !ok {
+		log.Fatalf("%T does not store run events", backend)
+	}
+
+	repo, err := findRepository(backend, repository)
+	if err != nil {
+		log.Fatalf("Failed to find %q: %v", repository, err)
+	}
+	events, err := history.LoadRunEvents(repo.ID, time.Now().Add(-since))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tJOB\tEVENT\tPATH\tDETAILS")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			event.Time.Local().Format(time.RFC3339),
+			event.JobID,
+			event.Type,
+			strings.TrimSpace(event.Language+" "+event.Path),
+			details(event),
+		)
+	}
+	w.Flush()
+}
+
+func details(event storage.RunEvent) string {
+	var parts []string
+	if len(event.Dependencies) > 0 {
+		parts = append(parts, strings.Join(event.Dependencies, ", "))
+	}
+	if event.PullRequest != 0 {
+		parts = append(parts, fmt.Sprintf("#%d", event.PullRequest))
+	}
+	if event.Branch != "" {
+		parts = append(parts, event.Branch)
+	}
+	if event.Error != "" {
+		parts = append(parts, event.Error)
+	}
+	return strings.Join(parts, " ")
+}
+
+// localFiles lists the files below root like the github trees API does,
+// relative to root and slash separated
+func localFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" || info.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// validateCommand exits with 1 if the file is invalid
+func reindexCommand(args []string) {
+	var bucket string
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.StringVar(&bucket, "s3-bucket", "", "s3 storage bucket")
+	flags.Parse(args)
+
+	if bucket == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := storage.NewS3Storage(bucket).Reindex(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func validateCommand(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sisyphus validate [file, defaults to .sisyphus]")
+	}
+	flags.Parse(args)
+
+	path := ".sisyphus"
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := config.Parse(bs)
+	if errs, ok := err.(config.Errors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, e)
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if f.HasPatterns() {
+		files, err := localFiles(filepath.Dir(path))
+		if err != nil {
+			log.Fatal(err)
+		}
+		f = f.Expand(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tLANGUAGE\tPLUGIN\tBRANCH\tPOLICY\tSCHEDULE")
+	for _, r := range f.Resolve("") {
+		branch := r.Branch
+		if branch == "" {
+			branch = "default"
+		}
+		schedule := r.Schedule
+		if schedule == "" {
+			schedule = "repository"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Path, r.Language, r.Plugin, branch, r.Policy, schedule)
+	}
+	w.Flush()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "history":
+		historyCommand(os.Args[2:])
+	case "reindex":
+		reindexCommand(os.Args[2:])
+	case "validate":
+		validateCommand(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
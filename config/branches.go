@@ -0,0 +1,128 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// PolicyAll allows updates to any newer version
+	PolicyAll = "all"
+	// PolicyMinor allows updates within the current major version
+	PolicyMinor = "minor"
+	// PolicyPatch allows updates within the current minor version
+	PolicyPatch = "patch"
+)
+
+// BaseBranch is one of several branches an entry opens PRs against
+type BaseBranch struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// Targets returns a copy of the entry for every base branch, with Branch and
+// Policy set. Entries without branches target Branch, or defaultBranch.
+func (e Entry) Targets(defaultBranch string) []Entry {
+	if len(e.Branches) == 0 {
+		target := e
+		if target.Branch == "" {
+			target.Branch = defaultBranch
+		}
+		return []Entry{target}
+	}
+
+	targets := make([]Entry, 0, len(e.Branches))
+	for _, b := range e.Branches {
+		target := e
+		target.Branch = b.Name
+		target.Policy = b.Policy
+		target.Branches = nil
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Allows reports whether the entry's policy allows updating a dependency
+// from current to latest. Restricted policies refuse versions they can't
+// compare.
+func (e Entry) Allows(current, latest string) bool {
+	if e.Policy == "" || e.Policy == PolicyAll {
+		return true
+	}
+
+	from, ok := segments(current)
+	if !ok {
+		return false
+	}
+	to, ok := segments(latest)
+	if !ok {
+		return false
+	}
+
+	same := 1
+	if e.Policy == PolicyPatch {
+		same = 2
+	}
+	for i := 0; i < same; i++ {
+		if from[i] != to[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Newest returns the version to update a dependency from current to: latest
+// if the policy allows it, and otherwise the newest of releases it allows.
+// releases may include older versions and should exclude prereleases.
+func (e Entry) Newest(current, latest string, releases []string) (string, bool) {
+	if e.Allows(current, latest) {
+		return latest, true
+	}
+
+	from, ok := segments(current)
+	if !ok {
+		return "", false
+	}
+	var (
+		newest   string
+		newestAt [3]int
+	)
+	for _, release := range releases {
+		at, ok := segments(release)
+		if !ok || !newer(at, from) || !e.Allows(current, release) {
+			continue
+		}
+		if newest == "" || newer(at, newestAt) {
+			newest, newestAt = release, at
+		}
+	}
+	return newest, newest != ""
+}
+
+func newer(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// segments parses the major, minor and patch numbers of versions like
+// 1.2.3, ~> 1.2 or ^1.2.3-beta. Missing segments are 0.
+func segments(version string) ([3]int, bool) {
+	var parsed [3]int
+	version = strings.TrimLeft(version, "^~>=<v ")
+	if i := strings.IndexAny(version, "-+ "); i != -1 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	for i := 0; i < len(parts) && i < 3; i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
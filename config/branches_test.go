@@ -0,0 +1,95 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Entry_Targets(t *testing.T) {
+	f, err := Parse([]byte(`
+greenkeep:
+  - path: .
+    language: ruby
+    policy: minor
+    branches:
+      - main
+      - {name: release/2.x, policy: patch}
+  - path: docs
+    language: javascript
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %q", err)
+	}
+
+	var targets []string
+	for _, e := range f.Greenkeep {
+		for _, target := range e.Targets("develop") {
+			targets = append(targets, target.Path+"@"+target.Branch+":"+target.Policy)
+		}
+	}
+	expected := []string{".@main:minor", ".@release/2.x:patch", "docs@develop:all"}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("Expected %q, but got %q", expected, targets)
+	}
+}
+
+func Test_Parse_RejectsBranchesWithBranch(t *testing.T) {
+	_, err := Parse([]byte(`
+greenkeep:
+  - path: .
+    language: ruby
+    branch: main
+    branches: [release/2.x, {name: release/2.x, policy: none}]
+`))
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, but got %v", err)
+	}
+	expected := []string{"greenkeep[0].branches", "greenkeep[0].branches[1].policy", "greenkeep[0].branches[1]"}
+	for i, e := range errs {
+		if e.Path != expected[i] {
+			t.Fatalf("Expected an error at %q, but got %q", expected[i], e)
+		}
+	}
+}
+
+func Test_Entry_Allows(t *testing.T) {
+	cases := []struct {
+		policy, current, latest string
+		expected                bool
+	}{
+		{PolicyAll, "1.2.3", "3.0.0", true},
+		{PolicyMinor, "1.2.3", "1.4.0", true},
+		{PolicyMinor, "^1.2.3", "2.0.0", false},
+		{PolicyPatch, "~> 1.2", "1.2.9", true},
+		{PolicyPatch, "1.2.3", "1.3.0", false},
+		{PolicyPatch, "latest", "1.3.0", false},
+	}
+
+	for _, c := range cases {
+		if allowed := (Entry{Policy: c.policy}).Allows(c.current, c.latest); allowed != c.expected {
+			t.Fatalf("Expected %s to allow %s -> %s: %v, but got %v", c.policy, c.current, c.latest, c.expected, allowed)
+		}
+	}
+}
+
+func Test_Entry_Newest(t *testing.T) {
+	releases := []string{"1.2.3", "1.2.4", "1.2.10", "1.3.0", "1.4.1", "2.0.0"}
+	cases := []struct {
+		policy, current, expected string
+		ok                        bool
+	}{
+		{PolicyAll, "1.2.3", "2.0.0", true},
+		{PolicyMinor, "1.2.3", "1.4.1", true},
+		{PolicyPatch, "~> 1.2", "1.2.10", true},
+		{PolicyPatch, "1.4.1", "", false},
+		{PolicyPatch, "latest", "", false},
+	}
+
+	for _, c := range cases {
+		newest, ok := (Entry{Policy: c.policy}).Newest(c.current, "2.0.0", releases)
+		if newest != c.expected || ok != c.ok {
+			t.Fatalf("Expected %s to update %s to %q (%v), but got %q (%v)", c.policy, c.current, c.expected, c.ok, newest, ok)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package config reads the .sisyphus file of a repository.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/nicolai86/sisyphus/schedule"
+)
+
+// Version is the newest schema version understood. Files without a version
+// are treated as version 1.
+const Version = 1
+
+const (
+	// StrategyPin replaces constraints with the latest version
+	StrategyPin = "pin"
+	// StrategyBump raises the floor of constraints to the latest version
+	StrategyBump = "bump"
+	// StrategyWiden keeps constraints, extending them to the latest version
+	StrategyWiden = "widen"
+)
+
+const (
+	// GroupAll updates every outdated dependency of an entry in a single PR
+	GroupAll = "all"
+	// GroupDependency opens a PR per outdated dependency
+	GroupDependency = "dependency"
+)
+
+// File is the content of a .sisyphus file
+type File struct {
+	Version   int     `json:"version"`
+	Greenkeep []Entry `json:"greenkeep"`
+}
+
+// Entry is a single greenkeep entry of a .sisyphus file
+type Entry struct {
+	// Path is a directory, or a path.Match pattern matching directories
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	// Exclude lists directories a pattern Path must not match, as patterns
+	Exclude []string `json:"exclude,omitempty"`
+	// Schedule restricts the entry further than the repository's schedule
+	Schedule *schedule.Spec `json:"schedule,omitempty"`
+	// Ignore lists dependencies never updated, as path.Match patterns
+	Ignore    []string `json:"ignore,omitempty"`
+	Strategy  string   `json:"strategy,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+	Reviewers []string `json:"reviewers,omitempty"`
+	// Branch is the branch PRs are opened against, the default branch if empty
+	Branch string `json:"branch,omitempty"`
+	// Policy restricts the updates proposed for Branch
+	Policy string `json:"policy,omitempty"`
+	// Branches replace Branch for entries maintaining several release lines
+	Branches []BaseBranch `json:"branches,omitempty"`
+	Group    string       `json:"group,omitempty"`
+}
+
+// Plugin is the subject of the workers handling the entry
+func (e Entry) Plugin() string {
+	return fmt.Sprintf("greenkeep-%s", e.Language)
+}
+
+// Ignored reports whether the dependency matches an ignore pattern
+func (e Entry) Ignored(dependency string) bool {
+	for _, pattern := range e.Ignore {
+		if ok, _ := path.Match(pattern, dependency); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups splits outdated dependencies into the sets updated by a single PR
+func (e Entry) Groups(dependencies []string) [][]string {
+	if len(dependencies) == 0 {
+		return nil
+	}
+	if e.Group != GroupDependency {
+		return [][]string{dependencies}
+	}
+	groups := make([][]string, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		groups = append(groups, []string{dependency})
+	}
+	return groups
+}
+
+// Resolved is an entry as the master fans it out
+type Resolved struct {
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	Plugin   string `json:"plugin"`
+	// Branch is empty for the default branch, if it is unknown
+	Branch string `json:"branch,omitempty"`
+	Policy string `json:"policy,omitempty"`
+	// Schedule is empty for entries running on the repository's schedule
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Resolve lists the jobs the master fans out for the file
+func (f File) Resolve(defaultBranch string) []Resolved {
+	resolved := make([]Resolved, 0, len(f.Greenkeep))
+	for _, e := range f.Greenkeep {
+		for _, target := range e.Targets(defaultBranch) {
+			r := Resolved{
+				Path:     target.Path,
+				Language: target.Language,
+				Plugin:   target.Plugin(),
+				Branch:   target.Branch,
+				Policy:   target.Policy,
+			}
+			if target.Schedule != nil {
+				r.Schedule = target.Schedule.String()
+			}
+			resolved = append(resolved, r)
+		}
+	}
+	return resolved
+}
+
+// Parse reads a .sisyphus file written in either YAML or JSON. Invalid files
+// return Errors, locating every problem found.
+func Parse(data []byte) (File, error) {
+	var (
+		tree interface{}
+		err  error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		tree, err = decodeJSON(data)
+	} else {
+		tree, err = decodeYAML(data)
+	}
+	if err != nil {
+		return File{}, err
+	}
+
+	v := validator{}
+	tree = v.file(tree)
+	if len(v.errs) > 0 {
+		return File{}, v.errs
+	}
+
+	// the tree is valid, so it fits the typed structs
+	bs, err := json.Marshal(tree)
+	if err != nil {
+		return File{}, err
+	}
+	var f File
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return File{}, err
+	}
+	if f.Version == 0 {
+		f.Version = Version
+	}
+	for i := range f.Greenkeep {
+		if f.Greenkeep[i].Strategy == "" {
+			f.Greenkeep[i].Strategy = StrategyPin
+		}
+		if f.Greenkeep[i].Group == "" {
+			f.Greenkeep[i].Group = GroupAll
+		}
+		if f.Greenkeep[i].Policy == "" {
+			f.Greenkeep[i].Policy = PolicyAll
+		}
+		for j := range f.Greenkeep[i].Branches {
+			if f.Greenkeep[i].Branches[j].Policy == "" {
+				f.Greenkeep[i].Branches[j].Policy = f.Greenkeep[i].Policy
+			}
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nicolai86/sisyphus/schedule"
+)
+
+func Test_Parse_YAML(t *testing.T) {
+	f, err := Parse([]byte(`
+version: 1
+greenkeep:
+  - path: path/a
+    language: javascript
+    schedule: 0 3 * * 1
+    ignore: [react, "babel-*"]
+    strategy: widen
+    labels: [dependencies]
+    reviewers: [nicolai86]
+    branch: develop
+    group: dependency
+  - path: path/b
+    language: ruby
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %q", err)
+	}
+
+	expected := File{
+		Version: 1,
+		Greenkeep: []Entry{
+			{
+				Path:      "path/a",
+				Language:  "javascript",
+				Schedule:  &schedule.Spec{Cron: "0 3 * * 1"},
+				Ignore:    []string{"react", "babel-*"},
+				Strategy:  StrategyWiden,
+				Labels:    []string{"dependencies"},
+				Reviewers: []string{"nicolai86"},
+				Branch:    "develop",
+				Policy:    PolicyAll,
+				Group:     GroupDependency,
+			},
+			{Path: "path/b", Language: "ruby", Strategy: StrategyPin, Policy: PolicyAll, Group: GroupAll},
+		},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Fatalf("Expected %#v, but got %#v", expected, f)
+	}
+}
+
+func Test_Parse_JSON(t *testing.T) {
+	f, err := Parse([]byte(`{
+  "greenkeep": [
+    {
+      "path": "path/a",
+      "language": "javascript",
+      "schedule": {
+        "interval": "6h",
+        "window": {"start": "22:00", "end": "06:00"},
+        "timezone": "Europe/Berlin"
+      }
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %q", err)
+	}
+
+	if f.Version != Version {
+		t.Fatalf("Expected missing versions to default to %d, but got %d", Version, f.Version)
+	}
+	expected := &schedule.Spec{
+		Interval: "6h",
+		Window:   &schedule.Window{Start: "22:00", End: "06:00"},
+		Timezone: "Europe/Berlin",
+	}
+	if !reflect.DeepEqual(f.Greenkeep[0].Schedule, expected) {
+		t.Fatalf("Expected %#v, but got %#v", expected, f.Greenkeep[0].Schedule)
+	}
+}
+
+func Test_Parse_LocatesSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"{\n  \"greenkeep\": [\n    {\"path\": \"a\",}\n  ]\n}", "line 3, column 18: invalid character '}' looking for beginning of object key string"},
+		{"greenkeep:\n  - path: a\n\tlanguage: ruby\n", "line 3: found a tab character that violates indentation"},
+	}
+
+	for _, c := range cases {
+		_, err := Parse([]byte(c.input))
+		if err == nil || err.Error() != c.expected {
+			t.Fatalf("Expected %q, but got %v", c.expected, err)
+		}
+	}
+}
+
+func Test_Parse_LocatesInvalidValues(t *testing.T) {
+	_, err := Parse([]byte(`
+version: 2
+greenkeep:
+  - path: ../outside
+    language: Ruby 2
+    strategy: latest
+    schedule:
+      cron: 0 3 * *
+    reviewers: ["not a login"]
+    colour: green
+  - language: ruby
+    branch: "feature..x"
+    ignore: ["[a-"]
+`))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expected Errors, but got %#v", err)
+	}
+
+	expected := []string{
+		"version",
+		"greenkeep[0].colour",
+		"greenkeep[0].path",
+		"greenkeep[0].language",
+		"greenkeep[0].schedule",
+		"greenkeep[0].strategy",
+		"greenkeep[0].reviewers[0]",
+		"greenkeep[1]",
+		"greenkeep[1].ignore[0]",
+		"greenkeep[1].branch",
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected errors at %q, but got %q", expected, errs.Error())
+	}
+}
+
+func Test_Parse_RejectsDuplicates(t *testing.T) {
+	_, err := Parse([]byte(`
+greenkeep:
+  - {path: a, language: ruby}
+  - {path: a, language: ruby}
+`))
+	if err == nil || err.Error() != "greenkeep[1]: duplicates greenkeep[0]" {
+		t.Fatalf("Expected a duplicate error, but got %v", err)
+	}
+}
+
+func Test_Entry_Ignored(t *testing.T) {
+	e := Entry{Ignore: []string{"rails", "babel-*"}}
+	for dependency, expected := range map[string]bool{
+		"rails":      true,
+		"rails-html": false,
+		"babel-core": true,
+		"react":      false,
+	} {
+		if e.Ignored(dependency) != expected {
+			t.Fatalf("Expected %q to be ignored: %v, but got %v", dependency, expected, !expected)
+		}
+	}
+}
+
+func Test_Entry_Groups(t *testing.T) {
+	deps := []string{"a", "b"}
+	if groups := (Entry{Group: GroupAll}).Groups(deps); !reflect.DeepEqual(groups, [][]string{{"a", "b"}}) {
+		t.Fatalf("Expected a single group, but got %q", groups)
+	}
+	if groups := (Entry{Group: GroupDependency}).Groups(deps); !reflect.DeepEqual(groups, [][]string{{"a"}, {"b"}}) {
+		t.Fatalf("Expected a group per dependency, but got %q", groups)
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Manifests maps the manifest files detected to their language
+var Manifests = map[string]string{
+	"Gemfile":      "ruby",
+	"package.json": "javascript",
+}
+
+// skippedDirectories hold installed dependencies rather than projects
+var skippedDirectories = []string{"node_modules", "vendor", "bower_components"}
+
+// Detect builds the file used for repositories without .sisyphus, with an
+// entry for every manifest among the paths of the repository's files
+func Detect(paths []string) File {
+	seen := map[string]bool{}
+	f := File{Version: Version}
+	for _, p := range paths {
+		language, ok := Manifests[path.Base(p)]
+		if !ok || skipped(p) {
+			continue
+		}
+		dir := path.Dir(p)
+		if seen[language+":"+dir] {
+			continue
+		}
+		seen[language+":"+dir] = true
+		f.Greenkeep = append(f.Greenkeep, Entry{
+			Path:     dir,
+			Language: language,
+			Strategy: StrategyPin,
+			Policy:   PolicyAll,
+			Group:    GroupAll,
+		})
+	}
+
+	sort.Slice(f.Greenkeep, func(i, j int) bool {
+		if f.Greenkeep[i].Path != f.Greenkeep[j].Path {
+			return f.Greenkeep[i].Path < f.Greenkeep[j].Path
+		}
+		return f.Greenkeep[i].Language < f.Greenkeep[j].Language
+	})
+	return f
+}
+
+func skipped(p string) bool {
+	for _, segment := range strings.Split(path.Dir(p), "/") {
+		if contains(skippedDirectories, segment) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Detect(t *testing.T) {
+	f := Detect([]string{
+		"README.md",
+		"package.json",
+		"node_modules/react/package.json",
+		"services/api/Gemfile",
+		"services/api/Gemfile.lock",
+		"services/api/vendor/bundle/ruby/2.3.0/gems/rack/Gemfile",
+		"services/web/package.json",
+		"services/web/Gemfile",
+	})
+
+	expected := []Entry{
+		{Path: ".", Language: "javascript", Strategy: StrategyPin, Policy: PolicyAll, Group: GroupAll},
+		{Path: "services/api", Language: "ruby", Strategy: StrategyPin, Policy: PolicyAll, Group: GroupAll},
+		{Path: "services/web", Language: "javascript", Strategy: StrategyPin, Policy: PolicyAll, Group: GroupAll},
+		{Path: "services/web", Language: "ruby", Strategy: StrategyPin, Policy: PolicyAll, Group: GroupAll},
+	}
+	if !reflect.DeepEqual(f.Greenkeep, expected) {
+		t.Fatalf("Expected %#v, but got %#v", expected, f.Greenkeep)
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"path"
+	"strings"
+)
+
+// IsPattern reports whether a path contains path.Match wildcards
+func IsPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// HasPatterns reports whether the file needs to be expanded before fan-out
+func (f File) HasPatterns() bool {
+	for _, e := range f.Greenkeep {
+		if IsPattern(e.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand replaces entries with pattern paths by an entry for every matching
+// directory holding a manifest of the entry's language. files are the paths
+// of all files of the repository. Entries declared explicitly take
+// precedence over matches of a pattern.
+func (f File) Expand(files []string) File {
+	declared := map[string]bool{}
+	for _, e := range f.Greenkeep {
+		if !IsPattern(e.Path) {
+			declared[e.Language+":"+path.Clean(e.Path)] = true
+		}
+	}
+
+	expanded := f
+	expanded.Greenkeep = nil
+	for _, e := range f.Greenkeep {
+		if !IsPattern(e.Path) {
+			expanded.Greenkeep = append(expanded.Greenkeep, e)
+			continue
+		}
+		for _, dir := range manifestDirectories(files, e.Language) {
+			if ok, _ := path.Match(path.Clean(e.Path), dir); !ok || e.excluded(dir) {
+				continue
+			}
+			if declared[e.Language+":"+dir] {
+				continue
+			}
+			declared[e.Language+":"+dir] = true
+
+			match := e
+			match.Path = dir
+			match.Exclude = nil
+			expanded.Greenkeep = append(expanded.Greenkeep, match)
+		}
+	}
+	return expanded
+}
+
+func (e Entry) excluded(dir string) bool {
+	for _, pattern := range e.Exclude {
+		if ok, _ := path.Match(path.Clean(pattern), dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestDirectories lists the directories holding a manifest of language,
+// in the order of files
+func manifestDirectories(files []string, language string) []string {
+	var dirs []string
+	for _, f := range files {
+		if Manifests[path.Base(f)] == language && !skipped(f) {
+			dirs = append(dirs, path.Dir(f))
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_File_Expand(t *testing.T) {
+	f, err := Parse([]byte(`
+greenkeep:
+  - path: packages/*
+    language: javascript
+    exclude: [packages/legacy-*]
+    labels: [frontend]
+  - path: services/*/api
+    language: ruby
+  - path: packages/app
+    language: javascript
+    group: dependency
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %q", err)
+	}
+
+	expanded := f.Expand([]string{
+		"packages/app/package.json",
+		"packages/legacy-ui/package.json",
+		"packages/ui/package.json",
+		"packages/ui/node_modules/react/package.json",
+		"packages/docs/README.md",
+		"services/billing/api/Gemfile",
+		"services/billing/worker/Gemfile",
+		"services/users/api/Gemfile",
+	})
+
+	var paths []string
+	for _, e := range expanded.Greenkeep {
+		paths = append(paths, e.Language+":"+e.Path+":"+e.Group)
+	}
+	expected := []string{
+		"javascript:packages/ui:all",
+		"ruby:services/billing/api:all",
+		"ruby:services/users/api:all",
+		"javascript:packages/app:dependency",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected %q, but got %q", expected, paths)
+	}
+	if labels := expanded.Greenkeep[0].Labels; !reflect.DeepEqual(labels, []string{"frontend"}) {
+		t.Fatalf("Expected matches to keep the entry's settings, but got %q", labels)
+	}
+}
+
+func Test_Parse_RejectsExcludeWithoutPattern(t *testing.T) {
+	_, err := Parse([]byte(`
+greenkeep:
+  - path: packages/app
+    language: javascript
+    exclude: [packages/legacy]
+`))
+	if err == nil || err.Error() != "greenkeep[0].exclude: only applies to paths with patterns like packages/*" {
+		t.Fatalf("Expected an exclude error, but got %v", err)
+	}
+}
@@ -0,0 +1,467 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nicolai86/sisyphus/schedule"
+	"gopkg.in/yaml.v2"
+)
+
+// Error locates a single problem of a .sisyphus file. Syntax errors carry a
+// line, everything else the path of the offending value, like
+// greenkeep[1].schedule.
+type Error struct {
+	Path    string `json:"path,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e Error) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	case e.Path != "":
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return e.Message
+}
+
+// Errors are all problems found in a .sisyphus file
+type Errors []Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	var tree interface{}
+	err := json.Unmarshal(data, &tree)
+	switch e := err.(type) {
+	case nil:
+		return tree, nil
+	case *json.SyntaxError:
+		return nil, Errors{locate(data, e.Offset, e.Error())}
+	}
+	return nil, Errors{{Message: err.Error()}}
+}
+
+// locate turns a byte offset into a line and column
+func locate(data []byte, offset int64, message string) Error {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndex(before, []byte("\n"))
+	if column > 1 {
+		// offsets point just past the offending character
+		column--
+	}
+	return Error{Line: line, Column: column, Message: message}
+}
+
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func decodeYAML(data []byte) (interface{}, error) {
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, Errors{{Line: line, Message: m[2]}}
+		}
+		return nil, Errors{{Message: strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+	return tree, nil
+}
+
+// validator collects every problem of a decoded file instead of stopping at
+// the first one. Its methods return the value normalized for encoding/json.
+type validator struct {
+	errs Errors
+}
+
+func (v *validator) errorf(at string, format string, args ...interface{}) {
+	v.errs = append(v.errs, Error{Path: at, Message: fmt.Sprintf(format, args...)})
+}
+
+// object returns the keys of a YAML or JSON object, reporting unknown ones
+func (v *validator) object(at string, node interface{}, known ...string) (map[string]interface{}, bool) {
+	fields := map[string]interface{}{}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			fields[key] = value
+		}
+	case map[interface{}]interface{}:
+		for key, value := range n {
+			s, ok := key.(string)
+			if !ok {
+				v.errorf(at, "key %v must be a string", key)
+				continue
+			}
+			fields[s] = value
+		}
+	default:
+		v.errorf(at, "expected an object, got %s", kind(node))
+		return nil, false
+	}
+
+	var unknown []string
+	for key := range fields {
+		if !contains(known, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		v.errorf(join(at, key), "unknown key, expected one of %s", strings.Join(known, ", "))
+		delete(fields, key)
+	}
+	return fields, true
+}
+
+func (v *validator) str(at string, node interface{}) (string, bool) {
+	s, ok := node.(string)
+	if !ok {
+		v.errorf(at, "expected a string, got %s", kind(node))
+	}
+	return s, ok
+}
+
+func (v *validator) strs(at string, node interface{}, check func(at, s string)) []string {
+	list, ok := node.([]interface{})
+	if !ok {
+		v.errorf(at, "expected a list, got %s", kind(node))
+		return nil
+	}
+	var out []string
+	for i, item := range list {
+		itemAt := fmt.Sprintf("%s[%d]", at, i)
+		s, ok := v.str(itemAt, item)
+		if !ok {
+			continue
+		}
+		if s == "" {
+			v.errorf(itemAt, "must not be empty")
+			continue
+		}
+		if check != nil {
+			check(itemAt, s)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (v *validator) oneOf(at string, node interface{}, allowed ...string) string {
+	s, ok := v.str(at, node)
+	if ok && !contains(allowed, s) {
+		v.errorf(at, "unsupported value %q, expected one of %s", s, strings.Join(allowed, ", "))
+	}
+	return s
+}
+
+func (v *validator) file(node interface{}) interface{} {
+	if node == nil {
+		v.errorf("", "the file is empty")
+		return nil
+	}
+	fields, ok := v.object("", node, "version", "greenkeep")
+	if !ok {
+		return nil
+	}
+
+	if version, ok := fields["version"]; ok {
+		n, ok := integer(version)
+		switch {
+		case !ok:
+			v.errorf("version", "expected a whole number, got %s", kind(version))
+		case n < 1 || n > Version:
+			v.errorf("version", "unsupported version %d, expected %d", n, Version)
+		}
+		fields["version"] = n
+	}
+
+	entries, ok := fields["greenkeep"]
+	if !ok {
+		return fields
+	}
+	list, ok := entries.([]interface{})
+	if !ok {
+		v.errorf("greenkeep", "expected a list, got %s", kind(entries))
+		return fields
+	}
+	seen := map[string]int{}
+	normalized := make([]interface{}, len(list))
+	for i, entry := range list {
+		at := fmt.Sprintf("greenkeep[%d]", i)
+		e := v.entry(at, entry)
+		normalized[i] = e
+		if e == nil {
+			continue
+		}
+		key := fmt.Sprintf("%v:%v:%v:%v", e["language"], e["path"], e["branch"], e["branches"])
+		if j, ok := seen[key]; ok {
+			v.errorf(at, "duplicates greenkeep[%d]", j)
+		}
+		seen[key] = i
+	}
+	fields["greenkeep"] = normalized
+	return fields
+}
+
+var (
+	languageName  = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	gitHubLogin   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,38})$`)
+	invalidBranch = regexp.MustCompile(`[\x00-\x20~^:?*\[\\\x7f]|\.\.|@\{|//`)
+)
+
+func (v *validator) entry(at string, node interface{}) map[string]interface{} {
+	fields, ok := v.object(at, node,
+		"path", "language", "exclude", "schedule", "ignore", "strategy", "labels", "reviewers", "branch", "policy", "branches", "group")
+	if !ok {
+		return nil
+	}
+
+	if _, ok := fields["path"]; !ok {
+		v.errorf(at, "path is required")
+	} else if p, ok := v.str(join(at, "path"), fields["path"]); ok {
+		switch {
+		case p == "":
+			v.errorf(join(at, "path"), "must not be empty, use . for the repository root")
+		case path.IsAbs(p):
+			v.errorf(join(at, "path"), "%q must be relative to the repository root", p)
+		case path.Clean(p) == ".." || strings.HasPrefix(path.Clean(p), "../"):
+			v.errorf(join(at, "path"), "%q points outside of the repository", p)
+		case IsPattern(p):
+			if _, err := path.Match(p, ""); err != nil {
+				v.errorf(join(at, "path"), "invalid pattern %q: %v", p, err)
+			}
+		}
+	}
+
+	if patterns, ok := fields["exclude"]; ok {
+		if p, _ := fields["path"].(string); !IsPattern(p) {
+			v.errorf(join(at, "exclude"), "only applies to paths with patterns like packages/*")
+		}
+		fields["exclude"] = v.strs(join(at, "exclude"), patterns, func(at, pattern string) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.errorf(at, "invalid pattern %q: %v", pattern, err)
+			}
+		})
+	}
+
+	if _, ok := fields["language"]; !ok {
+		v.errorf(at, "language is required")
+	} else {
+		// the plugin registry decides which languages are supported
+		if language, ok := v.str(join(at, "language"), fields["language"]); ok && !languageName.MatchString(language) {
+			v.errorf(join(at, "language"), "invalid language %q", language)
+		}
+	}
+
+	if s, ok := fields["schedule"]; ok {
+		fields["schedule"] = v.schedule(join(at, "schedule"), s)
+	}
+	if patterns, ok := fields["ignore"]; ok {
+		fields["ignore"] = v.strs(join(at, "ignore"), patterns, func(at, pattern string) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.errorf(at, "invalid pattern %q: %v", pattern, err)
+			}
+		})
+	}
+	if strategy, ok := fields["strategy"]; ok {
+		v.oneOf(join(at, "strategy"), strategy, StrategyPin, StrategyBump, StrategyWiden)
+	}
+	if labels, ok := fields["labels"]; ok {
+		fields["labels"] = v.strs(join(at, "labels"), labels, nil)
+	}
+	if reviewers, ok := fields["reviewers"]; ok {
+		fields["reviewers"] = v.strs(join(at, "reviewers"), reviewers, func(at, login string) {
+			if !gitHubLogin.MatchString(login) {
+				v.errorf(at, "%q is not a GitHub login", login)
+			}
+		})
+	}
+	if branch, ok := fields["branch"]; ok {
+		if b, ok := v.str(join(at, "branch"), branch); ok && !validBranch(b) {
+			v.errorf(join(at, "branch"), "%q is not a valid branch name", b)
+		}
+	}
+	if policy, ok := fields["policy"]; ok {
+		v.oneOf(join(at, "policy"), policy, PolicyAll, PolicyMinor, PolicyPatch)
+	}
+	if branches, ok := fields["branches"]; ok {
+		if _, ok := fields["branch"]; ok {
+			v.errorf(join(at, "branches"), "can't be combined with branch")
+		}
+		fields["branches"] = v.branches(join(at, "branches"), branches)
+	}
+	if group, ok := fields["group"]; ok {
+		v.oneOf(join(at, "group"), group, GroupAll, GroupDependency)
+	}
+	return fields
+}
+
+// branches accepts names and objects with name and policy
+func (v *validator) branches(at string, node interface{}) interface{} {
+	list, ok := node.([]interface{})
+	if !ok {
+		v.errorf(at, "expected a list, got %s", kind(node))
+		return nil
+	}
+	if len(list) == 0 {
+		v.errorf(at, "must not be empty")
+	}
+
+	seen := map[string]int{}
+	normalized := make([]interface{}, 0, len(list))
+	for i, item := range list {
+		itemAt := fmt.Sprintf("%s[%d]", at, i)
+		b := map[string]interface{}{}
+		if name, ok := item.(string); ok {
+			b["name"] = name
+		} else if fields, ok := v.object(itemAt, item, "name", "policy"); ok {
+			b = fields
+			if policy, ok := fields["policy"]; ok {
+				v.oneOf(join(itemAt, "policy"), policy, PolicyAll, PolicyMinor, PolicyPatch)
+			}
+		} else {
+			continue
+		}
+
+		if _, ok := b["name"]; !ok {
+			v.errorf(itemAt, "name is required")
+			continue
+		}
+		name, ok := v.str(join(itemAt, "name"), b["name"])
+		if !ok {
+			continue
+		}
+		if !validBranch(name) {
+			v.errorf(join(itemAt, "name"), "%q is not a valid branch name", name)
+		}
+		if j, ok := seen[name]; ok {
+			v.errorf(itemAt, "duplicates %s[%d]", at, j)
+		}
+		seen[name] = i
+		normalized = append(normalized, b)
+	}
+	return normalized
+}
+
+// schedule accepts either an expression like 6h or 0 3 * * 1-5, or an object
+// mirroring schedule.Spec
+func (v *validator) schedule(at string, node interface{}) interface{} {
+	if expr, ok := node.(string); ok {
+		spec, err := schedule.Parse(expr)
+		if err != nil {
+			v.errorf(at, "%v", err)
+		}
+		return spec
+	}
+
+	before := len(v.errs)
+	fields, ok := v.object(at, node, "cron", "interval", "window", "timezone")
+	if !ok {
+		return nil
+	}
+	var spec schedule.Spec
+	if cron, ok := fields["cron"]; ok {
+		spec.Cron, _ = v.str(join(at, "cron"), cron)
+	}
+	if interval, ok := fields["interval"]; ok {
+		spec.Interval, _ = v.str(join(at, "interval"), interval)
+	}
+	if timezone, ok := fields["timezone"]; ok {
+		spec.Timezone, _ = v.str(join(at, "timezone"), timezone)
+	}
+	if window, ok := fields["window"]; ok {
+		wAt := join(at, "window")
+		if bounds, ok := v.object(wAt, window, "start", "end"); ok {
+			spec.Window = &schedule.Window{}
+			for _, key := range []string{"start", "end"} {
+				if _, ok := bounds[key]; !ok {
+					v.errorf(wAt, "%s is required", key)
+				}
+			}
+			spec.Window.Start, _ = v.str(join(wAt, "start"), bounds["start"])
+			spec.Window.End, _ = v.str(join(wAt, "end"), bounds["end"])
+		}
+	}
+
+	if len(v.errs) == before {
+		if err := spec.Validate(); err != nil {
+			v.errorf(at, "%v", err)
+		}
+	}
+	return spec
+}
+
+func validBranch(name string) bool {
+	return name != "" &&
+		!invalidBranch.MatchString(name) &&
+		!strings.HasPrefix(name, "-") &&
+		!strings.HasPrefix(name, "/") &&
+		!strings.HasSuffix(name, "/") &&
+		!strings.HasSuffix(name, ".") &&
+		!strings.HasSuffix(name, ".lock")
+}
+
+func integer(node interface{}) (int, bool) {
+	switch n := node.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), n == float64(int(n))
+	}
+	return 0, false
+}
+
+func kind(node interface{}) string {
+	switch node.(type) {
+	case nil:
+		return "nothing"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int, float64:
+		return "a number"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+func join(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+// Package election decides which of several scheduler instances publishes
+// jobs. All instances call TryLock periodically, only the one holding the
+// lock acts.
+package election
+
+// Locker is a non-blocking, renewable lock
+type Locker interface {
+	// TryLock acquires or renews the lock and reports whether it's held
+	TryLock() (bool, error)
+	// Unlock releases the lock, if held
+	Unlock() error
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package election
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FileLock holds an exclusive flock on a file. It only coordinates instances
+// sharing a host or a filesystem with working flock support.
+type FileLock struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{
+		path: path,
+	}
+}
+
+func (l *FileLock) TryLock() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+
+	l.file = file
+	return true, nil
+}
+
+func (l *FileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	// closing the file releases the lock
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package election
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FileLock_Exclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sisyphus-election")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scheduler.lock")
+	a, b := NewFileLock(path), NewFileLock(path)
+
+	if ok, err := a.TryLock(); err != nil || !ok {
+		t.Fatalf("Expected a to acquire the lock, but got %v, %v", ok, err)
+	}
+	if ok, err := a.TryLock(); err != nil || !ok {
+		t.Fatalf("Expected a to renew the lock, but got %v, %v", ok, err)
+	}
+	if ok, err := b.TryLock(); err != nil || ok {
+		t.Fatalf("Expected b to be denied the lock, but got %v, %v", ok, err)
+	}
+
+	if err := a.Unlock(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if ok, err := b.TryLock(); err != nil || !ok {
+		t.Fatalf("Expected b to acquire the released lock, but got %v, %v", ok, err)
+	}
+	if ok, err := a.TryLock(); err != nil || ok {
+		t.Fatalf("Expected a to be denied the lock, but got %v, %v", ok, err)
+	}
+	b.Unlock()
+}
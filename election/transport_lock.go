@@ -0,0 +1,133 @@
+package election
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/transport"
+	"github.com/nicolai86/sisyphus/uuid"
+)
+
+// heartbeat is published by the leader, and by candidates claiming the lock
+type heartbeat struct {
+	ID     string
+	Resign bool `json:",omitempty"`
+}
+
+// TransportLock is a lease based lock: the holder publishes heartbeats on every
+// TryLock, and the lock is considered free once no heartbeat was seen for
+// ttl. Concurrent claims are resolved in favour of the lowest ID, and a
+// claim is only granted on the TryLock after the claim was published, so
+// competing claims have been seen.
+//
+// TryLock must be called considerably more often than ttl.
+type TransportLock struct {
+	t       transport.Transport
+	subject string
+	id      string
+	ttl     time.Duration
+	sub     transport.Subscription
+
+	mu      sync.Mutex
+	holder  string
+	seen    time.Time
+	claimed bool
+}
+
+// NewTransportLock joins the election on the given subject
+func NewTransportLock(t transport.Transport, subject string, ttl time.Duration) (*TransportLock, error) {
+	id, err := uuid.New()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TransportLock{
+		t:       t,
+		subject: subject,
+		id:      id,
+		ttl:     ttl,
+	}
+	l.sub, err = t.Subscribe(subject, l.receive)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, t.Flush()
+}
+
+func (l *TransportLock) receive(msg *transport.Msg) {
+	var hb heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil || hb.ID == l.id {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if hb.Resign {
+		if hb.ID == l.holder {
+			l.holder = ""
+		}
+		return
+	}
+
+	if l.holder == "" || l.holder == hb.ID || hb.ID < l.holder || time.Since(l.seen) > l.ttl {
+		l.holder = hb.ID
+		l.seen = time.Now()
+	}
+}
+
+func (l *TransportLock) publish(hb heartbeat) error {
+	b, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	if err := l.t.Publish(l.subject, b); err != nil {
+		return err
+	}
+	return l.t.Flush()
+}
+
+func (l *TransportLock) TryLock() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	othersHold := l.holder != "" && l.holder != l.id && time.Since(l.seen) <= l.ttl
+	if othersHold && l.holder < l.id {
+		l.claimed = false
+		return false, nil
+	}
+	if othersHold && !l.claimed {
+		return false, nil
+	}
+
+	if err := l.publish(heartbeat{ID: l.id}); err != nil {
+		return false, err
+	}
+	if !l.claimed {
+		l.claimed = true
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (l *TransportLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.claimed {
+		return nil
+	}
+	l.claimed = false
+	return l.publish(heartbeat{ID: l.id, Resign: true})
+}
+
+// Close leaves the election
+func (l *TransportLock) Close() error {
+	if err := l.Unlock(); err != nil {
+		return err
+	}
+	return l.sub.Unsubscribe()
+}
@@ -0,0 +1,110 @@
+package election
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/transport"
+)
+
+const testTTL = 100 * time.Millisecond
+
+func newTestLock(t *testing.T, m *transport.Memory, id string) *TransportLock {
+	l, err := NewTransportLock(m, "scheduler.leader", testTTL)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	// fixed IDs make the tie breaking predictable
+	l.id = id
+	return l
+}
+
+// rounds calls TryLock on every lock, like schedulers ticking in parallel,
+// and returns the IDs holding the lock in the last round
+func rounds(t *testing.T, n int, locks ...*TransportLock) []string {
+	var leaders []string
+	for i := 0; i < n; i++ {
+		leaders = nil
+		for _, l := range locks {
+			ok, err := l.TryLock()
+			if err != nil {
+				t.Fatalf("Expected no error, but got %v", err)
+			}
+			if ok {
+				leaders = append(leaders, l.id)
+			}
+		}
+		// let the heartbeats arrive
+		time.Sleep(10 * time.Millisecond)
+	}
+	return leaders
+}
+
+func Test_TransportLock_SingleLeader(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	b := newTestLock(t, m, "b")
+	a := newTestLock(t, m, "a")
+
+	for i := 0; i < 5; i++ {
+		if leaders := rounds(t, 2, b, a); len(leaders) != 1 || leaders[0] != "a" {
+			t.Fatalf("Expected only a to lead, but got %q", leaders)
+		}
+	}
+}
+
+func Test_TransportLock_LowestIDWins(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	c := newTestLock(t, m, "c")
+	if leaders := rounds(t, 2, c); len(leaders) != 1 || leaders[0] != "c" {
+		t.Fatalf("Expected c to lead, but got %q", leaders)
+	}
+
+	// a lower ID claiming the lock takes over
+	a := newTestLock(t, m, "a")
+	if leaders := rounds(t, 3, c, a); len(leaders) != 1 || leaders[0] != "a" {
+		t.Fatalf("Expected a to take over, but got %q", leaders)
+	}
+}
+
+func Test_TransportLock_MovesAfterTTL(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	a := newTestLock(t, m, "a")
+	b := newTestLock(t, m, "b")
+	if leaders := rounds(t, 2, a, b); len(leaders) != 1 || leaders[0] != "a" {
+		t.Fatalf("Expected a to lead, but got %q", leaders)
+	}
+
+	// a stops sending heartbeats without resigning, like a crashed scheduler
+	if leaders := rounds(t, 5, b); len(leaders) != 0 {
+		t.Fatalf("Expected no leader within the TTL, but got %q", leaders)
+	}
+	if leaders := rounds(t, 10, b); len(leaders) != 1 || leaders[0] != "b" {
+		t.Fatalf("Expected b to lead after the TTL, but got %q", leaders)
+	}
+}
+
+func Test_TransportLock_MovesAfterUnlock(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	a := newTestLock(t, m, "a")
+	b := newTestLock(t, m, "b")
+	if leaders := rounds(t, 2, a, b); len(leaders) != 1 || leaders[0] != "a" {
+		t.Fatalf("Expected a to lead, but got %q", leaders)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	// resigning frees the lock right away, long before the TTL
+	if leaders := rounds(t, 2, b); len(leaders) != 1 || leaders[0] != "b" {
+		t.Fatalf("Expected b to lead after a resigned, but got %q", leaders)
+	}
+}
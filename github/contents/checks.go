@@ -0,0 +1,102 @@
+package contents
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+// Checks remembers the files of the last successful check of every entry,
+// so unchanged files can skip a check
+type Checks struct {
+	// MaxAge forces a check once the last one is older, as new versions of
+	// dependencies appear without changes to the manifests
+	MaxAge time.Duration
+	// Store persists checks across restarts and workers. Without a store,
+	// checks are only remembered by this process.
+	Store storage.CheckStateStore
+
+	mu     sync.Mutex
+	checks map[string]storage.CheckState
+}
+
+// NewChecks returns Checks skipping unchanged files for up to maxAge
+func NewChecks(store storage.CheckStateStore, maxAge time.Duration) *Checks {
+	return &Checks{MaxAge: maxAge, Store: store, checks: map[string]storage.CheckState{}}
+}
+
+func (c *Checks) load(repositoryID, entry string) (storage.CheckState, error) {
+	if c.Store != nil {
+		return c.Store.LoadCheckState(repositoryID, entry)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.checks[repositoryID+":"+entry]
+	if !ok {
+		return state, storage.ErrNotFound
+	}
+	return state, nil
+}
+
+// Unchanged reports whether the last successful check of entry saw the same
+// files within MaxAge. Changes to the entry itself, like new ignores, count
+// as changes as well.
+func (c *Checks) Unchanged(repositoryID string, entry interface{}, files []File, now time.Time) (bool, error) {
+	key, err := entryKey(entry)
+	if err != nil {
+		return false, err
+	}
+	last, err := c.load(repositoryID, key)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return last.Fingerprint == fingerprint(files) && now.Sub(last.Time) < c.MaxAge, nil
+}
+
+// Succeeded records a successful check of entry
+func (c *Checks) Succeeded(repositoryID string, entry interface{}, files []File, now time.Time) error {
+	key, err := entryKey(entry)
+	if err != nil {
+		return err
+	}
+	state := storage.CheckState{
+		RepositoryID: repositoryID,
+		Entry:        key,
+		Fingerprint:  fingerprint(files),
+		Time:         now,
+	}
+	if c.Store != nil {
+		return c.Store.StoreCheckState(state)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[repositoryID+":"+key] = state
+	return nil
+}
+
+// entryKey hashes the JSON of entry, so keys stay short enough for file names
+func entryKey(entry interface{}) (string, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+func fingerprint(files []File) string {
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00", f.Path, len(f.Content))
+		h.Write(f.Content)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,174 @@
+// Package contents fetches files of repositories through the github contents
+// API. Responses are cached with their ETag and revalidated with
+// If-None-Match, so unchanged files don't count against the rate limit.
+package contents
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// DefaultBaseURL is the github API
+const DefaultBaseURL = "https://api.github.com/"
+
+// ErrNotFound is returned for files missing at the requested ref
+var ErrNotFound = errors.New("file not found")
+
+// RateLimitError is returned once the rate limit of a token is exhausted
+type RateLimitError struct {
+	// Reset is when github accepts requests again
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("github rate limit exceeded until %s", e.Reset.Format(time.RFC3339))
+}
+
+// StatusError is returned for all other unexpected responses
+type StatusError struct {
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Failed to fetch %s: %s", e.Path, e.Status)
+}
+
+// File is the content of a file at a ref
+type File struct {
+	Path    string
+	Content []byte
+	ETag    string
+	// Cached is set if github answered 304 Not Modified
+	Cached bool
+}
+
+// Cache keeps the last response for every file
+type Cache interface {
+	Get(key string) (File, bool)
+	Set(key string, f File)
+}
+
+// memoryCache is a Cache for a single process
+type memoryCache struct {
+	mu    sync.Mutex
+	files map[string]File
+}
+
+// NewMemoryCache returns a Cache keeping files in memory
+func NewMemoryCache() Cache {
+	return &memoryCache{files: map[string]File{}}
+}
+
+func (c *memoryCache) Get(key string) (File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[key]
+	return f, ok
+}
+
+func (c *memoryCache) Set(key string, f File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[key] = f
+}
+
+// Fetcher fetches files, revalidating cached ones
+type Fetcher struct {
+	// BaseURL of the github API, DefaultBaseURL if empty
+	BaseURL string
+	Client  *http.Client
+	Cache   Cache
+}
+
+// NewFetcher returns a Fetcher caching files in memory
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		BaseURL: DefaultBaseURL,
+		Cache:   NewMemoryCache(),
+	}
+}
+
+// Fetch returns the file at path of owner/repo on ref, a branch or commit
+func (f *Fetcher) Fetch(ctx context.Context, accessToken, owner, repo, ref, path string) (File, error) {
+	base := f.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	uri := fmt.Sprintf("%srepos/%s/%s/contents/%s?ref=%s",
+		strings.TrimSuffix(base, "/")+"/", owner, repo, escapePath(path), url.QueryEscape(ref))
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return File{}, err
+	}
+	// the raw media type returns the file itself rather than base64 encoded JSON
+	req.Header.Set("Accept", "application/vnd.github.v3.raw")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "token "+accessToken)
+	}
+
+	key := strings.Join([]string{owner, repo, ref, path}, "/")
+	cached, ok := File{}, false
+	if f.Cache != nil {
+		cached, ok = f.Cache.Get(key)
+	}
+	if ok && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := ctxhttp.Do(ctx, f.Client, req)
+	if err != nil {
+		return File{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		cached.Cached = true
+		return cached, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return File{}, ErrNotFound
+	case isRateLimited(resp):
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		return File{}, &RateLimitError{Reset: time.Unix(reset, 0)}
+	case resp.StatusCode != http.StatusOK:
+		return File{}, &StatusError{Path: path, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return File{}, err
+	}
+	file := File{Path: path, Content: content, ETag: resp.Header.Get("ETag")}
+	if f.Cache != nil && file.ETag != "" {
+		f.Cache.Set(key, file)
+	}
+	return file, nil
+}
+
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0"
+}
+
+// escapePath escapes every segment of path, keeping the slashes
+func escapePath(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,139 @@
+package contents
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/storage"
+	"golang.org/x/net/context"
+)
+
+func Test_Fetcher_RevalidatesCachedFiles(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/repos/nicolai86/sisyphus/contents/services/api/Gemfile" || r.URL.Query().Get("ref") != "main" {
+			t.Errorf("Expected a request for the Gemfile on main, but got %q", r.URL)
+		}
+		if r.Header.Get("Authorization") != "token secret" {
+			t.Errorf("Expected the token in the Authorization header, but got %q", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("source 'https://rubygems.org'\n"))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher()
+	f.BaseURL = srv.URL
+	for i, cached := range []bool{false, true} {
+		file, err := f.Fetch(context.Background(), "secret", "nicolai86", "sisyphus", "main", "services/api/Gemfile")
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if string(file.Content) != "source 'https://rubygems.org'\n" {
+			t.Fatalf("Expected the Gemfile, but got %q", file.Content)
+		}
+		if file.Cached != cached {
+			t.Fatalf("Expected request %d to be cached %v, but got %v", i, cached, file.Cached)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("Expected 2 requests, but got %d", requests)
+	}
+}
+
+func Test_Fetcher_TypedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/o/r/contents/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/repos/o/r/contents/limited":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "1476748800")
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	f := NewFetcher()
+	f.BaseURL = srv.URL + "/"
+	ctx := context.Background()
+
+	if _, err := f.Fetch(ctx, "", "o", "r", "main", "missing"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+	_, err := f.Fetch(ctx, "", "o", "r", "main", "limited")
+	if limit, ok := err.(*RateLimitError); !ok || !limit.Reset.Equal(time.Unix(1476748800, 0)) {
+		t.Fatalf("Expected a RateLimitError, but got %#v", err)
+	}
+	_, err = f.Fetch(ctx, "", "o", "r", "main", "broken")
+	if status, ok := err.(*StatusError); !ok || status.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a StatusError, but got %#v", err)
+	}
+}
+
+func testChecks(t *testing.T, c *Checks) {
+	now := time.Now()
+	files := []File{{Path: "Gemfile", Content: []byte("a")}, {Path: "Gemfile.lock", Content: []byte("b")}}
+	entry := map[string]string{"path": "."}
+
+	unchanged := func(entry interface{}, files []File, at time.Time) bool {
+		ok, err := c.Unchanged("repo", entry, files, at)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		return ok
+	}
+
+	if unchanged(entry, files, now) {
+		t.Fatalf("Expected unchecked files to be changed, but they were not")
+	}
+	if err := c.Succeeded("repo", entry, files, now); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !unchanged(entry, files, now.Add(time.Minute)) {
+		t.Fatalf("Expected checked files to be unchanged, but they were not")
+	}
+	if unchanged(entry, files, now.Add(2*time.Hour)) {
+		t.Fatalf("Expected old checks to expire, but they did not")
+	}
+	changed := []File{{Path: "Gemfile", Content: []byte("a")}, {Path: "Gemfile.lock", Content: []byte("c")}}
+	if unchanged(entry, changed, now) {
+		t.Fatalf("Expected modified files to be changed, but they were not")
+	}
+	if unchanged(map[string]string{"path": ".", "ignore": "rake"}, files, now) {
+		t.Fatalf("Expected a modified entry to be changed, but it was not")
+	}
+}
+
+func Test_Checks_Unchanged(t *testing.T) {
+	testChecks(t, NewChecks(nil, time.Hour))
+}
+
+func Test_Checks_Store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sisyphus-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := storage.NewFileStorage(dir)
+	testChecks(t, NewChecks(store, time.Hour))
+
+	// a restarted worker remembers the checks
+	files := []File{{Path: "Gemfile", Content: []byte("a")}, {Path: "Gemfile.lock", Content: []byte("b")}}
+	unchanged, err := NewChecks(store, time.Hour).Unchanged("repo", map[string]string{"path": "."}, files, time.Now())
+	if err != nil || !unchanged {
+		t.Fatalf("Expected stored checks to survive, but got %v, %v", unchanged, err)
+	}
+}
@@ -0,0 +1,54 @@
+package issue
+
+import (
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+func stringPtr(str string) *string {
+	return &str
+}
+
+// Report opens an issue, or updates the open issue with the same title, so
+// repeated reports of the same problem don't pile up. It returns the
+// issue number.
+func Report(accessToken, owner, repo, title, body string) (int, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	opt := &github.IssueListByRepoOptions{State: "open"}
+	for {
+		issues, resp, err := client.Issues.ListByRepo(owner, repo, opt)
+		if err != nil {
+			return 0, err
+		}
+		for _, issue := range issues {
+			if issue.Title == nil || *issue.Title != title || issue.Number == nil {
+				continue
+			}
+			if issue.Body != nil && *issue.Body == body {
+				return *issue.Number, nil
+			}
+			_, _, err := client.Issues.Edit(owner, repo, *issue.Number, &github.IssueRequest{
+				Body: stringPtr(body),
+			})
+			return *issue.Number, err
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	issue, _, err := client.Issues.Create(owner, repo, &github.IssueRequest{
+		Title: stringPtr(title),
+		Body:  stringPtr(body),
+	})
+	if err != nil || issue.Number == nil {
+		return 0, err
+	}
+	return *issue.Number, nil
+}
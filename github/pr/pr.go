@@ -5,50 +5,136 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"time"
+	"sort"
+	"strings"
 
 	"github.com/google/go-github/github"
 	"github.com/nicolai86/sisyphus/github/repo"
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
 // PullRequestExists wraps a simple loop to validate that a PR exists which fulfills
 // some arbitrary requirement
-func PullRequestExists(accessToken, owner, repo string, exists func(*github.PullRequest) bool) bool {
+func PullRequestExists(accessToken, owner, repo string, exists func(*github.PullRequest) bool) (bool, error) {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: accessToken},
 	)
 	tc := oauth2.NewClient(oauth2.NoContext, ts)
 	client := github.NewClient(tc)
 
-	prs, _, _ := client.PullRequests.List(owner, repo, nil)
+	prs, _, err := client.PullRequests.List(owner, repo, nil)
+	if err != nil {
+		return false, err
+	}
 
 	for _, pr := range prs {
 		if exists(pr) {
-			return true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// BranchHasPullRequest reports whether a PR was opened from branch, including
+// closed and merged ones
+func BranchHasPullRequest(accessToken, owner, repo, branch string) (bool, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	prs, _, err := client.PullRequests.List(owner, repo, &github.PullRequestListOptions{State: "all"})
+	if err != nil {
+		return false, err
+	}
+
+	for _, pr := range prs {
+		if pr.Head != nil && pr.Head.Ref != nil && *pr.Head.Ref == branch {
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
 
 func stringPtr(str string) *string {
 	return &str
 }
 
-func CreatePullRequest(accessToken, owner, repo, title, branch, body string) {
+// CreatePullRequest opens a PR merging branch into base
+func CreatePullRequest(accessToken, owner, repo, title, branch, base, body string) (*github.PullRequest, error) {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: accessToken},
 	)
 	tc := oauth2.NewClient(oauth2.NoContext, ts)
 	client := github.NewClient(tc)
 
-	client.PullRequests.Create(owner, repo, &github.NewPullRequest{
+	pr, _, err := client.PullRequests.Create(owner, repo, &github.NewPullRequest{
 		Title: stringPtr(title),
 		Head:  stringPtr(branch),
-		Base:  stringPtr("master"),
+		Base:  stringPtr(base),
 		Body:  stringPtr(body),
 	})
+	return pr, err
+}
+
+// AddLabels labels an existing pull request
+func AddLabels(accessToken, owner, repo string, number int, labels []string) error {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	_, _, err := client.Issues.AddLabelsToIssue(owner, repo, number, labels)
+	return err
+}
+
+// RequestReviewers asks users to review an existing pull request
+func RequestReviewers(accessToken, owner, repo string, number int, reviewers []string) error {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	req, err := client.NewRequest("POST", fmt.Sprintf("repos/%s/%s/pulls/%d/requested_reviewers", owner, repo, number), struct {
+		Reviewers []string `json:"reviewers"`
+	}{reviewers})
+	if err != nil {
+		return err
+	}
+	// review requests are a preview of the github API
+	req.Header.Set("Accept", "application/vnd.github.black-cat-preview+json")
+	_, err = client.Do(req, nil)
+	return err
+}
+
+// BranchName names the branch updating dependencies of path on base. The
+// dependencies should include their new versions. The name only depends on
+// the arguments, so retried jobs find the branch pushed by earlier attempts.
+func BranchName(repository, path, base string, dependencies []string) string {
+	sorted := append([]string{}, dependencies...)
+	sort.Strings(sorted)
+	key := strings.Join(append([]string{repository, path, base}, sorted...), "\x00")
+	return fmt.Sprintf("greenkeep/%x", md5.Sum([]byte(key)))
+}
+
+// BranchExists asks the remote for branch. Git is killed once ctx is done.
+func BranchExists(ctx context.Context, accessToken, owner, repoName, branch string) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads",
+		fmt.Sprintf("https://%s@github.com/%s/%s.git", accessToken, owner, repoName),
+		"refs/heads/"+branch,
+	)
+	cmd.Env = os.Environ()
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("Failed to list branches: %q", err)
+	}
+	return strings.TrimSpace(string(out)) != "", nil
 }
 
 type UpdateFile struct {
@@ -56,21 +142,26 @@ type UpdateFile struct {
 	Destination string
 }
 
-func PublishChanges(accessToken, owner, repoName string, updates []UpdateFile) (string, error) {
+// PublishChanges pushes the updated files to a new branch off base. Git is
+// killed once ctx is done.
+func PublishChanges(ctx context.Context, accessToken, owner, repoName, base, branch string, updates []UpdateFile) error {
 	for _, update := range updates {
 		if _, err := os.Stat(update.Source); err != nil {
-			return "", err
+			return err
 		}
 	}
 
-	dir, _ := repo.Clone(accessToken, owner, repoName)
-	branch := fmt.Sprintf("greenkeep/%x", md5.Sum([]byte(time.Now().String())))
+	dir, err := repo.Clone(ctx, accessToken, owner, repoName, base)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
 	if err := func() error {
 		cmds := [][]string{
 			[]string{"git", "checkout", "-b", branch},
 		}
 		for _, args := range cmds {
-			cmd := exec.Command(args[0], args[1:]...)
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 			cmd.Dir = dir
 			cmd.Env = os.Environ()
 			cmd.Stdout = os.Stdout
@@ -81,29 +172,28 @@ func PublishChanges(accessToken, owner, repoName string, updates []UpdateFile) (
 		}
 		return nil
 	}(); err != nil {
-		return "", err
+		return err
 	}
 
 	for _, update := range updates {
 		if err := os.Rename(update.Source, fmt.Sprintf("%s/%s", dir, update.Destination)); err != nil {
-			return "", err
+			return err
 		}
-		cmd := exec.Command("git", "add", fmt.Sprintf("%s/%s", dir, update.Destination))
+		cmd := exec.CommandContext(ctx, "git", "add", fmt.Sprintf("%s/%s", dir, update.Destination))
 		cmd.Dir = dir
 		cmd.Env = os.Environ()
 		if err := cmd.Run(); err != nil {
-			return "", err
+			return err
 		}
 	}
 
 	if err := func() error {
 		cmds := [][]string{
 			[]string{"git", "commit", "-m", "'update dependencies'"},
-			[]string{"git", "push", "-f", fmt.Sprintf("https://%s@github.com/%s/%s.git", accessToken, owner, repoName)},
-			[]string{"git", "checkout", "master"},
+			[]string{"git", "push", "-f", fmt.Sprintf("https://%s@github.com/%s/%s.git", accessToken, owner, repoName), branch},
 		}
 		for _, args := range cmds {
-			cmd := exec.Command(args[0], args[1:]...)
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 			cmd.Dir = dir
 			cmd.Env = os.Environ()
 			cmd.Stdout = os.Stdout
@@ -114,8 +204,8 @@ func PublishChanges(accessToken, owner, repoName string, updates []UpdateFile) (
 		}
 		return nil
 	}(); err != nil {
-		return "", err
+		return err
 	}
 
-	return branch, nil
+	return nil
 }
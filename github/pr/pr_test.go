@@ -0,0 +1,26 @@
+package pr
+
+import "testing"
+
+func Test_BranchName_Deterministic(t *testing.T) {
+	branch := BranchName("nicolai86/sisyphus", "web", "master", []string{"rake@12.0.0", "rails@5.0.1"})
+	if again := BranchName("nicolai86/sisyphus", "web", "master", []string{"rails@5.0.1", "rake@12.0.0"}); again != branch {
+		t.Fatalf("Expected %q regardless of the order of dependencies, but got %q", branch, again)
+	}
+
+	others := []struct {
+		repository, path, base string
+		dependencies           []string
+	}{
+		{"nicolai86/other", "web", "master", []string{"rake@12.0.0", "rails@5.0.1"}},
+		{"nicolai86/sisyphus", "api", "master", []string{"rake@12.0.0", "rails@5.0.1"}},
+		{"nicolai86/sisyphus", "web", "develop", []string{"rake@12.0.0", "rails@5.0.1"}},
+		{"nicolai86/sisyphus", "web", "master", []string{"rake@12.0.0"}},
+		{"nicolai86/sisyphus", "web", "master", []string{"rake@12.0.1", "rails@5.0.1"}},
+	}
+	for _, o := range others {
+		if other := BranchName(o.repository, o.path, o.base, o.dependencies); other == branch {
+			t.Fatalf("Expected %v to get a branch of its own, but got %q", o, other)
+		}
+	}
+}
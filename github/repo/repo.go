@@ -3,11 +3,55 @@ package repo
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 )
 
-func Clone(accessToken, owner, repo string) (string, error) {
+// DefaultBranch asks github for the default branch of a repository
+func DefaultBranch(accessToken, owner, repo string) (string, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	r, _, err := client.Repositories.Get(owner, repo)
+	if err != nil {
+		return "", err
+	}
+	if r.DefaultBranch == nil || *r.DefaultBranch == "" {
+		return "", fmt.Errorf("%s/%s has no default branch", owner, repo)
+	}
+	return *r.DefaultBranch, nil
+}
+
+// Accessible reports whether the owner of accessToken can read a repository.
+// github answers 404 for private repositories the token has no access to.
+func Accessible(accessToken, owner, repo string) (bool, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	_, resp, err := client.Repositories.Get(owner, repo)
+	if resp != nil && resp.Response != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Clone checks out a shallow copy of branch into a new temporary directory,
+// which the caller must remove. Git is killed once ctx is done.
+func Clone(ctx context.Context, accessToken, owner, repo, branch string) (string, error) {
 	dir, err := ioutil.TempDir("", fmt.Sprintf("gh-%s-%s", owner, repo))
 	if err != nil {
 		return "", err
@@ -15,14 +59,15 @@ func Clone(accessToken, owner, repo string) (string, error) {
 
 	cmds := [][]string{
 		[]string{"git", "init"},
-		[]string{"git", "pull", fmt.Sprintf("https://%s@github.com/%s/%s.git", accessToken, owner, repo), "--depth", "1"},
+		[]string{"git", "pull", "--depth", "1", fmt.Sprintf("https://%s@github.com/%s/%s.git", accessToken, owner, repo), branch},
 	}
 
 	for _, args := range cmds {
-		cmd := exec.Command(args[0], args[1:]...)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 		cmd.Dir = dir
 		cmd.Env = os.Environ()
 		if err := cmd.Run(); err != nil {
+			os.RemoveAll(dir)
 			return "", err
 		}
 	}
@@ -0,0 +1,30 @@
+package tree
+
+import (
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// Files lists the paths of all files of a repository at ref, which is a
+// branch, a commit or HEAD for the default branch
+func Files(accessToken, owner, repo, ref string) ([]string, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	client := github.NewClient(tc)
+
+	tree, _, err := client.Git.GetTree(owner, repo, ref, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range tree.Entries {
+		if entry.Type == nil || *entry.Type != "blob" || entry.Path == nil {
+			continue
+		}
+		files = append(files, *entry.Path)
+	}
+	return files, nil
+}
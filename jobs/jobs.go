@@ -0,0 +1,313 @@
+// Package jobs publishes work over a transport with acknowledgements: a job is
+// retried with exponential backoff until a worker reports success, and
+// moved to a dead-letter subject once it ran out of attempts.
+//
+// A worker replies twice to every job: once when it received the job, so the
+// dispatcher knows a worker is alive, and once with the result. Workers with
+// a full backlog reply busy instead, and the job is offered again later.
+//
+// Dispatchers with a Queue persist every job until it's acknowledged or
+// dead-lettered, and Resume delivers them again after a restart.
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
+)
+
+// DeadLetterSubject receives every job which failed all attempts
+const DeadLetterSubject = "jobs.dead-letter"
+
+// Job is a single unit of work. Its payload is decoded with job.Decode.
+type Job struct {
+	messages.Envelope
+	Subject     string
+	Attempt     int
+	MaxAttempts int
+}
+
+// DeadLetter is published to DeadLetterSubject
+type DeadLetter struct {
+	Job   Job
+	Error string
+}
+
+const (
+	statusReceived = "received"
+	statusBusy     = "busy"
+	statusDone     = "done"
+	statusFailed   = "failed"
+)
+
+// reply is sent by workers to the job's reply subject
+type reply struct {
+	JobID  string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+var (
+	errNoWorker = errors.New("no worker received the job")
+	errBusy     = errors.New("all workers are busy")
+)
+
+// Dispatcher publishes jobs and retries them in the background
+type Dispatcher struct {
+	t transport.Transport
+
+	// MaxAttempts before a job is dead-lettered
+	MaxAttempts int
+	// ReceiptTimeout is how long to wait for any worker to receive a job
+	ReceiptTimeout time.Duration
+	// AckTimeout is how long a worker may take to finish a job
+	AckTimeout time.Duration
+	// Backoff is the delay before the second attempt; it doubles with every
+	// further attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Keyring seals all payloads end to end if set
+	Keyring *storage.Keyring
+	// Queue keeps pending jobs and their attempts if set, so Resume can
+	// deliver them after a restart
+	Queue storage.JobQueueStore
+	// QueueName separates the jobs of dispatchers sharing a Queue
+	QueueName string
+
+	deliveries sync.WaitGroup
+}
+
+func NewDispatcher(t transport.Transport) *Dispatcher {
+	return &Dispatcher{
+		t:              t,
+		MaxAttempts:    5,
+		ReceiptTimeout: 5 * time.Second,
+		AckTimeout:     30 * time.Minute,
+		Backoff:        10 * time.Second,
+		MaxBackoff:     10 * time.Minute,
+	}
+}
+
+// Dispatch publishes payload as new job to subject and returns the job ID.
+// Delivery and retries happen in the background.
+func (d *Dispatcher) Dispatch(subject string, payload interface{}) (string, error) {
+	return d.dispatch("", subject, payload)
+}
+
+// DispatchFrom publishes a job caused by parent, sharing its correlation ID
+func (d *Dispatcher) DispatchFrom(parent Job, subject string, payload interface{}) (string, error) {
+	return d.dispatch(parent.CorrelationID, subject, payload)
+}
+
+func (d *Dispatcher) dispatch(correlationID, subject string, payload interface{}) (string, error) {
+	envelope, err := messages.NewEnvelope(correlationID, payload)
+	if err != nil {
+		return "", err
+	}
+	if d.Keyring != nil {
+		if envelope, err = messages.Seal(envelope, *d.Keyring); err != nil {
+			return "", err
+		}
+	}
+
+	job := Job{
+		Envelope:    envelope,
+		Subject:     subject,
+		Attempt:     1,
+		MaxAttempts: d.MaxAttempts,
+	}
+	if err := d.persist(job); err != nil {
+		return "", err
+	}
+	d.start(job)
+
+	return job.JobID, nil
+}
+
+func (d *Dispatcher) start(job Job) {
+	d.deliveries.Add(1)
+	go func() {
+		defer d.deliveries.Done()
+		d.deliver(job)
+	}()
+}
+
+// Resume delivers the jobs left pending by an earlier run of the dispatcher,
+// continuing with the attempt they were at. It returns the number of jobs.
+func (d *Dispatcher) Resume() (int, error) {
+	if d.Queue == nil {
+		return 0, nil
+	}
+	pending, err := d.Queue.LoadPendingJobs(d.QueueName)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pending {
+		var job Job
+		if err := messages.Decode(p.Job, &job); err != nil {
+			log.Printf("Failed to resume job %s, dropping it: %q\n", p.ID, err)
+			d.finish(Job{Envelope: messages.Envelope{JobID: p.ID}})
+			continue
+		}
+		job.Attempt = p.Attempt
+		d.start(job)
+	}
+	return len(pending), nil
+}
+
+// persist stores job in the queue, if any
+func (d *Dispatcher) persist(job Job) error {
+	if d.Queue == nil {
+		return nil
+	}
+	b, err := messages.Encode(job)
+	if err != nil {
+		return err
+	}
+	return d.Queue.StorePendingJob(storage.PendingJob{
+		Queue:   d.QueueName,
+		ID:      job.JobID,
+		Subject: job.Subject,
+		Attempt: job.Attempt,
+		Job:     b,
+	})
+}
+
+// finish removes an acknowledged or dead-lettered job from the queue
+func (d *Dispatcher) finish(job Job) {
+	if d.Queue == nil {
+		return
+	}
+	if err := d.Queue.DeletePendingJob(d.QueueName, job.JobID); err != nil {
+		log.Printf("Failed to remove job %s from the queue: %q\n", job.JobID, err)
+	}
+}
+
+// Drain waits until all dispatched jobs were acknowledged or dead-lettered,
+// or ctx is done. Jobs still being delivered then are lost, unless the Queue
+// keeps them for Resume.
+func (d *Dispatcher) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempt && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return delay
+}
+
+func (d *Dispatcher) deliver(job Job) {
+	var (
+		err  error
+		busy int
+	)
+	if job.Attempt < 1 {
+		job.Attempt = 1
+	}
+	for {
+		if err = d.attempt(job); err == nil {
+			d.finish(job)
+			return
+		}
+		if err == errBusy {
+			// busy workers push back without using up attempts
+			busy++
+			time.Sleep(d.backoff(busy))
+			continue
+		}
+
+		log.Printf("job %s on %q failed attempt %d/%d: %v\n", job.JobID, job.Subject, job.Attempt, job.MaxAttempts, err)
+		if job.Attempt >= job.MaxAttempts {
+			break
+		}
+		// the failed attempt counts even if the dispatcher stops during backoff
+		delay := d.backoff(job.Attempt)
+		job.Attempt++
+		if err := d.persist(job); err != nil {
+			log.Printf("Failed to persist attempt %d of job %s: %q\n", job.Attempt, job.JobID, err)
+		}
+		time.Sleep(delay)
+	}
+
+	b, _ := json.Marshal(DeadLetter{Job: job, Error: err.Error()})
+	d.t.Publish(DeadLetterSubject, b)
+	d.t.Flush()
+	d.finish(job)
+}
+
+func (d *Dispatcher) attempt(job Job) error {
+	replies := make(chan reply, 2)
+	inbox := d.t.NewInbox()
+	sub, err := d.t.Subscribe(inbox, func(msg *transport.Msg) {
+		var r reply
+		if err := json.Unmarshal(msg.Data, &r); err != nil || r.JobID != job.JobID {
+			return
+		}
+		select {
+		case replies <- r:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	b, err := messages.Encode(job)
+	if err != nil {
+		return err
+	}
+	if err := d.t.PublishRequest(job.Subject, inbox, b); err != nil {
+		return err
+	}
+	if err := d.t.Flush(); err != nil {
+		return err
+	}
+
+	timeout := d.ReceiptTimeout
+	for {
+		select {
+		case r := <-replies:
+			switch r.Status {
+			case statusReceived:
+				timeout = d.AckTimeout
+			case statusBusy:
+				return errBusy
+			case statusDone:
+				return nil
+			default:
+				return fmt.Errorf("worker failed: %s", r.Error)
+			}
+		case <-time.After(timeout):
+			if timeout == d.ReceiptTimeout {
+				return errNoWorker
+			}
+			return errors.New("worker did not finish in time")
+		}
+	}
+}
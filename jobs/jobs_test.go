@@ -0,0 +1,336 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
+)
+
+func newTestDispatcher(t transport.Transport) *Dispatcher {
+	d := NewDispatcher(t)
+	d.ReceiptTimeout = 100 * time.Millisecond
+	d.AckTimeout = time.Second
+	d.Backoff = time.Millisecond
+	d.MaxBackoff = 5 * time.Millisecond
+	d.MaxAttempts = 3
+	return d
+}
+
+// Test_Pipeline runs scheduler → master → language worker in memory
+func Test_Pipeline(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	handled := make(chan string, 1)
+	NewWorker("greenkeep", func(ctx context.Context, job Job) error {
+		var repositoryID string
+		if err := job.Decode(&repositoryID); err != nil {
+			return err
+		}
+		_, err := d.Dispatch("greenkeep-ruby", repositoryID)
+		return err
+	}).Subscribe(m, "greenkeep")
+	NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		var repositoryID string
+		if err := job.Decode(&repositoryID); err != nil {
+			return err
+		}
+		handled <- repositoryID
+		return nil
+	}).Subscribe(m, "greenkeep-ruby")
+
+	if _, err := d.Dispatch("greenkeep", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-handled:
+		if id != "1" {
+			t.Fatalf("Expected the ruby worker to handle %q, but got %q", "1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the ruby worker to handle the job, but it never did")
+	}
+}
+
+func Test_Dispatcher_RetriesFailedJobs(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	attempts := make(chan int, 3)
+	NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		attempts <- job.Attempt
+		if job.Attempt < 2 {
+			panic("docker went away")
+		}
+		return nil
+	}).Subscribe(m, "greenkeep-ruby")
+	dead := make(chan *transport.Msg, 1)
+	m.Subscribe(DeadLetterSubject, func(msg *transport.Msg) { dead <- msg })
+
+	d.Dispatch("greenkeep-ruby", nil)
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case attempt := <-attempts:
+			if attempt != expected {
+				t.Fatalf("Expected attempt %d, but got %d", expected, attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected attempt %d, but got none", expected)
+		}
+	}
+	select {
+	case msg := <-dead:
+		t.Fatalf("Expected no dead letter, but got %s", msg.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_Dispatcher_DeadLettersExhaustedJobs(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		return errors.New("no Gemfile")
+	}).Subscribe(m, "greenkeep-ruby")
+	dead := make(chan *transport.Msg, 1)
+	m.Subscribe(DeadLetterSubject, func(msg *transport.Msg) { dead <- msg })
+
+	id, _ := d.Dispatch("greenkeep-ruby", nil)
+
+	select {
+	case msg := <-dead:
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Data, &letter); err != nil {
+			t.Fatal(err)
+		}
+		if letter.Job.JobID != id || letter.Job.Attempt != 3 {
+			t.Fatalf("Expected job %s after 3 attempts, but got %#v", id, letter.Job)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a dead letter, but got none")
+	}
+}
+
+func Test_Dispatcher_ResumesPendingJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sisyphus-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue := storage.NewFileStorage(dir)
+
+	// the first dispatcher finds no worker and stops before retrying, like
+	// a master killed while its jobs were pending
+	crashed := transport.NewMemory()
+	d := newTestDispatcher(crashed)
+	d.Queue, d.QueueName = queue, "master"
+	d.Backoff, d.MaxBackoff = time.Hour, time.Hour
+	id, err := d.Dispatch("greenkeep-ruby", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	crashed.Close()
+
+	pending, err := queue.LoadPendingJobs("master")
+	if err != nil || len(pending) != 1 || pending[0].ID != id || pending[0].Attempt != 2 {
+		t.Fatalf("Expected job %s pending at attempt 2, but got %#v, %v", id, pending, err)
+	}
+
+	m := transport.NewMemory()
+	defer m.Close()
+	handled := make(chan Job, 1)
+	NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		handled <- job
+		return nil
+	}).Subscribe(m, "greenkeep-ruby")
+
+	restarted := newTestDispatcher(m)
+	restarted.Queue, restarted.QueueName = queue, "master"
+	if n, err := restarted.Resume(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 resumed job, but got %d, %v", n, err)
+	}
+
+	select {
+	case job := <-handled:
+		var repositoryID string
+		if err := job.Decode(&repositoryID); err != nil {
+			t.Fatal(err)
+		}
+		if job.JobID != id || job.Attempt != 2 || repositoryID != "1" {
+			t.Fatalf("Expected attempt 2 of job %s for 1, but got attempt %d of %s for %q", id, job.Attempt, job.JobID, repositoryID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the resumed job to be handled, but it never was")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := restarted.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := queue.LoadPendingJobs("master"); err != nil || len(pending) != 0 {
+		t.Fatalf("Expected acknowledged jobs to leave the queue, but got %#v, %v", pending, err)
+	}
+}
+
+func Test_Worker_BoundsConcurrency(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+		done            = make(chan struct{}, 5)
+	)
+	w := NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		mu.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	w.Concurrency = 2
+	w.Backlog = 1
+	w.Subscribe(m, "greenkeep-ruby")
+
+	for i := 0; i < 5; i++ {
+		d.Dispatch("greenkeep-ruby", i)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected all 5 jobs to run eventually, but only %d did", i)
+		}
+	}
+	if maxRun > 2 {
+		t.Fatalf("Expected at most 2 concurrent jobs, but got %d", maxRun)
+	}
+}
+
+func Test_Worker_DrainCancelsRunningJobs(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	started := make(chan struct{})
+	w := NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w.Subscribe(m, "greenkeep-ruby")
+	d.Dispatch("greenkeep-ruby", nil)
+	<-started
+
+	// Drain only returns once the running job gave up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Worker_DrainHandsBackBacklog(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+
+	started := make(chan struct{})
+	w := NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w.Concurrency = 1
+	w.Subscribe(m, "greenkeep-ruby")
+	d.Dispatch("greenkeep-ruby", 1)
+	<-started
+	d.Dispatch("greenkeep-ruby", 2)
+	// let the second job reach the backlog of the draining worker
+	time.Sleep(20 * time.Millisecond)
+
+	handled := make(chan Job, 2)
+	NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		handled <- job
+		return nil
+	}).Subscribe(m, "greenkeep-ruby")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case job := <-handled:
+			var n int
+			if err := job.Decode(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				continue
+			}
+			if job.Attempt != 1 {
+				t.Fatalf("Expected the backlog job to keep attempt 1, but got %d", job.Attempt)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the backlog job to be redelivered, but it never was")
+		}
+	}
+}
+
+func Test_Worker_Timeout(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+	d := newTestDispatcher(m)
+	d.MaxAttempts = 1
+
+	w := NewWorker("greenkeep-ruby", func(ctx context.Context, job Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w.Timeout = 10 * time.Millisecond
+	w.Subscribe(m, "greenkeep-ruby")
+	dead := make(chan *transport.Msg, 1)
+	m.Subscribe(DeadLetterSubject, func(msg *transport.Msg) { dead <- msg })
+
+	d.Dispatch("greenkeep-ruby", nil)
+	select {
+	case msg := <-dead:
+		var letter DeadLetter
+		json.Unmarshal(msg.Data, &letter)
+		if !strings.Contains(letter.Error, "timed out") {
+			t.Fatalf("Expected a timeout, but got %q", letter.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the job to time out, but it did not")
+	}
+}
@@ -0,0 +1,223 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+	"golang.org/x/net/context"
+)
+
+// Handler processes a job. Returning an error or panicking fails the
+// attempt, and the job is retried later. Handlers must give up once ctx is
+// done, which happens on timeouts and when the worker is stopped.
+type Handler func(ctx context.Context, job Job) error
+
+// Worker runs handler for jobs of a subject, with at most Concurrency jobs
+// at once. Up to Backlog received jobs wait for a free slot, further jobs
+// are turned down as busy and redelivered by the dispatcher.
+type Worker struct {
+	// Queue is the queue group shared by all replicas of a worker, so every
+	// job is received by one replica only
+	Queue       string
+	Concurrency int
+	Backlog     int
+	// Timeout cancels jobs running longer, if set
+	Timeout time.Duration
+	// Keyring restricts the worker to sealed jobs
+	Keyring *storage.Keyring
+
+	handler Handler
+
+	mu       sync.Mutex
+	t        transport.Transport
+	subject  string
+	sub      transport.Subscription
+	backlog  chan delivery
+	draining bool
+	running  sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type delivery struct {
+	job   Job
+	reply string
+}
+
+func NewWorker(queue string, handler Handler) *Worker {
+	return &Worker{
+		Queue:       queue,
+		Concurrency: 1,
+		Backlog:     16,
+		handler:     handler,
+	}
+}
+
+func respond(t transport.Transport, subject string, r reply) {
+	if subject == "" {
+		return
+	}
+	b, _ := json.Marshal(r)
+	t.Publish(subject, b)
+	t.Flush()
+}
+
+// Subscribe starts receiving jobs published to subject. Jobs are
+// acknowledged once handler returns without error. A worker subscribes to a
+// single subject only.
+func (w *Worker) Subscribe(t transport.Transport, subject string) error {
+	if w.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, but is %d", w.Concurrency)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sub != nil {
+		return fmt.Errorf("worker is already subscribed to %q", w.subject)
+	}
+
+	w.t = t
+	w.subject = subject
+	w.backlog = make(chan delivery, w.Backlog)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for i := 0; i < w.Concurrency; i++ {
+		w.running.Add(1)
+		go func() {
+			defer w.running.Done()
+			for d := range w.backlog {
+				w.process(d)
+			}
+		}()
+	}
+
+	sub, err := t.QueueSubscribe(subject, w.Queue, w.receive)
+	if err != nil {
+		w.cancel()
+		close(w.backlog)
+		return err
+	}
+	w.sub = sub
+	return nil
+}
+
+func (w *Worker) receive(msg *transport.Msg) {
+	var job Job
+	if err := messages.Decode(msg.Data, &job); err != nil {
+		// leave the job to workers which understand it
+		log.Printf("ignoring job on %q: %v\n", w.subject, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.draining {
+		// the dispatcher redelivers to another replica
+		return
+	}
+
+	select {
+	case w.backlog <- delivery{job: job, reply: msg.Reply}:
+		respond(w.t, msg.Reply, reply{JobID: job.JobID, Status: statusReceived})
+	default:
+		respond(w.t, msg.Reply, reply{JobID: job.JobID, Status: statusBusy})
+	}
+}
+
+func (w *Worker) isDraining() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.draining
+}
+
+func (w *Worker) process(d delivery) {
+	job := d.job
+	if w.isDraining() {
+		// handed back like a busy worker, so it keeps its attempt
+		respond(w.t, d.reply, reply{JobID: job.JobID, Status: statusBusy})
+		return
+	}
+
+	ctx := w.ctx
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	err := open(w.Keyring, &job)
+	if err == nil {
+		err = run(ctx, w.handler, job)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("job timed out after %s: %v", w.Timeout, err)
+	}
+	if err != nil {
+		log.Printf("job %s on %q failed: %v\n", job.JobID, w.subject, err)
+		respond(w.t, d.reply, reply{JobID: job.JobID, Status: statusFailed, Error: err.Error()})
+		return
+	}
+	respond(w.t, d.reply, reply{JobID: job.JobID, Status: statusDone})
+}
+
+// Drain stops receiving jobs and waits for running jobs to finish. Jobs still
+// waiting in the backlog are handed back without using up an attempt, so
+// they are redelivered to other replicas. Running jobs are cancelled once ctx is done.
+func (w *Worker) Drain(ctx context.Context) error {
+	w.mu.Lock()
+	if w.sub == nil || w.draining {
+		w.mu.Unlock()
+		return nil
+	}
+	w.draining = true
+	err := w.sub.Unsubscribe()
+	close(w.backlog)
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+	}
+	w.cancel()
+	return err
+}
+
+func open(keyring *storage.Keyring, job *Job) error {
+	if keyring == nil {
+		if job.KeyID != "" {
+			return fmt.Errorf("job is sealed with %q, but no keyring is configured", job.KeyID)
+		}
+		return nil
+	}
+
+	envelope, err := messages.Open(job.Envelope, *keyring)
+	if err != nil {
+		return err
+	}
+	job.Envelope = envelope
+	return nil
+}
+
+// run turns panics of handler into errors
+func run(ctx context.Context, handler Handler, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return handler(ctx, job)
+}
@@ -0,0 +1,15 @@
+package messages
+
+import "github.com/nicolai86/sisyphus/config"
+
+// PluginRun is sent from the scheduler to the subject of a plugin. It
+// carries no credentials, receivers resolve those by repository ID.
+type PluginRun struct {
+	RepositoryID string
+}
+
+// DependencyCheck is sent from the master to greenkeep-<language> workers
+type DependencyCheck struct {
+	Config       config.Entry
+	RepositoryID string
+}
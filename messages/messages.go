@@ -0,0 +1,98 @@
+// Package messages defines the messages exchanged between the scheduler, the
+// master and the language workers.
+//
+// Every message is wrapped in an Envelope carrying the schema version. Decode
+// rejects versions it does not know, so a worker which was not yet updated
+// during a rolling deploy fails loudly instead of misreading a message.
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nicolai86/sisyphus/uuid"
+)
+
+// Version is the schema version of all messages sent by this build.
+// Increment it whenever a payload changes incompatibly.
+const Version = 1
+
+// UnknownVersionError is returned when decoding a message of another version
+type UnknownVersionError struct {
+	Version int
+}
+
+func (e *UnknownVersionError) Error() string {
+	return fmt.Sprintf("unknown message version %d, expected %d", e.Version, Version)
+}
+
+// Envelope wraps the payload of every message
+type Envelope struct {
+	Version int
+	// JobID identifies this message
+	JobID string
+	// CorrelationID is shared by all jobs caused by the same scheduler run
+	CorrelationID string
+	Timestamp     time.Time
+	// KeyID is set if the payload was sealed with a storage key
+	KeyID   string `json:",omitempty"`
+	Payload json.RawMessage
+}
+
+// Versioned is implemented by Envelope and every type embedding it
+type Versioned interface {
+	SchemaVersion() int
+}
+
+func (e Envelope) SchemaVersion() int {
+	return e.Version
+}
+
+// NewEnvelope wraps payload into a new envelope. Without a correlation ID,
+// the envelope starts a new correlation with its own job ID.
+func NewEnvelope(correlationID string, payload interface{}) (Envelope, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	id, err := uuid.New()
+	if err != nil {
+		return Envelope{}, err
+	}
+	if correlationID == "" {
+		correlationID = id
+	}
+
+	return Envelope{
+		Version:       Version,
+		JobID:         id,
+		CorrelationID: correlationID,
+		Timestamp:     time.Now().UTC(),
+		Payload:       b,
+	}, nil
+}
+
+// Decode unmarshals the payload into v
+func (e Envelope) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Encode marshals a message of the current version
+func Encode(v Versioned) ([]byte, error) {
+	if v.SchemaVersion() != Version {
+		return nil, &UnknownVersionError{Version: v.SchemaVersion()}
+	}
+	return json.Marshal(v)
+}
+
+// Decode unmarshals data into v, and rejects messages of unknown versions
+func Decode(data []byte, v Versioned) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if v.SchemaVersion() != Version {
+		return &UnknownVersionError{Version: v.SchemaVersion()}
+	}
+	return nil
+}
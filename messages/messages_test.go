@@ -0,0 +1,81 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nicolai86/sisyphus/config"
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+func Test_Envelope_RoundTrip(t *testing.T) {
+	e, err := NewEnvelope("", DependencyCheck{
+		Config:       config.Entry{Path: "fakes", Language: "ruby"},
+		RepositoryID: "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.CorrelationID != e.JobID {
+		t.Fatalf("Expected a new correlation %q, but got %q", e.JobID, e.CorrelationID)
+	}
+
+	b, err := Encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Envelope
+	if err := Decode(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var check DependencyCheck
+	if err := decoded.Decode(&check); err != nil || check.RepositoryID != "1" || check.Config.Language != "ruby" {
+		t.Fatalf("Expected the dependency check of %q, but got %#v (%v)", "1", check, err)
+	}
+}
+
+func Test_Decode_RejectsUnknownVersions(t *testing.T) {
+	for _, data := range []string{
+		`{"Version": 2, "JobID": "a", "Payload": {}}`,
+		`{"RepositoryID": "1"}`,
+	} {
+		var e Envelope
+		err := Decode([]byte(data), &e)
+		if _, ok := err.(*UnknownVersionError); !ok {
+			t.Fatalf("Expected an UnknownVersionError for %s, but got %v", data, err)
+		}
+	}
+}
+
+func Test_Seal_RoundTrip(t *testing.T) {
+	keyring, err := storage.NewKeyring("a", storage.Key{ID: "a", Secret: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := NewEnvelope("", PluginRun{RepositoryID: "1"})
+
+	sealed, err := Seal(e, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.KeyID != "a" || bytes.Contains(sealed.Payload, []byte(`"1"`)) {
+		t.Fatalf("Expected a sealed payload, but got %s", sealed.Payload)
+	}
+
+	opened, err := Open(sealed, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run PluginRun
+	if err := opened.Decode(&run); err != nil || run.RepositoryID != "1" {
+		t.Fatalf("Expected repository %q, but got %#v (%v)", "1", run, err)
+	}
+
+	sealed.JobID = "another job"
+	if _, err := Open(sealed, keyring); err == nil {
+		t.Fatalf("Expected a payload moved to another job to be rejected")
+	}
+	if _, err := Open(e, keyring); err != ErrNotSealed {
+		t.Fatalf("Expected ErrNotSealed, but got %v", err)
+	}
+}
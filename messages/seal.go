@@ -0,0 +1,81 @@
+package messages
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+// ErrNotSealed is returned by Open for plaintext envelopes when a keyring
+// demands sealed ones
+var ErrNotSealed = errors.New("message is not sealed")
+
+func newAEAD(key storage.Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the payload with the active key of the storage keyring. The
+// job ID is authenticated, so payloads can't be moved between envelopes.
+func Seal(e Envelope, keyring storage.Keyring) (Envelope, error) {
+	if e.KeyID != "" {
+		return e, nil
+	}
+
+	key := keyring.Active()
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return Envelope{}, err
+	}
+
+	sealed, err := json.Marshal(aead.Seal(nonce, nonce, e.Payload, []byte(e.JobID)))
+	if err != nil {
+		return Envelope{}, err
+	}
+	e.KeyID = key.ID
+	e.Payload = sealed
+	return e, nil
+}
+
+// Open decrypts a sealed payload. Plaintext envelopes are rejected, as
+// anyone able to publish could forge them.
+func Open(e Envelope, keyring storage.Keyring) (Envelope, error) {
+	if e.KeyID == "" {
+		return Envelope{}, ErrNotSealed
+	}
+	key, ok := keyring.Get(e.KeyID)
+	if !ok {
+		return Envelope{}, fmt.Errorf("message %s was sealed with unknown key %q", e.JobID, e.KeyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	var sealed []byte
+	if err := json.Unmarshal(e.Payload, &sealed); err != nil || len(sealed) < aead.NonceSize() {
+		return Envelope{}, fmt.Errorf("message %s has a malformed payload", e.JobID)
+	}
+	nonce := sealed[:aead.NonceSize()]
+	payload, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(e.JobID))
+	if err != nil {
+		return Envelope{}, fmt.Errorf("message %s could not be decrypted", e.JobID)
+	}
+
+	e.KeyID = ""
+	e.Payload = payload
+	return e, nil
+}
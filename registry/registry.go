@@ -0,0 +1,233 @@
+// Package registry tracks the plugins served by running workers.
+//
+// Workers announce their plugin with heartbeats, and a Registry considers a
+// plugin live while heartbeats of at least one worker keep arriving. New
+// registries ask all workers to announce themselves right away, so they
+// don't have to wait for the next heartbeat.
+package registry
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/transport"
+	"github.com/nicolai86/sisyphus/uuid"
+)
+
+const (
+	// HeartbeatSubject receives the announcements of all workers
+	HeartbeatSubject = "plugins.heartbeat"
+	// DiscoverSubject asks all workers to announce themselves
+	DiscoverSubject = "plugins.discover"
+
+	// DefaultInterval is the time between two heartbeats of a worker
+	DefaultInterval = 10 * time.Second
+	// DefaultTTL is the time a worker is considered live after a heartbeat
+	DefaultTTL = 3 * DefaultInterval
+)
+
+// discoveryWindow is the time New waits for workers to announce themselves
+var discoveryWindow = time.Second
+
+// Plugin is announced by every worker
+type Plugin struct {
+	// ID identifies the announcing worker
+	ID string
+	// Name is the plugin repositories enable, like greenkeep
+	Name string
+	// Subject receives the jobs of the plugin
+	Subject   string
+	Languages []string `json:",omitempty"`
+	// Leaving is announced by workers shutting down
+	Leaving bool `json:",omitempty"`
+}
+
+// Announcer keeps announcing a plugin until it is closed
+type Announcer struct {
+	t        transport.Transport
+	plugin   Plugin
+	sub      transport.Subscription
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Announce starts sending heartbeats for the plugin every interval
+func Announce(t transport.Transport, p Plugin, interval time.Duration) (*Announcer, error) {
+	id, err := uuid.New()
+	if err != nil {
+		return nil, err
+	}
+	p.ID = id
+
+	a := &Announcer{
+		t:      t,
+		plugin: p,
+		stop:   make(chan struct{}),
+	}
+	a.sub, err = t.Subscribe(DiscoverSubject, func(*transport.Msg) {
+		a.publish(a.plugin)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := a.publish(a.plugin); err != nil {
+		a.sub.Unsubscribe()
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.publish(a.plugin)
+			}
+		}
+	}()
+	return a, nil
+}
+
+func (a *Announcer) publish(p Plugin) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := a.t.Publish(HeartbeatSubject, b); err != nil {
+		return err
+	}
+	return a.t.Flush()
+}
+
+// Close stops the heartbeats and tells registries the worker is gone
+func (a *Announcer) Close() error {
+	a.stopOnce.Do(func() { close(a.stop) })
+	if err := a.sub.Unsubscribe(); err != nil {
+		return err
+	}
+	leaving := a.plugin
+	leaving.Leaving = true
+	return a.publish(leaving)
+}
+
+// Available is a plugin served by at least one live worker
+type Available struct {
+	Name      string
+	Subject   string
+	Languages []string
+	Workers   int
+}
+
+type announcement struct {
+	plugin Plugin
+	seen   time.Time
+}
+
+// Registry collects the announcements of all workers
+type Registry struct {
+	t   transport.Transport
+	ttl time.Duration
+	sub transport.Subscription
+
+	mu      sync.Mutex
+	workers map[string]announcement
+}
+
+// New subscribes to heartbeats and asks all workers to announce themselves.
+// It waits a moment for their announcements, so a new registry knows the
+// live plugins right away.
+func New(t transport.Transport, ttl time.Duration) (*Registry, error) {
+	r := &Registry{
+		t:       t,
+		ttl:     ttl,
+		workers: map[string]announcement{},
+	}
+
+	var err error
+	r.sub, err = t.Subscribe(HeartbeatSubject, r.receive)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Publish(DiscoverSubject, nil); err != nil {
+		r.sub.Unsubscribe()
+		return nil, err
+	}
+	if err := t.Flush(); err != nil {
+		r.sub.Unsubscribe()
+		return nil, err
+	}
+	time.Sleep(discoveryWindow)
+	return r, nil
+}
+
+func (r *Registry) receive(msg *transport.Msg) {
+	var p Plugin
+	if err := json.Unmarshal(msg.Data, &p); err != nil || p.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p.Leaving {
+		delete(r.workers, p.ID)
+		return
+	}
+	r.workers[p.ID] = announcement{plugin: p, seen: time.Now()}
+}
+
+// live returns the announcements seen within the ttl, dropping the others
+func (r *Registry) live() []Plugin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var plugins []Plugin
+	for id, a := range r.workers {
+		if time.Since(a.seen) > r.ttl {
+			delete(r.workers, id)
+			continue
+		}
+		plugins = append(plugins, a.plugin)
+	}
+	return plugins
+}
+
+// Serves reports whether a live worker receives jobs sent to subject
+func (r *Registry) Serves(subject string) bool {
+	for _, p := range r.live() {
+		if p.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// Plugins lists the available plugins, ordered by subject
+func (r *Registry) Plugins() []Available {
+	bySubject := map[string]*Available{}
+	for _, p := range r.live() {
+		a, ok := bySubject[p.Subject]
+		if !ok {
+			a = &Available{Name: p.Name, Subject: p.Subject, Languages: p.Languages}
+			bySubject[p.Subject] = a
+		}
+		a.Workers++
+	}
+
+	available := make([]Available, 0, len(bySubject))
+	for _, a := range bySubject {
+		available = append(available, *a)
+	}
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].Subject < available[j].Subject
+	})
+	return available
+}
+
+// Close stops listening to heartbeats
+func (r *Registry) Close() error {
+	return r.sub.Unsubscribe()
+}
@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/transport"
+)
+
+func init() {
+	discoveryWindow = 50 * time.Millisecond
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected condition to hold within a second, but it did not")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_Registry_DiscoversAnnouncedPlugins(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	ruby, err := Announce(m, Plugin{Name: "greenkeep", Subject: "greenkeep-ruby", Languages: []string{"ruby"}}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer ruby.Close()
+
+	r, err := New(m, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer r.Close()
+
+	if !r.Serves("greenkeep-ruby") {
+		t.Fatalf("Expected greenkeep-ruby to be served, but it was not")
+	}
+	if r.Serves("greenkeep-go") {
+		t.Fatalf("Expected greenkeep-go not to be served, but it was")
+	}
+
+	second, err := Announce(m, Plugin{Name: "greenkeep", Subject: "greenkeep-ruby", Languages: []string{"ruby"}}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer second.Close()
+
+	expected := []Available{
+		{Name: "greenkeep", Subject: "greenkeep-ruby", Languages: []string{"ruby"}, Workers: 2},
+	}
+	waitFor(t, func() bool { return reflect.DeepEqual(r.Plugins(), expected) })
+}
+
+func Test_Registry_DropsLeavingWorkers(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	r, err := New(m, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer r.Close()
+
+	a, err := Announce(m, Plugin{Name: "greenkeep", Subject: "greenkeep-javascript"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	waitFor(t, func() bool { return r.Serves("greenkeep-javascript") })
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	waitFor(t, func() bool { return !r.Serves("greenkeep-javascript") })
+}
+
+func Test_Registry_ExpiresSilentWorkers(t *testing.T) {
+	m := transport.NewMemory()
+	defer m.Close()
+
+	r, err := New(m, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer r.Close()
+
+	a, err := Announce(m, Plugin{Name: "greenkeep", Subject: "greenkeep"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer a.Close()
+	waitFor(t, func() bool { return r.Serves("greenkeep") })
+
+	time.Sleep(40 * time.Millisecond)
+	if r.Serves("greenkeep") {
+		t.Fatalf("Expected greenkeep to expire, but it was still served")
+	}
+}
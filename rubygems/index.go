@@ -0,0 +1,142 @@
+package rubygems
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// DefaultIndexURL is rubygems.org
+const DefaultIndexURL = "https://rubygems.org/"
+
+// ErrUnknownGem is returned for gems the index doesn't know, like private ones
+var ErrUnknownGem = errors.New("unknown gem")
+
+// Index queries a server implementing the rubygems.org versions API, like
+// rubygems.org itself or gemstash
+type Index struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewIndex returns an Index for the server at baseURL
+func NewIndex(baseURL string) *Index {
+	return &Index{BaseURL: baseURL}
+}
+
+type indexVersion struct {
+	Number     string `json:"number"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// Serves reports whether the gems of s come from the index. Only GEM sources
+// whose remotes all point to the index qualify, as other gem servers may
+// publish different gems under the same names.
+func (i *Index) Serves(s Source) bool {
+	if s.Type != "GEM" || len(s.Remotes) == 0 {
+		return false
+	}
+	for _, remote := range s.Remotes {
+		if strings.TrimSuffix(remote, "/") != strings.TrimSuffix(i.BaseURL, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Versions returns the releases of a gem newest first, ignoring prereleases
+func (i *Index) Versions(ctx context.Context, name string) ([]Version, error) {
+	uri := fmt.Sprintf("%sapi/v1/versions/%s.json", strings.TrimSuffix(i.BaseURL, "/")+"/", url.PathEscape(name))
+	resp, err := ctxhttp.Get(ctx, i.Client, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownGem
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch versions of %s: %s", name, resp.Status)
+	}
+
+	var versions []indexVersion
+	if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return nil, fmt.Errorf("Failed to decode versions of %s: %v", name, err)
+	}
+
+	var releases []Version
+	for _, v := range versions {
+		parsed, err := ParseVersion(v.Number)
+		if err != nil || v.Prerelease || parsed.Prerelease() {
+			continue
+		}
+		releases = append(releases, parsed)
+	}
+	if len(releases) == 0 {
+		return nil, ErrUnknownGem
+	}
+	sort.Slice(releases, func(a, b int) bool { return releases[a].Compare(releases[b]) > 0 })
+	return releases, nil
+}
+
+// Latest returns the newest release of a gem, ignoring prereleases
+func (i *Index) Latest(ctx context.Context, name string) (Version, error) {
+	releases, err := i.Versions(ctx, name)
+	if err != nil {
+		return Version{}, err
+	}
+	return releases[0], nil
+}
+
+// Update is a locked gem with a newer release
+type Update struct {
+	Name   string
+	Locked Version
+	Latest Version
+	// Releases are all releases newer than Locked, newest first, for
+	// policies which don't allow Latest
+	Releases []Version
+}
+
+// Outdated compares the gems of the Gemfile with the index. Only gems from
+// sources served by the index are checked; GIT and PATH gems are pinned to
+// their source, gems of other gem servers are left to them, and gems unknown
+// to the index are skipped.
+func (i *Index) Outdated(ctx context.Context, l *Lockfile) ([]Update, error) {
+	var updates []Update
+	for _, d := range l.Dependencies {
+		spec, source, ok := l.Locked(d.Name)
+		if !ok || !i.Serves(source) || d.Pinned {
+			continue
+		}
+		locked, err := ParseVersion(spec.Version)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.Name, err)
+		}
+
+		releases, err := i.Versions(ctx, d.Name)
+		if err == ErrUnknownGem {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var newer []Version
+		for _, release := range releases {
+			if release.Compare(locked) > 0 {
+				newer = append(newer, release)
+			}
+		}
+		if len(newer) > 0 {
+			updates = append(updates, Update{Name: d.Name, Locked: locked, Latest: newer[0], Releases: newer})
+		}
+	}
+	return updates, nil
+}
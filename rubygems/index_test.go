@@ -0,0 +1,109 @@
+package rubygems
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func Test_Index_Outdated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/versions/rake.json":
+			w.Write([]byte(`[{"number":"12.0.0.beta1","prerelease":true},{"number":"11.3.0","prerelease":false},{"number":"10.6.0","prerelease":false},{"number":"10.5.0","prerelease":false}]`))
+		case "/api/v1/versions/turbolinks.json":
+			w.Write([]byte(`[{"number":"5.0.1","prerelease":false},{"number":"2.5.3","prerelease":false}]`))
+		case "/api/v1/versions/mini_portile2.json":
+			w.Write([]byte(`[{"number":"2.1.0","prerelease":false}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	l, err := ParseLockfile(strings.NewReader(strings.Replace(lockfile, "https://rubygems.org/", srv.URL+"/", 1)))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	updates, err := NewIndex(srv.URL).Outdated(context.Background(), l)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []Update{
+		{Name: "rake", Locked: MustParseVersion("10.5.0"), Latest: MustParseVersion("11.3.0"), Releases: []Version{MustParseVersion("11.3.0"), MustParseVersion("10.6.0")}},
+		{Name: "turbolinks", Locked: MustParseVersion("2.5.3"), Latest: MustParseVersion("5.0.1"), Releases: []Version{MustParseVersion("5.0.1")}},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Fatalf("Expected %v, but got %v", expected, updates)
+	}
+}
+
+func Test_Index_Outdated_OtherRemotes(t *testing.T) {
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write([]byte(`[{"number":"99.0.0","prerelease":false}]`))
+	}))
+	defer srv.Close()
+
+	l, err := ParseLockfile(strings.NewReader(`GEM
+  remote: ` + srv.URL + `/
+  specs:
+    rake (10.5.0)
+
+GEM
+  remote: https://gems.example.com/
+  specs:
+    billing (1.0.0)
+
+PLATFORMS
+  ruby
+
+DEPENDENCIES
+  billing
+  rake
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	index := NewIndex(srv.URL)
+	if !index.Serves(l.Sources[0]) || index.Serves(l.Sources[1]) {
+		t.Fatalf("Expected the index to serve only %s, but got %v and %v", srv.URL, index.Serves(l.Sources[0]), index.Serves(l.Sources[1]))
+	}
+	updates, err := index.Outdated(context.Background(), l)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expected := []Update{{Name: "rake", Locked: MustParseVersion("10.5.0"), Latest: MustParseVersion("99.0.0"), Releases: []Version{MustParseVersion("99.0.0")}}}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Fatalf("Expected %v, but got %v", expected, updates)
+	}
+	if !reflect.DeepEqual(requested, []string{"/api/v1/versions/rake.json"}) {
+		t.Fatalf("Expected only rake to be requested, but got %q", requested)
+	}
+}
+
+func Test_Index_Latest_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/versions/private.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	index := NewIndex(srv.URL + "/")
+	if _, err := index.Latest(context.Background(), "private"); err != ErrUnknownGem {
+		t.Fatalf("Expected ErrUnknownGem, but got %v", err)
+	}
+	if _, err := index.Latest(context.Background(), "rake"); err == nil {
+		t.Fatalf("Expected an error, but got none")
+	}
+}
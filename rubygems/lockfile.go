@@ -0,0 +1,165 @@
+package rubygems
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Source is a GEM, GIT or PATH section of a Gemfile.lock
+type Source struct {
+	// Type is GEM, GIT or PATH
+	Type string
+	// Remotes are the gem servers, repositories or directories of the source
+	Remotes []string
+	// Options hold everything else, like revision and branch of GIT sources
+	Options map[string]string
+	Specs   []Spec
+}
+
+// Spec is a locked gem
+type Spec struct {
+	Name    string
+	Version string
+	// Platform is set for platform specific gems, like x86_64-linux
+	Platform     string
+	Dependencies []Dependency
+}
+
+// Dependency is a gem required by a Gemfile or another gem
+type Dependency struct {
+	Name         string
+	Requirements []string
+	// Pinned dependencies come from a GIT or PATH source
+	Pinned bool
+}
+
+// Lockfile is a parsed Gemfile.lock
+type Lockfile struct {
+	Sources      []Source
+	Platforms    []string
+	Dependencies []Dependency
+	RubyVersion  string
+	BundledWith  string
+}
+
+// nameVersion matches lines like "nokogiri (1.6.8-x86_64-linux)", as
+// bundler does
+var nameVersion = regexp.MustCompile(`^(\S+?)(?: \(([^-)]*)(?:-(.*))?\))?(!)?$`)
+
+// ParseLockfile reads a Gemfile.lock. Unknown sections are skipped, as
+// bundler adds new ones from time to time.
+func ParseLockfile(r io.Reader) (*Lockfile, error) {
+	l := &Lockfile{}
+	var (
+		section string
+		source  *Source
+		spec    *Spec
+	)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		content := strings.TrimSpace(line)
+		if indent == 0 {
+			section, source, spec = content, nil, nil
+			switch section {
+			case "GEM", "GIT", "PATH":
+				l.Sources = append(l.Sources, Source{Type: section, Options: map[string]string{}})
+				source = &l.Sources[len(l.Sources)-1]
+			}
+			continue
+		}
+
+		switch {
+		case source != nil && indent == 2:
+			key, value := splitOption(content)
+			switch key {
+			case "remote":
+				source.Remotes = append(source.Remotes, value)
+			case "specs":
+			default:
+				source.Options[key] = value
+			}
+		case source != nil && indent == 4:
+			m := nameVersion.FindStringSubmatch(content)
+			if m == nil || m[2] == "" {
+				return nil, fmt.Errorf("line %d: malformed spec %q", n, content)
+			}
+			source.Specs = append(source.Specs, Spec{Name: m[1], Version: m[2], Platform: m[3]})
+			spec = &source.Specs[len(source.Specs)-1]
+		case source != nil && indent == 6:
+			if spec == nil {
+				return nil, fmt.Errorf("line %d: dependency %q outside of a spec", n, content)
+			}
+			d, err := parseDependency(content)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			spec.Dependencies = append(spec.Dependencies, d)
+		case section == "PLATFORMS":
+			l.Platforms = append(l.Platforms, content)
+		case section == "DEPENDENCIES":
+			d, err := parseDependency(content)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			l.Dependencies = append(l.Dependencies, d)
+		case section == "RUBY VERSION":
+			l.RubyVersion = content
+		case section == "BUNDLED WITH":
+			l.BundledWith = content
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func splitOption(s string) (string, string) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// parseDependency reads lines like "rake (>= 10.0, < 12)" or "rails!"
+func parseDependency(s string) (Dependency, error) {
+	name := s
+	var requirements string
+	if i := strings.Index(s, " ("); i >= 0 {
+		if !strings.HasSuffix(strings.TrimSuffix(s, "!"), ")") {
+			return Dependency{}, fmt.Errorf("malformed dependency %q", s)
+		}
+		name, requirements = s[:i], strings.TrimSuffix(strings.TrimSuffix(s, "!"), ")")[i+2:]
+	}
+
+	d := Dependency{Name: strings.TrimSuffix(name, "!"), Pinned: strings.HasSuffix(s, "!")}
+	if requirements != "" {
+		for _, r := range strings.Split(requirements, ",") {
+			d.Requirements = append(d.Requirements, strings.TrimSpace(r))
+		}
+	}
+	return d, nil
+}
+
+// Locked returns the spec locked for name, and its source
+func (l *Lockfile) Locked(name string) (Spec, Source, bool) {
+	for _, source := range l.Sources {
+		for _, spec := range source.Specs {
+			if spec.Name == name {
+				return spec, source, true
+			}
+		}
+	}
+	return Spec{}, Source{}, false
+}
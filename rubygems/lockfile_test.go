@@ -0,0 +1,95 @@
+package rubygems
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const lockfile = `GIT
+  remote: https://github.com/rails/rails.git
+  revision: 2c3a5b0a13be4c9b6bde1f5bba1d1f5a2c5e7b0e
+  branch: 3-2-stable
+  specs:
+    rails (3.2.22.5)
+      railties (= 3.2.22.5)
+
+PATH
+  remote: gems/dealertool
+  specs:
+    dealertool (0.1.0)
+
+GEM
+  remote: https://rubygems.org/
+  specs:
+    mini_portile2 (2.1.0)
+    nokogiri (1.6.8-x86_64-linux)
+      mini_portile2 (~> 2.1.0)
+    rake (10.5.0)
+    turbolinks (2.5.3)
+      coffee-rails
+
+PLATFORMS
+  ruby
+  x86_64-linux
+
+DEPENDENCIES
+  dealertool!
+  nokogiri
+  rails!
+  rake (>= 10.0, < 12)
+  turbolinks (~> 2.3)
+
+RUBY VERSION
+   ruby 2.3.1p112
+
+BUNDLED WITH
+   1.13.6
+`
+
+func Test_ParseLockfile(t *testing.T) {
+	l, err := ParseLockfile(strings.NewReader(lockfile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(l.Sources) != 3 {
+		t.Fatalf("Expected 3 sources, but got %d", len(l.Sources))
+	}
+	git := l.Sources[0]
+	if git.Type != "GIT" || git.Options["branch"] != "3-2-stable" || !reflect.DeepEqual(git.Remotes, []string{"https://github.com/rails/rails.git"}) {
+		t.Fatalf("Expected the rails GIT source, but got %#v", git)
+	}
+
+	spec, source, ok := l.Locked("nokogiri")
+	expected := Spec{Name: "nokogiri", Version: "1.6.8", Platform: "x86_64-linux", Dependencies: []Dependency{
+		{Name: "mini_portile2", Requirements: []string{"~> 2.1.0"}},
+	}}
+	if !ok || source.Type != "GEM" || !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Expected %#v from GEM, but got %#v from %q", expected, spec, source.Type)
+	}
+
+	if !reflect.DeepEqual(l.Platforms, []string{"ruby", "x86_64-linux"}) {
+		t.Fatalf("Expected ruby and x86_64-linux, but got %q", l.Platforms)
+	}
+	dependencies := []Dependency{
+		{Name: "dealertool", Pinned: true},
+		{Name: "nokogiri"},
+		{Name: "rails", Pinned: true},
+		{Name: "rake", Requirements: []string{">= 10.0", "< 12"}},
+		{Name: "turbolinks", Requirements: []string{"~> 2.3"}},
+	}
+	if !reflect.DeepEqual(l.Dependencies, dependencies) {
+		t.Fatalf("Expected %#v, but got %#v", dependencies, l.Dependencies)
+	}
+	if l.RubyVersion != "ruby 2.3.1p112" || l.BundledWith != "1.13.6" {
+		t.Fatalf("Expected ruby 2.3.1p112 bundled with 1.13.6, but got %q and %q", l.RubyVersion, l.BundledWith)
+	}
+}
+
+func Test_ParseLockfile_Malformed(t *testing.T) {
+	_, err := ParseLockfile(strings.NewReader("GEM\n  specs:\n    rake\n"))
+	if err == nil || err.Error() != `line 3: malformed spec "rake"` {
+		t.Fatalf("Expected a malformed spec error, but got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package rubygems
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var constraintPattern = regexp.MustCompile(`^\s*(=|!=|>=|<=|>|<|~>)?\s*(\S+)\s*$`)
+
+// Constraint is a single operator and version, like ~> 2.1
+type Constraint struct {
+	// Operator is one of =, !=, >, <, >=, <= and ~>
+	Operator string
+	Version  Version
+	// implicit is set for versions written without operator
+	implicit bool
+}
+
+// ParseConstraint reads a constraint, versions without operator mean =
+func ParseConstraint(s string) (Constraint, error) {
+	m := constraintPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Constraint{}, fmt.Errorf("illformed requirement %q", s)
+	}
+	v, err := ParseVersion(m[2])
+	if err != nil {
+		return Constraint{}, fmt.Errorf("illformed requirement %q", s)
+	}
+	if m[1] == "" {
+		return Constraint{Operator: "=", Version: v, implicit: true}, nil
+	}
+	return Constraint{Operator: m[1], Version: v}, nil
+}
+
+func (c Constraint) String() string {
+	if c.implicit {
+		return c.Version.String()
+	}
+	return c.Operator + " " + c.Version.String()
+}
+
+// Allows reports whether v satisfies c
+func (c Constraint) Allows(v Version) bool {
+	cmp := v.Compare(c.Version)
+	switch c.Operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "~>":
+		return cmp >= 0 && v.Release().Compare(c.Version.Bump()) < 0
+	}
+	return false
+}
+
+// Requirement is the list of constraints of a gem statement, all of which
+// have to be satisfied. An empty requirement allows every version.
+type Requirement []Constraint
+
+// ParseRequirement reads the constraints of a gem statement, like
+// []string{">= 1.0", "< 3"}
+func ParseRequirement(constraints []string) (Requirement, error) {
+	var r Requirement
+	for _, s := range constraints {
+		// a single string may hold several constraints, like ">= 1.0, < 3"
+		for _, part := range strings.Split(s, ",") {
+			c, err := ParseConstraint(part)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, c)
+		}
+	}
+	return r, nil
+}
+
+// Allows reports whether v satisfies all constraints of r
+func (r Requirement) Allows(v Version) bool {
+	for _, c := range r {
+		if !c.Allows(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Strings returns the constraints as written to a Gemfile
+func (r Requirement) Strings() []string {
+	s := make([]string, len(r))
+	for i, c := range r {
+		s[i] = c.String()
+	}
+	return s
+}
+
+// Pin replaces r with the latest version
+func (r Requirement) Pin(latest Version) Requirement {
+	return Requirement{{Operator: "=", Version: latest, implicit: true}}
+}
+
+// Bump moves every constraint of r to the latest version, keeping its
+// operator and precision: ~> 2.1 becomes ~> 3.0, >= 1.2.0 becomes >= 1.5.6
+func (r Requirement) Bump(latest Version) Requirement {
+	var bumped Requirement
+	for _, c := range r {
+		switch c.Operator {
+		case "~>":
+			c.Version = latest.Truncate(c.Version.Segments())
+		case "<":
+			c.Version = latest.Next(c.Version.Segments())
+		case ">":
+			c.Operator, c.Version = ">=", latest
+		case "!=":
+		default:
+			c.Version = latest
+		}
+		bumped = append(bumped, c)
+	}
+	return r.checked(bumped, latest)
+}
+
+// Widen keeps the lower bounds of r, raising its upper bounds just enough to
+// allow the latest version: ~> 2.1 becomes >= 2.1, < 4 for 3.0.1
+func (r Requirement) Widen(latest Version) Requirement {
+	var widened Requirement
+	for _, c := range r {
+		switch c.Operator {
+		case "~>":
+			widened = append(widened,
+				Constraint{Operator: ">=", Version: c.Version},
+				Constraint{Operator: "<", Version: latest.Truncate(c.Version.Segments()).Bump()},
+			)
+		case "=":
+			widened = append(widened,
+				Constraint{Operator: ">=", Version: c.Version},
+				Constraint{Operator: "<=", Version: latest},
+			)
+		case "<":
+			c.Version = latest.Next(c.Version.Segments())
+			widened = append(widened, c)
+		case "<=":
+			c.Version = latest
+			widened = append(widened, c)
+		default:
+			widened = append(widened, c)
+		}
+	}
+	return r.checked(widened, latest)
+}
+
+// checked falls back to pinning if updated still excludes latest, like
+// != constraints excluding it
+func (r Requirement) checked(updated Requirement, latest Version) Requirement {
+	if len(updated) == 0 || !updated.Allows(latest) {
+		return r.Pin(latest)
+	}
+	return updated
+}
@@ -0,0 +1,81 @@
+package rubygems
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Requirement_Allows(t *testing.T) {
+	cases := []struct {
+		constraints []string
+		version     string
+		expected    bool
+	}{
+		{nil, "5.0.1", true},
+		{[]string{"~> 2.1"}, "2.9", true},
+		{[]string{"~> 2.1"}, "3.0", false},
+		{[]string{"~> 3.1.1"}, "3.1.9", true},
+		{[]string{"~> 3.1.1"}, "3.2.0", false},
+		{[]string{">= 1.2.0"}, "1.5.6", true},
+		{[]string{"<= 2.7.2"}, "2.7.4", false},
+		{[]string{"0.1.6"}, "0.1.6", true},
+		{[]string{">= 1.0", "< 3"}, "3.0.0", false},
+		{[]string{">= 1.0, < 3"}, "2.9", true},
+		{[]string{"!= 2.0"}, "2.0.0", false},
+		{[]string{"~> 2.0"}, "3.0.0.rc1", false},
+	}
+	for _, c := range cases {
+		r, err := ParseRequirement(c.constraints)
+		if err != nil {
+			t.Fatalf("Expected no error for %q, but got %v", c.constraints, err)
+		}
+		if actual := r.Allows(MustParseVersion(c.version)); actual != c.expected {
+			t.Fatalf("Expected %q to allow %s: %v, but got %v", c.constraints, c.version, c.expected, actual)
+		}
+	}
+}
+
+func Test_Requirement_Updates(t *testing.T) {
+	cases := []struct {
+		constraints []string
+		latest      string
+		pin         []string
+		bump        []string
+		widen       []string
+	}{
+		{[]string{"~> 2.3"}, "5.0.1", []string{"5.0.1"}, []string{"~> 5.0"}, []string{">= 2.3", "< 6"}},
+		{[]string{"~> 3.1.1"}, "3.3.7", []string{"3.3.7"}, []string{"~> 3.3.7"}, []string{">= 3.1.1", "< 3.4"}},
+		{[]string{">= 1.2.0", "<= 2.7.2"}, "2.7.4", []string{"2.7.4"}, []string{">= 2.7.4", "<= 2.7.4"}, []string{">= 1.2.0", "<= 2.7.4"}},
+		{[]string{"< 0.4"}, "0.4.4", []string{"0.4.4"}, []string{"< 0.5"}, []string{"< 0.5"}},
+		{[]string{"0.1.6"}, "0.2.3", []string{"0.2.3"}, []string{"0.2.3"}, []string{">= 0.1.6", "<= 0.2.3"}},
+		{[]string{"!= 2.0.1"}, "2.0.1", []string{"2.0.1"}, []string{"2.0.1"}, []string{"2.0.1"}},
+	}
+	for _, c := range cases {
+		r, err := ParseRequirement(c.constraints)
+		if err != nil {
+			t.Fatalf("Expected no error for %q, but got %v", c.constraints, err)
+		}
+		latest := MustParseVersion(c.latest)
+		for strategy, expected := range map[string][]string{
+			"pin":   c.pin,
+			"bump":  c.bump,
+			"widen": c.widen,
+		} {
+			var updated Requirement
+			switch strategy {
+			case "pin":
+				updated = r.Pin(latest)
+			case "bump":
+				updated = r.Bump(latest)
+			case "widen":
+				updated = r.Widen(latest)
+			}
+			if !reflect.DeepEqual(updated.Strings(), expected) {
+				t.Fatalf("Expected %s of %q to %s to be %q, but got %q", strategy, c.constraints, c.latest, expected, updated.Strings())
+			}
+			if !updated.Allows(latest) {
+				t.Fatalf("Expected %s of %q to allow %s, but it did not", strategy, c.constraints, c.latest)
+			}
+		}
+	}
+}
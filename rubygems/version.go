@@ -0,0 +1,169 @@
+// Package rubygems implements the version semantics of rubygems, as used by
+// Gem::Version and Gem::Requirement.
+package rubygems
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9a-zA-Z]+)*(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// segmentPattern splits 1.0.a10 into 1, 0, a and 10
+var segmentPattern = regexp.MustCompile(`[0-9]+|[a-zA-Z]+`)
+
+// Version is a version like 1.2.0 or 2.0.0.rc1
+type Version struct {
+	original string
+	segments []segment
+}
+
+// segment is either numeric, or a string marking a prerelease
+type segment struct {
+	number int
+	str    string
+}
+
+func (s segment) numeric() bool {
+	return s.str == ""
+}
+
+func (s segment) String() string {
+	if s.numeric() {
+		return strconv.Itoa(s.number)
+	}
+	return s.str
+}
+
+// ParseVersion reads a version. Like rubygems, 1.0-rc1 is read as 1.0.pre.rc1.
+func ParseVersion(s string) (Version, error) {
+	s = strings.TrimSpace(s)
+	if !versionPattern.MatchString(s) {
+		return Version{}, fmt.Errorf("malformed version number string %q", s)
+	}
+
+	v := Version{original: s}
+	for _, part := range segmentPattern.FindAllString(strings.Replace(s, "-", ".pre.", -1), -1) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			v.segments = append(v.segments, segment{str: part})
+			continue
+		}
+		v.segments = append(v.segments, segment{number: n})
+	}
+	return v, nil
+}
+
+// MustParseVersion is ParseVersion for versions known to be valid
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v Version) String() string {
+	if v.original != "" {
+		return v.original
+	}
+	parts := make([]string, len(v.segments))
+	for i, s := range v.segments {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ".")
+}
+
+// Prerelease reports whether v contains letters, like 2.0.0.rc1
+func (v Version) Prerelease() bool {
+	for _, s := range v.segments {
+		if !s.numeric() {
+			return true
+		}
+	}
+	return false
+}
+
+// Release drops the prerelease parts of v, 2.0.0.rc1 becomes 2.0.0
+func (v Version) Release() Version {
+	var segments []segment
+	for _, s := range v.segments {
+		if !s.numeric() {
+			break
+		}
+		segments = append(segments, s)
+	}
+	return Version{segments: segments}
+}
+
+// Bump returns the upper bound of ~> v: 1.2.3 becomes 1.3, 1.2 becomes 2
+func (v Version) Bump() Version {
+	segments := append([]segment{}, v.Release().segments...)
+	if len(segments) > 1 {
+		segments = segments[:len(segments)-1]
+	}
+	segments[len(segments)-1].number++
+	return Version{segments: segments}
+}
+
+// Segments returns the number of segments of v
+func (v Version) Segments() int {
+	return len(v.segments)
+}
+
+// Truncate keeps the first n segments of v, padding it with zeros
+func (v Version) Truncate(n int) Version {
+	segments := append([]segment{}, v.Release().segments...)
+	for len(segments) < n {
+		segments = append(segments, segment{})
+	}
+	return Version{segments: segments[:n]}
+}
+
+// Next increments the last of the first n segments of v: 0.4.4 becomes 0.5
+// for n = 2
+func (v Version) Next(n int) Version {
+	next := v.Truncate(n)
+	next.segments[n-1].number++
+	return next
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal or greater than o.
+// Missing segments count as zero, and prereleases are lower than releases.
+func (v Version) Compare(o Version) int {
+	n := len(v.segments)
+	if len(o.segments) > n {
+		n = len(o.segments)
+	}
+	for i := 0; i < n; i++ {
+		a, b := segment{}, segment{}
+		if i < len(v.segments) {
+			a = v.segments[i]
+		}
+		if i < len(o.segments) {
+			b = o.segments[i]
+		}
+		switch {
+		case a.numeric() && b.numeric():
+			if a.number != b.number {
+				return compareInts(a.number, b.number)
+			}
+		case a.numeric():
+			return 1
+		case b.numeric():
+			return -1
+		case a.str != b.str:
+			return strings.Compare(a.str, b.str)
+		}
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,45 @@
+package rubygems
+
+import "testing"
+
+func Test_Version_Compare(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0.0", 0},
+		{"1.2.10", "1.2.9", 1},
+		{"2.0.0.rc1", "2.0.0", -1},
+		{"2.0.0.rc1", "2.0.0.beta2", 1},
+		{"1.0.a10", "1.0.a9", 1},
+		{"1.0-rc1", "1.0.pre.rc1", 0},
+		{"0.4", "0.4.4", -1},
+	}
+	for _, c := range cases {
+		if actual := MustParseVersion(c.a).Compare(MustParseVersion(c.b)); actual != c.expected {
+			t.Fatalf("Expected %s <=> %s to be %d, but got %d", c.a, c.b, c.expected, actual)
+		}
+	}
+}
+
+func Test_Version_Bump(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3":     "1.3",
+		"1.2":       "2",
+		"5":         "6",
+		"2.0.0.rc1": "2.1",
+	}
+	for version, expected := range cases {
+		if actual := MustParseVersion(version).Bump().String(); actual != expected {
+			t.Fatalf("Expected %s to bump to %s, but got %s", version, expected, actual)
+		}
+	}
+}
+
+func Test_ParseVersion_Malformed(t *testing.T) {
+	for _, s := range []string{"", "a.b", "1..2", "1.2 beta"} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Fatalf("Expected %q to be malformed, but it was not", s)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package schedule decides when plugins run for a repository.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Spec describes when a plugin runs. Exactly one of Cron or Interval must be
+// set; runs are further restricted to the optional daily window. Cron
+// expressions and windows are evaluated in Timezone, which defaults to UTC.
+type Spec struct {
+	Cron     string  `json:"cron,omitempty"`
+	Interval string  `json:"interval,omitempty"`
+	Window   *Window `json:"window,omitempty"`
+	Timezone string  `json:"timezone,omitempty"`
+}
+
+// Window is a daily time window of HH:MM clock times. A window with
+// End before Start wraps around midnight.
+type Window struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Parse turns user input into a spec: durations like 6h become intervals,
+// everything else is treated as cron expression.
+func Parse(expr string) (Spec, error) {
+	expr = strings.TrimSpace(expr)
+	var spec Spec
+	if _, err := time.ParseDuration(expr); err == nil {
+		spec.Interval = expr
+	} else {
+		spec.Cron = expr
+	}
+	return spec, spec.Validate()
+}
+
+// String returns the cron expression or interval
+func (s Spec) String() string {
+	if s.Cron != "" {
+		return s.Cron
+	}
+	return s.Interval
+}
+
+func (s Spec) Validate() error {
+	if (s.Cron == "") == (s.Interval == "") {
+		return errors.New("schedule needs either a cron expression or an interval")
+	}
+	if s.Cron != "" {
+		if _, err := parseCron(s.Cron); err != nil {
+			return err
+		}
+	}
+	if s.Interval != "" {
+		d, err := time.ParseDuration(s.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %v", s.Interval, err)
+		}
+		if d < time.Minute {
+			return fmt.Errorf("interval %q must be at least one minute", s.Interval)
+		}
+	}
+	if _, err := s.location(); err != nil {
+		return err
+	}
+	if s.Window != nil {
+		if _, _, err := s.Window.bounds(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Spec) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+	return loc, nil
+}
+
+// Next returns the time of the run following last. A plugin which never ran
+// is due right away for intervals, and at the next match for cron
+// expressions. Results before now mean the run is overdue.
+func (s Spec) Next(last, now time.Time) (time.Time, error) {
+	if err := s.Validate(); err != nil {
+		return time.Time{}, err
+	}
+	loc, _ := s.location()
+
+	var next time.Time
+	if s.Interval != "" {
+		d, _ := time.ParseDuration(s.Interval)
+		next = now
+		if !last.IsZero() {
+			next = last.Add(d)
+		}
+	} else {
+		cron, _ := parseCron(s.Cron)
+		base := now
+		if !last.IsZero() {
+			base = last
+		}
+		if next = cron.next(base.In(loc)); next.IsZero() {
+			return next, fmt.Errorf("cron expression %q never matches", s.Cron)
+		}
+	}
+
+	if s.Window != nil {
+		next = s.Window.adjust(next.In(loc))
+	}
+	return next, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window time %q, expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w Window) bounds() (time.Duration, time.Duration, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("window %s-%s is empty", w.Start, w.End)
+	}
+	return start, end, nil
+}
+
+func (w Window) contains(clock, start, end time.Duration) bool {
+	if start < end {
+		return clock >= start && clock < end
+	}
+	return clock >= start || clock < end
+}
+
+// adjust moves t forward to the next start of the window unless it's inside already
+func (w Window) adjust(t time.Time) time.Time {
+	start, end, err := w.bounds()
+	if err != nil {
+		return t
+	}
+
+	// wall clock times, as days around DST transitions have 23 or 25 hours
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.contains(clock, start, end) {
+		return t
+	}
+
+	hour, minute := int(start/time.Hour), int(start%time.Hour/time.Minute)
+	next := time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, t.Location())
+	if next.Before(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, hour, minute, 0, 0, t.Location())
+	}
+	return next
+}
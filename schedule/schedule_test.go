@@ -0,0 +1,91 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, value string) time.Time {
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func Test_Spec_Next(t *testing.T) {
+	now := mustParse(t, "2016-08-15T10:30:00Z") // a monday
+
+	cases := []struct {
+		spec     Spec
+		last     string
+		expected string
+	}{
+		{Spec{Interval: "6h"}, "", "2016-08-15T10:30:00Z"},
+		{Spec{Interval: "6h"}, "2016-08-15T08:00:00Z", "2016-08-15T14:00:00Z"},
+		{Spec{Cron: "0 3 * * *"}, "", "2016-08-16T03:00:00Z"},
+		{Spec{Cron: "*/15 * * * *"}, "2016-08-15T10:14:00Z", "2016-08-15T10:15:00Z"},
+		{Spec{Cron: "0 9 * * 1-5"}, "2016-08-12T09:00:00Z", "2016-08-15T09:00:00Z"},
+		{Spec{Cron: "0 0 1 * 0"}, "2016-08-15T00:00:00Z", "2016-08-21T00:00:00Z"},
+		{Spec{Cron: "0 3 * * *", Timezone: "Europe/Berlin"}, "", "2016-08-16T01:00:00Z"},
+		{Spec{Interval: "1h", Window: &Window{Start: "22:00", End: "06:00"}}, "", "2016-08-15T22:00:00Z"},
+		{Spec{Interval: "1h", Window: &Window{Start: "22:00", End: "06:00"}}, "2016-08-15T04:00:00Z", "2016-08-15T05:00:00Z"},
+		{Spec{Interval: "1h", Window: &Window{Start: "09:00", End: "17:00"}}, "2016-08-15T16:30:00Z", "2016-08-16T09:00:00Z"},
+	}
+
+	for _, c := range cases {
+		var last time.Time
+		if c.last != "" {
+			last = mustParse(t, c.last)
+		}
+		next, err := c.spec.Next(last, now)
+		if err != nil {
+			t.Fatalf("%#v: %v", c.spec, err)
+		}
+		if expected := mustParse(t, c.expected); !next.Equal(expected) {
+			t.Errorf("%#v after %q: expected %s, but got %s", c.spec, c.last, expected, next.UTC())
+		}
+	}
+}
+
+func Test_Spec_Next_WindowAcrossDST(t *testing.T) {
+	cases := []struct {
+		now      string
+		expected string
+	}{
+		// clocks in Berlin skip from 02:00 to 03:00 on 2016-03-27
+		{"2016-03-27T05:00:00Z", "2016-03-27T07:00:00Z"},
+		// and go back from 03:00 to 02:00 on 2016-10-30
+		{"2016-10-30T06:00:00Z", "2016-10-30T08:00:00Z"},
+	}
+	spec := Spec{Interval: "1h", Timezone: "Europe/Berlin", Window: &Window{Start: "09:00", End: "17:00"}}
+	for _, c := range cases {
+		next, err := spec.Next(time.Time{}, mustParse(t, c.now))
+		if err != nil {
+			t.Fatalf("%#v: %v", spec, err)
+		}
+		if expected := mustParse(t, c.expected); !next.Equal(expected) {
+			t.Errorf("after %s: expected %s, but got %s", c.now, expected, next.UTC())
+		}
+	}
+}
+
+func Test_Spec_Validate(t *testing.T) {
+	invalid := []Spec{
+		{},
+		{Cron: "* * * *"},
+		{Cron: "60 * * * *"},
+		{Cron: "*/0 * * * *"},
+		{Interval: "soon"},
+		{Interval: "10s"},
+		{Interval: "1h", Cron: "* * * * *"},
+		{Interval: "1h", Timezone: "Mars/Olympus"},
+		{Interval: "1h", Window: &Window{Start: "25:00", End: "06:00"}},
+	}
+
+	for _, spec := range invalid {
+		if err := spec.Validate(); err == nil {
+			t.Errorf("Expected %#v to be invalid", spec)
+		}
+	}
+}
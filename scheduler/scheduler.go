@@ -0,0 +1,130 @@
+// Package scheduler dispatches the plugins enabled for repositories once
+// their schedules are due.
+package scheduler
+
+import (
+	"log"
+	"time"
+
+	"github.com/nicolai86/sisyphus/jobs"
+	"github.com/nicolai86/sisyphus/messages"
+	"github.com/nicolai86/sisyphus/registry"
+	"github.com/nicolai86/sisyphus/schedule"
+	"github.com/nicolai86/sisyphus/storage"
+	"github.com/nicolai86/sisyphus/transport"
+)
+
+// Scheduler keeps the schedule of all repositories. Several schedulers may
+// share a storage, but only the leader among them should Dispatch.
+type Scheduler struct {
+	repos storage.RepositoryStore
+	// states persists runs, nil if the storage doesn't
+	states     storage.ScheduleStateStore
+	dispatcher *jobs.Dispatcher
+	plugins    *registry.Registry
+	table      *table
+	// waiting holds the plugins held back for a live worker
+	waiting map[string]bool
+}
+
+// New loads the schedule of all repositories. Without persisted states every
+// plugin runs right away.
+func New(repos storage.RepositoryStore, dispatcher *jobs.Dispatcher, plugins *registry.Registry, fallback schedule.Spec) (*Scheduler, error) {
+	s := &Scheduler{
+		repos:      repos,
+		dispatcher: dispatcher,
+		plugins:    plugins,
+		waiting:    map[string]bool{},
+	}
+	if states, ok := repos.(storage.ScheduleStateStore); ok {
+		s.states = states
+	} else {
+		log.Printf("%T does not persist schedule states\n", repos)
+	}
+
+	all, states, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.table = newTable(all, states, fallback, time.Now())
+	return s, nil
+}
+
+func (s *Scheduler) load() ([]storage.Repository, []storage.ScheduleState, error) {
+	repos, err := s.repos.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.states == nil {
+		return repos, nil, nil
+	}
+
+	states, err := s.states.LoadScheduleStates()
+	return repos, states, err
+}
+
+// Reload replaces the schedule, as another scheduler may have run plugins
+// while leading
+func (s *Scheduler) Reload(now time.Time) error {
+	repos, states, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.table.reset(repos, states, now)
+	return nil
+}
+
+// Subscribe keeps the schedule up to date with every repository the frontend
+// enables, disables or edits
+func (s *Scheduler) Subscribe(t transport.Transport) (transport.Subscription, error) {
+	return t.Subscribe("toggle-repository", func(msg *transport.Msg) {
+		s.Toggle(string(msg.Data), time.Now())
+	})
+}
+
+// Toggle reschedules a repository, or unschedules it once it's gone
+func (s *Scheduler) Toggle(id string, now time.Time) {
+	repo, err := s.repos.Get(id)
+	if err == storage.ErrNotFound {
+		log.Printf("unscheduling %s\n", id)
+		s.table.remove(id)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load %s: %q\n", id, err)
+		return
+	}
+
+	log.Printf("rescheduling %s with %q\n", id, repo.Plugins)
+	s.table.update(repo, now)
+}
+
+// Dispatch runs the plugins due at now. Plugins without live workers stay due
+// until one shows up.
+func (s *Scheduler) Dispatch(now time.Time) {
+	for _, e := range s.table.due(now) {
+		key := e.repo.ID + ":" + e.plugin
+		if !s.plugins.Serves(e.plugin) {
+			if !s.waiting[key] {
+				log.Printf("no live worker for %q, holding back %s\n", e.plugin, e.repo.ID)
+			}
+			s.waiting[key] = true
+			continue
+		}
+		delete(s.waiting, key)
+
+		id, err := s.dispatcher.Dispatch(e.plugin, messages.PluginRun{RepositoryID: e.repo.ID})
+		if err != nil {
+			log.Printf("Failed to schedule %q for %s: %q\n", e.plugin, e.repo.ID, err)
+			continue
+		}
+		log.Printf("scheduled %q for %s as job %s\n", e.plugin, e.repo.ID, id)
+
+		state := s.table.ran(e, now)
+		if s.states != nil {
+			if err := s.states.StoreScheduleState(state); err != nil {
+				log.Printf("Failed to persist schedule of %s: %q\n", e.repo.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nicolai86/sisyphus/schedule"
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+// entry is a single plugin scheduled for a repository
+type entry struct {
+	repo    storage.Repository
+	plugin  string
+	spec    schedule.Spec
+	lastRun time.Time
+	nextRun time.Time
+}
+
+type entryKey struct {
+	repositoryID string
+	plugin       string
+}
+
+// table is the in-memory schedule of all repositories with enabled plugins.
+// It's loaded once and then kept up to date incrementally.
+type table struct {
+	mu       sync.Mutex
+	fallback schedule.Spec
+	entries  map[entryKey]*entry
+	// lastRuns holds persisted runs of entries which are not scheduled (yet)
+	lastRuns map[entryKey]time.Time
+}
+
+func newTable(repos []storage.Repository, states []storage.ScheduleState, fallback schedule.Spec, now time.Time) *table {
+	t := &table{
+		fallback: fallback,
+	}
+	t.reset(repos, states, now)
+	return t
+}
+
+// reset replaces all entries and runs, e.g. after another instance was scheduling
+func (t *table) reset(repos []storage.Repository, states []storage.ScheduleState, now time.Time) {
+	t.mu.Lock()
+	t.entries = make(map[entryKey]*entry)
+	t.lastRuns = make(map[entryKey]time.Time)
+	for _, state := range states {
+		t.lastRuns[entryKey{state.RepositoryID, state.Plugin}] = state.LastRun
+	}
+	t.mu.Unlock()
+
+	for _, repo := range repos {
+		t.update(repo, now)
+	}
+}
+
+func (t *table) nextRun(e *entry, now time.Time) time.Time {
+	next, err := e.spec.Next(e.lastRun, now)
+	if err != nil {
+		log.Printf("invalid schedule %q of %q for %s, using %q: %v\n", e.spec, e.plugin, e.repo.ID, t.fallback, err)
+		e.spec = t.fallback
+		next, _ = e.spec.Next(e.lastRun, now)
+	}
+	return next
+}
+
+// update adds or replaces all entries of the repository. Runs of plugins which
+// stay enabled are kept, so editing a repository doesn't trigger extra runs.
+func (t *table) update(repo storage.Repository, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(repo.ID)
+	for _, plugin := range repo.Plugins {
+		key := entryKey{repo.ID, plugin}
+		e := &entry{
+			repo:    repo,
+			plugin:  plugin,
+			spec:    repo.Schedule(plugin, t.fallback),
+			lastRun: t.lastRuns[key],
+		}
+		e.nextRun = t.nextRun(e, now)
+		t.entries[key] = e
+	}
+}
+
+func (t *table) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(id)
+}
+
+func (t *table) removeLocked(id string) {
+	for key, e := range t.entries {
+		if key.repositoryID == id {
+			t.lastRuns[key] = e.lastRun
+			delete(t.entries, key)
+		}
+	}
+}
+
+// due returns copies of all entries whose next run is not after now
+func (t *table) due(now time.Time) []entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var due []entry
+	for _, e := range t.entries {
+		if !e.nextRun.After(now) {
+			due = append(due, *e)
+		}
+	}
+	return due
+}
+
+// ran records a run and returns the state to persist
+func (t *table) ran(e entry, at time.Time) storage.ScheduleState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := entryKey{e.repo.ID, e.plugin}
+	t.lastRuns[key] = at
+	if current, ok := t.entries[key]; ok {
+		current.lastRun = at
+		current.nextRun = t.nextRun(current, at)
+		e = *current
+	}
+
+	return storage.ScheduleState{
+		RepositoryID: e.repo.ID,
+		Plugin:       e.plugin,
+		LastRun:      at,
+		NextRun:      e.nextRun,
+	}
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicolai86/sisyphus/schedule"
+	"github.com/nicolai86/sisyphus/storage"
+)
+
+var hourly = schedule.Spec{Interval: "1h"}
+
+// dueKeys returns the repositories and plugins due at now
+func dueKeys(tbl *table, now time.Time) map[entryKey]bool {
+	keys := map[entryKey]bool{}
+	for _, e := range tbl.due(now) {
+		keys[entryKey{e.repo.ID, e.plugin}] = true
+	}
+	return keys
+}
+
+func expectDue(t *testing.T, tbl *table, now time.Time, expected ...entryKey) {
+	due := dueKeys(tbl, now)
+	if len(due) != len(expected) {
+		t.Fatalf("Expected %v to be due, but got %v", expected, due)
+	}
+	for _, key := range expected {
+		if !due[key] {
+			t.Fatalf("Expected %v to be due, but got %v", expected, due)
+		}
+	}
+}
+
+func Test_Table_Add(t *testing.T) {
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	tbl := newTable(
+		[]storage.Repository{{ID: "a", Plugins: []string{"ruby"}}},
+		[]storage.ScheduleState{{RepositoryID: "a", Plugin: "ruby", LastRun: now.Add(-30 * time.Minute)}},
+		hourly, now,
+	)
+	expectDue(t, tbl, now)
+
+	// a new repository never ran and is due right away
+	tbl.update(storage.Repository{ID: "b", Plugins: []string{"ruby"}}, now)
+	expectDue(t, tbl, now, entryKey{"b", "ruby"})
+
+	expectDue(t, tbl, now.Add(30*time.Minute), entryKey{"a", "ruby"}, entryKey{"b", "ruby"})
+}
+
+func Test_Table_Toggle(t *testing.T) {
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	tbl := newTable(
+		[]storage.Repository{{ID: "a", Plugins: []string{"ruby"}}},
+		[]storage.ScheduleState{{RepositoryID: "a", Plugin: "ruby", LastRun: now.Add(-30 * time.Minute)}},
+		hourly, now,
+	)
+
+	// enabling another plugin keeps the run of the existing one
+	tbl.update(storage.Repository{ID: "a", Plugins: []string{"ruby", "javascript"}}, now)
+	expectDue(t, tbl, now, entryKey{"a", "javascript"})
+
+	// disabled plugins are no longer due
+	tbl.update(storage.Repository{ID: "a", Plugins: []string{"javascript"}}, now)
+	expectDue(t, tbl, now.Add(time.Hour), entryKey{"a", "javascript"})
+
+	// and continue their schedule when enabled again
+	tbl.update(storage.Repository{ID: "a", Plugins: []string{"ruby", "javascript"}}, now)
+	expectDue(t, tbl, now, entryKey{"a", "javascript"})
+
+	// schedule edits apply to the next run
+	tbl.update(storage.Repository{
+		ID:        "a",
+		Plugins:   []string{"ruby"},
+		Schedules: map[string]schedule.Spec{"ruby": {Interval: "10m"}},
+	}, now)
+	expectDue(t, tbl, now, entryKey{"a", "ruby"})
+}
+
+func Test_Table_Remove(t *testing.T) {
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	tbl := newTable([]storage.Repository{
+		{ID: "a", Plugins: []string{"ruby"}},
+		{ID: "b", Plugins: []string{"ruby", "javascript"}},
+	}, nil, hourly, now)
+	expectDue(t, tbl, now, entryKey{"a", "ruby"}, entryKey{"b", "ruby"}, entryKey{"b", "javascript"})
+
+	tbl.remove("b")
+	expectDue(t, tbl, now, entryKey{"a", "ruby"})
+
+	tbl.remove("unknown")
+	expectDue(t, tbl, now, entryKey{"a", "ruby"})
+}
+
+func Test_Table_Ran(t *testing.T) {
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	tbl := newTable([]storage.Repository{{ID: "a", Plugins: []string{"ruby"}}}, nil, hourly, now)
+
+	due := tbl.due(now)
+	if len(due) != 1 {
+		t.Fatalf("Expected one due entry, but got %d", len(due))
+	}
+	state := tbl.ran(due[0], now)
+	if !state.LastRun.Equal(now) || !state.NextRun.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected a run at %v and the next at %v, but got %#v", now, now.Add(time.Hour), state)
+	}
+	expectDue(t, tbl, now.Add(59*time.Minute))
+	expectDue(t, tbl, now.Add(time.Hour), entryKey{"a", "ruby"})
+}
@@ -18,6 +18,8 @@ go build -o bin/repository-scheduler ./cmd/repository-scheduler
 go build -o bin/greenkeepr-master ./cmd/greenkeepr-master/main.go
 go build -o bin/greenkeepr-javascript ./cmd/greenkeepr-javascript/main.go
 go build -o bin/greenkeepr-ruby ./cmd/greenkeepr-ruby/*.go
+go build -o bin/sisyphus-keys ./cmd/sisyphus-keys
+go build -o bin/sisyphus ./cmd/sisyphus
 
 for binary in $(find bin/ -type f); do
   chmod +x $binary
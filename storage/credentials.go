@@ -0,0 +1,40 @@
+package storage
+
+// Credentials are everything needed to act on behalf of a repository
+type Credentials struct {
+	ID          string
+	FullName    string
+	AccessToken string
+	// DefaultBranch is empty for repositories stored before it was detected
+	DefaultBranch string
+}
+
+// CredentialProvider resolves the credentials of a repository, so messages
+// only need to carry the repository ID
+type CredentialProvider interface {
+	Credentials(repositoryID string) (Credentials, error)
+}
+
+// StoredCredentials reads credentials from a repository store
+type StoredCredentials struct {
+	finder RepositoryFinder
+}
+
+func NewStoredCredentials(finder RepositoryFinder) StoredCredentials {
+	return StoredCredentials{finder: finder}
+}
+
+// Credentials returns ErrNotFound for unknown or disabled repositories
+func (s StoredCredentials) Credentials(repositoryID string) (Credentials, error) {
+	r, err := s.finder.Get(repositoryID)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{
+		ID:            r.ID,
+		FullName:      r.FullName,
+		AccessToken:   r.AccessToken,
+		DefaultBranch: r.DefaultBranch,
+	}, nil
+}
@@ -4,75 +4,351 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 )
 
+const (
+	// formatGCM is the version byte of records sealed with AES-GCM. Records
+	// written before versioning was introduced are unauthenticated AES-CFB and
+	// carry no version byte at all.
+	formatGCM byte = 1
+	// formatKeyring records are sealed with AES-GCM and name the key they were
+	// sealed with: version, key id length, key id, nonce, ciphertext.
+	formatKeyring byte = 2
+)
+
+var (
+	// ErrMalformedRecord is returned for records which are not even well-formed ciphertext
+	ErrMalformedRecord = errors.New("malformed encrypted record")
+	// ErrDecryptionFailed is returned if a record was tampered with or encrypted with another key
+	ErrDecryptionFailed = errors.New("decryption failed, wrong key or tampered record")
+	// ErrUnknownKey is returned if a record was encrypted with a key missing from the keyring
+	ErrUnknownKey = errors.New("record was encrypted with a key missing from the keyring")
+)
+
+// DecryptionError wraps ErrMalformedRecord or ErrDecryptionFailed with the
+// affected repository
+type DecryptionError struct {
+	RepositoryID string
+	Err          error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("unable to decrypt repository %q: %v", e.RepositoryID, e.Err)
+}
+
+// AESStorage encrypts repositories before handing them to the backing store.
+// The encrypted repository is stored in the AccessToken field; ID, FullName,
+// Plugins and Schedules stay readable so backends can index them.
 type AESStorage struct {
-	encryptionKey string
-	backingStore  RepositoryReaderWriter
+	keyring      Keyring
+	backingStore RepositoryStore
 }
 
-func NewAESStorage(key string, backingStore RepositoryReaderWriter) AESStorage {
+func NewAESStorage(keyring Keyring, backingStore RepositoryStore) AESStorage {
 	return AESStorage{
-		encryptionKey: key,
-		backingStore:  backingStore,
+		keyring:      keyring,
+		backingStore: backingStore,
 	}
 }
 
+func newAEAD(key Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Store always writes the current format with the active key, which upgrades
+// legacy records and records of rotated keys
 func (f AESStorage) Store(r Repository) error {
-	// either 16, 24, or 32 bytes
-	block, err := aes.NewCipher([]byte(f.encryptionKey))
+	key := f.keyring.Active()
+	aead, err := newAEAD(key)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%#v\n", f.encryptionKey)
-	var buf = &bytes.Buffer{}
-	json.NewEncoder(buf).Encode(r)
+	plaintext, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
 
-	encrypted := make([]byte, aes.BlockSize+buf.Len())
-	iv := encrypted[:aes.BlockSize]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
 
-	encrypter := cipher.NewCFBEncrypter(block, iv)
-	encrypter.XORKeyStream(encrypted[aes.BlockSize:], buf.Bytes())
+	// the repository ID is authenticated so records can't be swapped
+	sealed := append([]byte{formatKeyring, byte(len(key.ID))}, key.ID...)
+	sealed = append(sealed, nonce...)
+	sealed = aead.Seal(sealed, nonce, plaintext, []byte(r.ID))
 
 	return f.backingStore.Store(Repository{
 		ID:          r.ID,
-		AccessToken: base64.StdEncoding.EncodeToString(encrypted),
+		FullName:    r.FullName,
+		AccessToken: base64.StdEncoding.EncodeToString(sealed),
 		Plugins:     r.Plugins,
+		Schedules:   r.Schedules,
 	})
 }
 
-func (f AESStorage) Load() ([]Repository, error) {
-	repos, err := f.backingStore.Load()
+func (f AESStorage) decrypt(repo Repository) (Repository, error) {
+	decoded, err := base64.StdEncoding.DecodeString(repo.AccessToken)
+	if err != nil || len(decoded) == 0 {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+	}
+
+	if decoded[0] == formatKeyring {
+		return f.decryptKeyring(repo, decoded)
+	}
+
+	// records without key id are tried with every key
+	for _, key := range f.keyring.Keys() {
+		r, err := f.decryptGCM(repo, key, decoded)
+		if err == nil {
+			return r, nil
+		}
+		if derr, ok := err.(*DecryptionError); !ok || derr.Err != ErrDecryptionFailed {
+			return Repository{}, err
+		}
+	}
+
+	return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrDecryptionFailed}
+}
+
+func (f AESStorage) decryptKeyring(repo Repository, decoded []byte) (Repository, error) {
+	if len(decoded) < 2 || len(decoded) < 2+int(decoded[1]) {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+	}
+	id := string(decoded[2 : 2+int(decoded[1])])
+	sealed := decoded[2+int(decoded[1]):]
+
+	key, ok := f.keyring.Get(id)
+	if !ok {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrUnknownKey}
+	}
+	aead, err := newAEAD(key)
 	if err != nil {
-		return nil, err
+		return Repository{}, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(repo.ID))
+	if err != nil {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrDecryptionFailed}
+	}
+
+	var r Repository
+	if err := json.Unmarshal(plaintext, &r); err != nil {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+	}
+	return r, nil
+}
+
+// decryptGCM reads records of the first, single key GCM format
+func (f AESStorage) decryptGCM(repo Repository, key Key, decoded []byte) (Repository, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Repository{}, err
 	}
 
-	fmt.Printf("%#v\n", f.encryptionKey)
+	if decoded[0] == formatGCM && len(decoded) >= 1+aead.NonceSize()+aead.Overhead() {
+		nonce := decoded[1 : 1+aead.NonceSize()]
+		plaintext, err := aead.Open(nil, nonce, decoded[1+aead.NonceSize():], []byte(repo.ID))
+		if err == nil {
+			var r Repository
+			if err := json.Unmarshal(plaintext, &r); err != nil {
+				return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+			}
+			return r, nil
+		}
+		// a legacy IV may start with the version byte by chance, so fall through
+	}
+
+	return f.decryptLegacy(repo, key, decoded)
+}
+
+// decryptLegacy reads records written with AES-CFB. CFB is unauthenticated, so
+// a record is only accepted if it decrypts into the repository it belongs to.
+func (f AESStorage) decryptLegacy(repo Repository, key Key, decoded []byte) (Repository, error) {
+	if len(decoded) < aes.BlockSize {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrMalformedRecord}
+	}
+
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return Repository{}, err
+	}
+
+	iv := decoded[:aes.BlockSize]
+	encrypted := decoded[aes.BlockSize:]
+	decrypter := cipher.NewCFBDecrypter(block, iv)
+
+	decrypted := make([]byte, len(encrypted))
+	decrypter.XORKeyStream(decrypted, encrypted)
+
+	var r Repository
+	if err := json.NewDecoder(bytes.NewBuffer(decrypted)).Decode(&r); err != nil || r.ID != repo.ID {
+		return Repository{}, &DecryptionError{RepositoryID: repo.ID, Err: ErrDecryptionFailed}
+	}
+
+	return r, nil
+}
+
+func (f AESStorage) decryptAll(repos []Repository) ([]Repository, error) {
 	for i, repo := range repos {
-		block, err := aes.NewCipher([]byte(f.encryptionKey))
+		r, err := f.decrypt(repo)
 		if err != nil {
 			return nil, err
 		}
+		repos[i] = r
+	}
 
-		decoded, _ := base64.StdEncoding.DecodeString(repo.AccessToken)
-		encrypted := decoded
-		iv := encrypted[:aes.BlockSize]
+	return repos, nil
+}
 
-		encrypted = encrypted[aes.BlockSize:]
-		decrypter := cipher.NewCFBDecrypter(block, iv)
+func (f AESStorage) Load() ([]Repository, error) {
+	repos, err := f.backingStore.Load()
+	if err != nil {
+		return nil, err
+	}
 
-		decrypted := make([]byte, len(encrypted))
-		decrypter.XORKeyStream(decrypted, encrypted)
+	return f.decryptAll(repos)
+}
 
-		var r Repository
-		fmt.Printf("%v\n", string(decrypted))
-		json.NewDecoder(bytes.NewBuffer(decrypted)).Decode(&r)
-		repos[i] = r
+func (f AESStorage) Get(id string) (Repository, error) {
+	repo, err := f.backingStore.Get(id)
+	if err != nil {
+		return Repository{}, err
 	}
 
-	return repos, nil
+	return f.decrypt(repo)
+}
+
+// GetByFullName falls back to decrypting every repository for records
+// written before the full name was stored unencrypted.
+func (f AESStorage) GetByFullName(fullName string) (Repository, error) {
+	repo, err := f.backingStore.GetByFullName(fullName)
+	if err == nil {
+		return f.decrypt(repo)
+	}
+	if err != ErrNotFound {
+		return Repository{}, err
+	}
+
+	repos, err := f.Load()
+	if err != nil {
+		return Repository{}, err
+	}
+	for _, repo := range repos {
+		if repo.FullName == fullName {
+			return repo, nil
+		}
+	}
+
+	return Repository{}, ErrNotFound
+}
+
+func (f AESStorage) ListByPlugin(plugin string) ([]Repository, error) {
+	repos, err := f.backingStore.ListByPlugin(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.decryptAll(repos)
+}
+
+// LoadScheduleStates is passed through, schedule states contain no secrets
+func (f AESStorage) LoadScheduleStates() ([]ScheduleState, error) {
+	states, ok := f.backingStore.(ScheduleStateStore)
+	if !ok {
+		return nil, fmt.Errorf("%T does not store schedule states", f.backingStore)
+	}
+	return states.LoadScheduleStates()
+}
+
+func (f AESStorage) LoadScheduleState(repositoryID, plugin string) (ScheduleState, error) {
+	states, ok := f.backingStore.(ScheduleStateStore)
+	if !ok {
+		return ScheduleState{}, fmt.Errorf("%T does not store schedule states", f.backingStore)
+	}
+	return states.LoadScheduleState(repositoryID, plugin)
+}
+
+func (f AESStorage) StoreScheduleState(state ScheduleState) error {
+	states, ok := f.backingStore.(ScheduleStateStore)
+	if !ok {
+		return fmt.Errorf("%T does not store schedule states", f.backingStore)
+	}
+	return states.StoreScheduleState(state)
+}
+
+// LoadCheckState is passed through, check states contain no secrets
+func (f AESStorage) LoadCheckState(repositoryID, entry string) (CheckState, error) {
+	checks, ok := f.backingStore.(CheckStateStore)
+	if !ok {
+		return CheckState{}, fmt.Errorf("%T does not store check states", f.backingStore)
+	}
+	return checks.LoadCheckState(repositoryID, entry)
+}
+
+func (f AESStorage) StoreCheckState(state CheckState) error {
+	checks, ok := f.backingStore.(CheckStateStore)
+	if !ok {
+		return fmt.Errorf("%T does not store check states", f.backingStore)
+	}
+	return checks.StoreCheckState(state)
+}
+
+// StorePendingJob is passed through, payloads hold no access tokens and are
+// sealed by the dispatcher if needed
+func (f AESStorage) StorePendingJob(job PendingJob) error {
+	queue, ok := f.backingStore.(JobQueueStore)
+	if !ok {
+		return fmt.Errorf("%T does not store pending jobs", f.backingStore)
+	}
+	return queue.StorePendingJob(job)
+}
+
+func (f AESStorage) DeletePendingJob(queueName, id string) error {
+	queue, ok := f.backingStore.(JobQueueStore)
+	if !ok {
+		return fmt.Errorf("%T does not store pending jobs", f.backingStore)
+	}
+	return queue.DeletePendingJob(queueName, id)
+}
+
+func (f AESStorage) LoadPendingJobs(queueName string) ([]PendingJob, error) {
+	queue, ok := f.backingStore.(JobQueueStore)
+	if !ok {
+		return nil, fmt.Errorf("%T does not store pending jobs", f.backingStore)
+	}
+	return queue.LoadPendingJobs(queueName)
+}
+
+// StoreRunEvent is passed through, run events contain no secrets
+func (f AESStorage) StoreRunEvent(event RunEvent) error {
+	history, ok := f.backingStore.(RunHistoryStore)
+	if !ok {
+		return fmt.Errorf("%T does not store run events", f.backingStore)
+	}
+	return history.StoreRunEvent(event)
+}
+
+func (f AESStorage) LoadRunEvents(repositoryID string, since time.Time) ([]RunEvent, error) {
+	history, ok := f.backingStore.(RunHistoryStore)
+	if !ok {
+		return nil, fmt.Errorf("%T does not store run events", f.backingStore)
+	}
+	return history.LoadRunEvents(repositoryID, since)
 }
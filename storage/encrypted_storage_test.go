@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func newTestKeyring(t *testing.T, active string, keys ...Key) Keyring {
+	keyring, err := NewKeyring(active, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func singleKeyring(t *testing.T, secret string) Keyring {
+	return newTestKeyring(t, "default", Key{ID: "default", Secret: []byte(secret)})
+}
+
+func newTestFileStorage(t *testing.T) (FileStorage, func()) {
+	dir, err := ioutil.TempDir("", "sisyphus-aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStorage(dir), func() { os.RemoveAll(dir) }
+}
+
+// storeLegacy writes a record the way AESStorage did before records were versioned
+func storeLegacy(t *testing.T, backend RepositoryStore, r Repository) {
+	block, err := aes.NewCipher([]byte(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf = &bytes.Buffer{}
+	json.NewEncoder(buf).Encode(r)
+
+	encrypted := make([]byte, aes.BlockSize+buf.Len())
+	iv := encrypted[:aes.BlockSize]
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted[aes.BlockSize:], buf.Bytes())
+
+	if err := backend.Store(Repository{
+		ID:          r.ID,
+		AccessToken: base64.StdEncoding.EncodeToString(encrypted),
+		Plugins:     r.Plugins,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectDecryptionError(t *testing.T, err, expected error) {
+	derr, ok := err.(*DecryptionError)
+	if !ok {
+		t.Fatalf("Expected a *DecryptionError, but got %#v", err)
+	}
+	if derr.Err != expected {
+		t.Fatalf("Expected %q, but got %q", expected, derr.Err)
+	}
+}
+
+func Test_AESStorage_RoundTrip(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	s := NewAESStorage(singleKeyring(t, testKey), backend)
+	repo := Repository{ID: "1", FullName: "nicolai86/sisyphus", AccessToken: "secret", Plugins: []string{"greenkeep"}}
+	if err := s.Store(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := backend.Get("1")
+	if raw.AccessToken == "secret" || raw.AccessToken == "" {
+		t.Fatalf("Expected the access token to be encrypted, but got %q", raw.AccessToken)
+	}
+
+	loaded, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, repo) {
+		t.Fatalf("Expected %#v, but got %#v", repo, loaded)
+	}
+}
+
+func Test_AESStorage_Tampered(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	s := NewAESStorage(singleKeyring(t, testKey), backend)
+	if err := s.Store(Repository{ID: "1", AccessToken: "secret", Plugins: []string{"greenkeep"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := backend.Get("1")
+	sealed, _ := base64.StdEncoding.DecodeString(raw.AccessToken)
+	sealed[len(sealed)-1] ^= 0xff
+	raw.AccessToken = base64.StdEncoding.EncodeToString(sealed)
+	backend.Store(raw)
+
+	_, err := s.Get("1")
+	expectDecryptionError(t, err, ErrDecryptionFailed)
+
+	raw.AccessToken = "not base64!"
+	backend.Store(raw)
+
+	_, err = s.Get("1")
+	expectDecryptionError(t, err, ErrMalformedRecord)
+}
+
+func Test_AESStorage_WrongKey(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	if err := NewAESStorage(singleKeyring(t, testKey), backend).Store(Repository{ID: "1", AccessToken: "secret", Plugins: []string{"greenkeep"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewAESStorage(singleKeyring(t, "fedcba9876543210fedcba9876543210"), backend).Get("1")
+	expectDecryptionError(t, err, ErrDecryptionFailed)
+}
+
+func Test_AESStorage_UpgradesLegacyRecords(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	repo := Repository{ID: "1", FullName: "nicolai86/sisyphus", AccessToken: "secret", Plugins: []string{"greenkeep"}}
+	storeLegacy(t, backend, repo)
+
+	s := NewAESStorage(singleKeyring(t, testKey), backend)
+	loaded, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, repo) {
+		t.Fatalf("Expected %#v, but got %#v", repo, loaded)
+	}
+
+	if err := s.Store(loaded); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := backend.Get("1")
+	sealed, _ := base64.StdEncoding.DecodeString(raw.AccessToken)
+	if sealed[0] != formatKeyring {
+		t.Fatalf("Expected the record to be rewritten as version %d, but got %d", formatKeyring, sealed[0])
+	}
+	if loaded, err := s.Get("1"); err != nil || !reflect.DeepEqual(loaded, repo) {
+		t.Fatalf("Expected %#v, but got %#v (%v)", repo, loaded, err)
+	}
+}
+
+func Test_AESStorage_KeyRotation(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	oldKey := Key{ID: "2016-08", Secret: []byte(testKey)}
+	newKey := Key{ID: "2016-09", Secret: []byte("fedcba9876543210")}
+	repo := Repository{ID: "1", AccessToken: "secret", Plugins: []string{"greenkeep"}}
+
+	if err := NewAESStorage(newTestKeyring(t, oldKey.ID, oldKey), backend).Store(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := NewAESStorage(newTestKeyring(t, newKey.ID, oldKey, newKey), backend)
+	loaded, err := rotated.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotated.Store(loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAESStorage(newTestKeyring(t, newKey.ID, newKey), backend).Get("1"); err != nil {
+		t.Fatalf("Expected the record to be readable with the new key only, but got %q", err)
+	}
+	_, err = NewAESStorage(newTestKeyring(t, oldKey.ID, oldKey), backend).Get("1")
+	expectDecryptionError(t, err, ErrUnknownKey)
+}
+
+func Test_AESStorage_LoadScheduleState(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testScheduleStateStore(t, NewAESStorage(singleKeyring(t, testKey), backend))
+}
+
+func Test_AESStorage_CheckState(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testCheckStateStore(t, NewAESStorage(singleKeyring(t, testKey), backend))
+}
+
+func Test_AESStorage_JobQueue(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testJobQueueStore(t, NewAESStorage(singleKeyring(t, testKey), backend))
+}
@@ -2,12 +2,19 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// errStopWalk ends a walk early without reporting an error
+var errStopWalk = errors.New("stop walk")
+
 type FileStorage struct {
 	DataDirectory string
 }
@@ -18,40 +25,112 @@ func NewFileStorage(dataDirectory string) FileStorage {
 	}
 }
 
+func (f FileStorage) path(id string) string {
+	return fmt.Sprintf("%s/%s.json", f.DataDirectory, id)
+}
+
 func (f FileStorage) Store(r Repository) error {
 	if len(r.Plugins) == 0 {
-		return os.Remove(fmt.Sprintf("%s/%s.json", f.DataDirectory, r.ID))
+		return os.Remove(f.path(r.ID))
 	}
 
 	file, err := os.OpenFile(
-		fmt.Sprintf("%s/%s.json", f.DataDirectory, r.ID),
+		f.path(r.ID),
 		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
 		0600,
 	)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	return json.NewEncoder(file).Encode(r)
 }
 
-func (f FileStorage) Load() ([]Repository, error) {
-	var repos []Repository
+func (f FileStorage) read(path string) (Repository, error) {
+	var repo Repository
+
+	file, err := os.Open(path)
+	if err != nil {
+		return repo, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&repo)
+	return repo, err
+}
 
+// walk calls fn for every stored repository until fn returns an error
+func (f FileStorage) walk(fn func(Repository) error) error {
 	err := filepath.Walk(f.DataDirectory, func(path string, info os.FileInfo, _ error) error {
 		if info.IsDir() && path != f.DataDirectory {
 			return filepath.SkipDir
 		}
 
 		if strings.HasSuffix(path, ".json") {
-			file, err := os.Open(path)
+			repo, err := f.read(path)
 			if err != nil {
 				return err
 			}
-			var repo Repository
-			if err := json.NewDecoder(file).Decode(&repo); err != nil {
-				return err
-			}
+			return fn(repo)
+		}
+		return nil
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func (f FileStorage) Load() ([]Repository, error) {
+	var repos []Repository
+
+	err := f.walk(func(repo Repository) error {
+		repos = append(repos, repo)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// Get reads a single repository file
+func (f FileStorage) Get(id string) (Repository, error) {
+	repo, err := f.read(f.path(id))
+	if os.IsNotExist(err) {
+		return Repository{}, ErrNotFound
+	}
+	return repo, err
+}
+
+// GetByFullName stops at the first repository matching fullName
+func (f FileStorage) GetByFullName(fullName string) (Repository, error) {
+	var found *Repository
+
+	err := f.walk(func(repo Repository) error {
+		if repo.FullName == fullName {
+			found = &repo
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return Repository{}, err
+	}
+	if found == nil {
+		return Repository{}, ErrNotFound
+	}
+
+	return *found, nil
+}
+
+func (f FileStorage) ListByPlugin(plugin string) ([]Repository, error) {
+	var repos []Repository
+
+	err := f.walk(func(repo Repository) error {
+		if repo.HasPlugin(plugin) {
 			repos = append(repos, repo)
 		}
 		return nil
@@ -62,3 +141,210 @@ func (f FileStorage) Load() ([]Repository, error) {
 
 	return repos, nil
 }
+
+func (f FileStorage) scheduleDirectory() string {
+	return fmt.Sprintf("%s/schedules", f.DataDirectory)
+}
+
+// LoadScheduleStates reads all states from the schedules directory
+func (f FileStorage) LoadScheduleStates() ([]ScheduleState, error) {
+	infos, err := ioutil.ReadDir(f.scheduleDirectory())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var states []ScheduleState
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		bs, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", f.scheduleDirectory(), info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var state ScheduleState
+		if err := json.Unmarshal(bs, &state); err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+func (f FileStorage) scheduleStatePath(repositoryID, plugin string) string {
+	return fmt.Sprintf("%s/%s.%s.json", f.scheduleDirectory(), repositoryID, url.QueryEscape(plugin))
+}
+
+// LoadScheduleState reads the file of a single repository and plugin
+func (f FileStorage) LoadScheduleState(repositoryID, plugin string) (ScheduleState, error) {
+	var state ScheduleState
+	bs, err := ioutil.ReadFile(f.scheduleStatePath(repositoryID, plugin))
+	if os.IsNotExist(err) {
+		return state, ErrNotFound
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(bs, &state)
+	return state, err
+}
+
+// StoreScheduleState writes one file per repository and plugin
+func (f FileStorage) StoreScheduleState(state ScheduleState) error {
+	if err := os.MkdirAll(f.scheduleDirectory(), 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.scheduleStatePath(state.RepositoryID, state.Plugin), bs, 0600)
+}
+
+func (f FileStorage) checkStatePath(repositoryID, entry string) string {
+	return fmt.Sprintf("%s/checks/%s.%s.json", f.DataDirectory, repositoryID, url.QueryEscape(entry))
+}
+
+// LoadCheckState reads the file of a single repository and entry
+func (f FileStorage) LoadCheckState(repositoryID, entry string) (CheckState, error) {
+	var state CheckState
+	bs, err := ioutil.ReadFile(f.checkStatePath(repositoryID, entry))
+	if os.IsNotExist(err) {
+		return state, ErrNotFound
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(bs, &state)
+	return state, err
+}
+
+// StoreCheckState writes one file per repository and entry
+func (f FileStorage) StoreCheckState(state CheckState) error {
+	if err := os.MkdirAll(fmt.Sprintf("%s/checks", f.DataDirectory), 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.checkStatePath(state.RepositoryID, state.Entry), bs, 0600)
+}
+
+func (f FileStorage) jobDirectory(queue string) string {
+	return fmt.Sprintf("%s/jobs/%s", f.DataDirectory, url.QueryEscape(queue))
+}
+
+// StorePendingJob writes one file per job
+func (f FileStorage) StorePendingJob(job PendingJob) error {
+	if err := os.MkdirAll(f.jobDirectory(job.Queue), 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fmt.Sprintf("%s/%s.json", f.jobDirectory(job.Queue), job.ID), bs, 0600)
+}
+
+func (f FileStorage) DeletePendingJob(queue, id string) error {
+	err := os.Remove(fmt.Sprintf("%s/%s.json", f.jobDirectory(queue), id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LoadPendingJobs reads all jobs of the queue directory
+func (f FileStorage) LoadPendingJobs(queue string) ([]PendingJob, error) {
+	infos, err := ioutil.ReadDir(f.jobDirectory(queue))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []PendingJob
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		bs, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", f.jobDirectory(queue), info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var job PendingJob
+		if err := json.Unmarshal(bs, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (f FileStorage) runDirectory() string {
+	return fmt.Sprintf("%s/runs", f.DataDirectory)
+}
+
+// StoreRunEvent appends the event to a file per repository, one JSON document
+// per line
+func (f FileStorage) StoreRunEvent(event RunEvent) error {
+	if err := os.MkdirAll(f.runDirectory(), 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fmt.Sprintf("%s/%s.jsonl", f.runDirectory(), event.RepositoryID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(bs, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f FileStorage) LoadRunEvents(repositoryID string, since time.Time) ([]RunEvent, error) {
+	file, err := os.Open(fmt.Sprintf("%s/%s.jsonl", f.runDirectory(), repositoryID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []RunEvent
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var event RunEvent
+		if err := decoder.Decode(&event); err != nil {
+			return nil, err
+		}
+		if !event.Time.Before(since) {
+			events = append(events, event)
+		}
+	}
+
+	sortRunEvents(events)
+	return events, nil
+}
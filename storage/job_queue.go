@@ -0,0 +1,26 @@
+package storage
+
+import "encoding/json"
+
+// PendingJob is a job which was dispatched, but neither acknowledged nor
+// dead-lettered yet
+type PendingJob struct {
+	// Queue separates the jobs of dispatchers sharing a store
+	Queue   string
+	ID      string
+	Subject string
+	// Attempt is the number of the attempt running, starting at 1
+	Attempt int
+	// Job is the encoded job, including its payload
+	Job json.RawMessage
+}
+
+// JobQueueStore persists PendingJobs, so jobs survive restarts of their
+// dispatcher
+type JobQueueStore interface {
+	// StorePendingJob adds or replaces a job
+	StorePendingJob(PendingJob) error
+	// DeletePendingJob removes a finished job, missing jobs are ignored
+	DeletePendingJob(queue, id string) error
+	LoadPendingJobs(queue string) ([]PendingJob, error)
+}
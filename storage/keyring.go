@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key is a single AES key of a Keyring
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring holds all keys AESStorage can decrypt with. New records are always
+// encrypted with the active key.
+type Keyring struct {
+	keys   []Key
+	active string
+}
+
+// NewKeyring validates all keys; active must be the ID of one of them
+func NewKeyring(active string, keys ...Key) (Keyring, error) {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || len(key.ID) > 255 {
+			return Keyring{}, fmt.Errorf("invalid key id %q", key.ID)
+		}
+		if seen[key.ID] {
+			return Keyring{}, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		if l := len(key.Secret); l != 16 && l != 24 && l != 32 {
+			return Keyring{}, fmt.Errorf("key %q must be 16, 24 or 32 bytes, but is %d", key.ID, l)
+		}
+		seen[key.ID] = true
+	}
+	if !seen[active] {
+		return Keyring{}, fmt.Errorf("active key %q is not part of the keyring", active)
+	}
+
+	return Keyring{
+		keys:   keys,
+		active: active,
+	}, nil
+}
+
+// Active returns the key used for writes
+func (k Keyring) Active() Key {
+	key, _ := k.Get(k.active)
+	return key
+}
+
+// Get returns the key with the given ID
+func (k Keyring) Get(id string) (Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Keys returns all keys, starting with the active one
+func (k Keyring) Keys() []Key {
+	keys := []Key{k.Active()}
+	for _, key := range k.keys {
+		if key.ID != k.active {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// DeriveKey derives a 32 byte key from a passphrase using scrypt
+func DeriveKey(passphrase, salt string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), []byte(salt), 1<<15, 8, 1, 32)
+}
+
+type keyringFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID         string `json:"id"`
+		Key        string `json:"key,omitempty"`
+		Passphrase string `json:"passphrase,omitempty"`
+		Salt       string `json:"salt,omitempty"`
+	} `json:"keys"`
+}
+
+// LoadKeyring reads a keyring file:
+//
+//	{
+//	  "active": "2016-09",
+//	  "keys": [
+//	    {"id": "2016-08", "key": "a raw key of 16, 24 or 32 bytes"},
+//	    {"id": "2016-09", "passphrase": "derived via scrypt", "salt": "defaults to the id"}
+//	  ]
+//	}
+func LoadKeyring(path string) (Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Keyring{}, err
+	}
+	defer f.Close()
+
+	var file keyringFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return Keyring{}, fmt.Errorf("invalid keyring %q: %v", path, err)
+	}
+
+	var keys []Key
+	for _, k := range file.Keys {
+		if (k.Key == "") == (k.Passphrase == "") {
+			return Keyring{}, fmt.Errorf("key %q needs either a key or a passphrase", k.ID)
+		}
+
+		secret := []byte(k.Key)
+		if k.Passphrase != "" {
+			salt := k.Salt
+			if salt == "" {
+				salt = k.ID
+			}
+			if secret, err = DeriveKey(k.Passphrase, salt); err != nil {
+				return Keyring{}, err
+			}
+		}
+		keys = append(keys, Key{ID: k.ID, Secret: secret})
+	}
+
+	return NewKeyring(file.Active, keys...)
+}
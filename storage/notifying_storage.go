@@ -0,0 +1,121 @@
+package storage
+
+import "sync"
+
+// Change describes a single Store call. A repository without plugins was
+// removed from the store.
+type Change struct {
+	Repository Repository
+}
+
+// Removed reports whether the repository was removed from the store
+func (c Change) Removed() bool {
+	return len(c.Repository.Plugins) == 0
+}
+
+// RepositoryWatcher notifies about every change to a store
+type RepositoryWatcher interface {
+	// Watch returns a channel receiving all future changes in order, and a
+	// function to stop watching. Changes queue up for slow watchers, so
+	// neither Store nor other watchers wait for them.
+	Watch() (<-chan Change, func())
+}
+
+type watcher struct {
+	changes chan Change
+	done    chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []Change
+	stopped bool
+}
+
+func (w *watcher) push(c Change) {
+	w.mu.Lock()
+	w.pending = append(w.pending, c)
+	w.mu.Unlock()
+	w.cond.Signal()
+}
+
+// run forwards pending changes until the watcher is stopped. It's the only
+// sender on changes, so it closes the channel as well.
+func (w *watcher) run() {
+	defer close(w.changes)
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		c := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.changes <- c:
+		case <-w.done:
+		}
+	}
+}
+
+// NotifyingStorage wraps a store and notifies watchers after each successful Store
+type NotifyingStorage struct {
+	RepositoryStore
+
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func NewNotifyingStorage(backingStore RepositoryStore) *NotifyingStorage {
+	return &NotifyingStorage{
+		RepositoryStore: backingStore,
+		watchers:        make(map[*watcher]struct{}),
+	}
+}
+
+func (n *NotifyingStorage) Store(r Repository) error {
+	if err := n.RepositoryStore.Store(r); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for w := range n.watchers {
+		w.push(Change{Repository: r})
+	}
+
+	return nil
+}
+
+func (n *NotifyingStorage) Watch() (<-chan Change, func()) {
+	w := &watcher{
+		changes: make(chan Change),
+		done:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+
+	n.mu.Lock()
+	n.watchers[w] = struct{}{}
+	n.mu.Unlock()
+
+	var once sync.Once
+	return w.changes, func() {
+		once.Do(func() {
+			n.mu.Lock()
+			delete(n.watchers, w)
+			n.mu.Unlock()
+
+			// unblock a pending send before stopping
+			close(w.done)
+			w.mu.Lock()
+			w.stopped = true
+			w.mu.Unlock()
+			w.cond.Signal()
+		})
+	}
+}
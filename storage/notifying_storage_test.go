@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func receiveChange(t *testing.T, changes <-chan Change) Change {
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a change, but got none")
+	}
+	return Change{}
+}
+
+func Test_NotifyingStorage_Watch(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	store := NewNotifyingStorage(backend)
+
+	changes, stop := store.Watch()
+	defer stop()
+
+	if err := store.Store(Repository{ID: "1", Plugins: []string{"ruby"}}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if c := receiveChange(t, changes); c.Repository.ID != "1" || c.Removed() {
+		t.Fatalf("Expected repository 1 to be stored, but got %#v", c)
+	}
+
+	// storing without plugins deletes the repository
+	if err := store.Store(Repository{ID: "1"}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if c := receiveChange(t, changes); c.Repository.ID != "1" || !c.Removed() {
+		t.Fatalf("Expected repository 1 to be removed, but got %#v", c)
+	}
+	if _, err := store.Get("1"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+
+	// failed writes are not announced
+	if err := store.Store(Repository{ID: "1"}); err == nil {
+		t.Fatalf("Expected an error deleting a missing repository, but got none")
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("Expected no change, but got %#v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_NotifyingStorage_StopWatching(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	store := NewNotifyingStorage(backend)
+
+	stopped, stop := store.Watch()
+	changes, stopOther := store.Watch()
+	defer stopOther()
+	stop()
+	stop()
+
+	if _, ok := <-stopped; ok {
+		t.Fatalf("Expected the stopped channel to be closed")
+	}
+	// other watchers keep receiving changes
+	if err := store.Store(Repository{ID: "1", Plugins: []string{"ruby"}}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if c := receiveChange(t, changes); c.Repository.ID != "1" {
+		t.Fatalf("Expected repository 1, but got %#v", c)
+	}
+}
+
+func Test_NotifyingStorage_SlowWatcher(t *testing.T) {
+	backend, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	store := NewNotifyingStorage(backend)
+
+	// nobody receives from the stalled watcher
+	_, stopStalled := store.Watch()
+	defer stopStalled()
+	changes, stop := store.Watch()
+	defer stop()
+
+	stored := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			store.Store(Repository{ID: "1", Plugins: []string{"ruby"}})
+		}
+		close(stored)
+	}()
+	select {
+	case <-stored:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Store not to wait for a stalled watcher, but it did")
+	}
+
+	for i := 0; i < 100; i++ {
+		if c := receiveChange(t, changes); c.Repository.ID != "1" {
+			t.Fatalf("Expected repository 1, but got %#v", c)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// RunEventType names a step in the lifecycle of a job
+type RunEventType string
+
+const (
+	RunStarted           RunEventType = "started"
+	RunOutdatedFound     RunEventType = "outdated-found"
+	RunPRCreated         RunEventType = "pr-created"
+	RunSkippedExistingPR RunEventType = "skipped-existing-pr"
+	RunFailed            RunEventType = "failed"
+	RunInvalidConfig     RunEventType = "invalid-config"
+	RunUnsupported       RunEventType = "unsupported-language"
+)
+
+// RunEvent records what a job did to a repository
+type RunEvent struct {
+	RepositoryID  string
+	JobID         string
+	CorrelationID string
+	Type          RunEventType
+	Time          time.Time
+	Plugin        string
+	Path          string `json:",omitempty"`
+	Language      string `json:",omitempty"`
+	// Dependencies are the outdated dependencies found
+	Dependencies []string `json:",omitempty"`
+	Branch       string   `json:",omitempty"`
+	PullRequest  int      `json:",omitempty"`
+	Error        string   `json:",omitempty"`
+}
+
+// RunHistoryStore persists RunEvents
+type RunHistoryStore interface {
+	StoreRunEvent(RunEvent) error
+	// LoadRunEvents returns the events of a repository since the given time,
+	// oldest first
+	LoadRunEvents(repositoryID string, since time.Time) ([]RunEvent, error)
+}
+
+// sortRunEvents orders events by time, keeping the order of events recorded
+// within the same instant
+func sortRunEvents(events []RunEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+}
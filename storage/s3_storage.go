@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -22,23 +26,58 @@ func NewS3Storage(bucket string) S3Storage {
 	}
 }
 
-func (f S3Storage) Store(r Repository) error {
+func (f S3Storage) client() (*s3.S3, error) {
 	sess, err := session.NewSessionWithOptions(session.Options{
 		Profile: os.Getenv("AWS_PROFILE"),
 	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get S3 session: %q", err)
+	}
+
+	return s3.New(sess), nil
+}
+
+// nameIndexPrefix and pluginIndexPrefix hold empty objects named after the
+// repository id, so lookups list a single prefix instead of every object
+func nameIndexPrefix(fullName string) string {
+	return fmt.Sprintf("names/%s/", url.QueryEscape(fullName))
+}
+
+func pluginIndexPrefix(plugin string) string {
+	return fmt.Sprintf("plugins/%s/", url.QueryEscape(plugin))
+}
+
+// indexKeys lists the index objects pointing at r
+func indexKeys(r Repository) []string {
+	keys := []string{nameIndexPrefix(r.FullName) + r.ID}
+	for _, plugin := range r.Plugins {
+		keys = append(keys, pluginIndexPrefix(plugin)+r.ID)
+	}
+	return keys
+}
+
+// Store writes the repository and its index objects, and removes index
+// objects of a previous version which no longer apply
+func (f S3Storage) Store(r Repository) error {
+	svc, err := f.client()
 	if err != nil {
 		return err
 	}
 
-	svc := s3.New(sess)
+	previous, err := f.read(svc, fmt.Sprintf("%s.json", r.ID))
+	if err != nil && err != ErrNotFound {
+		return err
+	}
 
 	if len(r.Plugins) == 0 {
 		params := &s3.DeleteObjectInput{
 			Bucket: aws.String(f.Bucket),
 			Key:    aws.String(fmt.Sprintf("%s.json", r.ID)),
 		}
-		_, err := svc.DeleteObject(params)
-		return err
+		if _, err := svc.DeleteObject(params); err != nil {
+			return err
+		}
+		return f.deleteIndex(svc, indexKeys(previous), nil)
 	}
 
 	bs, err := json.MarshalIndent(&r, "", "\t")
@@ -50,50 +89,514 @@ func (f S3Storage) Store(r Repository) error {
 		Key:    aws.String(fmt.Sprintf("%s.json", r.ID)),
 		Body:   bytes.NewReader(bs),
 	}
-	_, err = svc.PutObject(params)
+	if _, err = svc.PutObject(params); err != nil {
+		return err
+	}
 
-	return err
+	keys := indexKeys(r)
+	if err := f.writeIndex(svc, keys); err != nil {
+		return err
+	}
+	return f.deleteIndex(svc, indexKeys(previous), keys)
 }
 
-func (f S3Storage) Load() ([]Repository, error) {
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Profile: os.Getenv("AWS_PROFILE"),
+func (f S3Storage) writeIndex(svc *s3.S3, keys []string) error {
+	for _, key := range keys {
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(f.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(nil),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIndex removes the index objects in keys which are not kept
+func (f S3Storage) deleteIndex(svc *s3.S3, keys, keep []string) error {
+	kept := map[string]bool{}
+	for _, key := range keep {
+		kept[key] = true
+	}
+	for _, key := range keys {
+		// records which were never stored have no id
+		if kept[key] || strings.HasSuffix(key, "/") {
+			continue
+		}
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(f.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexed lists the repository ids below an index prefix
+func (f S3Storage) indexed(svc *s3.S3, prefix string) ([]string, error) {
+	var ids []string
+	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(f.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range page.Contents {
+			ids = append(ids, strings.TrimPrefix(*o.Key, prefix))
+		}
+		return true
 	})
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get S3 session: %q", err)
+		return nil, fmt.Errorf("Unable to list objects: %q", err)
 	}
+	return ids, nil
+}
 
-	svc := s3.New(sess)
+// Reindex writes the index objects of every repository. Buckets written
+// before the index existed need it once.
+func (f S3Storage) Reindex() error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
 
-	params := &s3.ListObjectsInput{
+	return f.walk(func(r Repository) error {
+		return f.writeIndex(svc, indexKeys(r))
+	})
+}
+
+func (f S3Storage) read(svc *s3.S3, key string) (Repository, error) {
+	var r Repository
+
+	params := &s3.GetObjectInput{
 		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(key),
 	}
-	resp, err := svc.ListObjects(params)
+	resp, err := svc.GetObject(params)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to list objects: %q", err)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			return r, ErrNotFound
+		}
+		return r, err
 	}
+	defer resp.Body.Close()
 
-	var repos []Repository
-	for _, o := range resp.Contents {
-		params := &s3.GetObjectInput{
-			Bucket: aws.String(f.Bucket),
-			Key:    aws.String(*o.Key),
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return r, err
+	}
+
+	err = json.Unmarshal(b, &r)
+	return r, err
+}
+
+// walk calls fn for every object in the bucket until fn returns an error
+func (f S3Storage) walk(fn func(Repository) error) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	// schedule states, indexes and other records are stored below prefixes
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String(f.Bucket),
+		Delimiter: aws.String("/"),
+	}
+	var walkErr error
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range page.Contents {
+			r, err := f.read(svc, *o.Key)
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			if err := fn(r); err != nil {
+				walkErr = err
+				return false
+			}
 		}
-		resp, err := svc.GetObject(params)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to list objects: %q", err)
+	}
+	if walkErr == errStopWalk {
+		return nil
+	}
+
+	return walkErr
+}
+
+func (f S3Storage) Load() ([]Repository, error) {
+	var repos []Repository
+
+	err := f.walk(func(r Repository) error {
+		repos = append(repos, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// Get fetches a single object from the bucket
+func (f S3Storage) Get(id string) (Repository, error) {
+	svc, err := f.client()
+	if err != nil {
+		return Repository{}, err
+	}
+
+	return f.read(svc, fmt.Sprintf("%s.json", id))
+}
 
+// GetByFullName looks the id up in the name index
+func (f S3Storage) GetByFullName(fullName string) (Repository, error) {
+	svc, err := f.client()
+	if err != nil {
+		return Repository{}, err
+	}
+
+	ids, err := f.indexed(svc, nameIndexPrefix(fullName))
+	if err != nil {
+		return Repository{}, err
+	}
+	for _, id := range ids {
+		r, err := f.read(svc, fmt.Sprintf("%s.json", id))
+		if err == ErrNotFound {
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return Repository{}, err
+		}
+		// a repository renamed by another writer may leave the old name behind
+		if r.FullName == fullName {
+			return r, nil
 		}
+	}
+
+	return Repository{}, ErrNotFound
+}
+
+// ListByPlugin reads the repositories listed in the plugin index
+func (f S3Storage) ListByPlugin(plugin string) ([]Repository, error) {
+	svc, err := f.client()
+	if err != nil {
+		return nil, err
+	}
 
-		b, err := ioutil.ReadAll(resp.Body)
+	ids, err := f.indexed(svc, pluginIndexPrefix(plugin))
+	if err != nil {
+		return nil, err
+	}
+	var repos []Repository
+	for _, id := range ids {
+		r, err := f.read(svc, fmt.Sprintf("%s.json", id))
+		if err == ErrNotFound {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
-
-		var r Repository
-		json.Unmarshal(b, &r)
-		repos = append(repos, r)
+		if r.HasPlugin(plugin) {
+			repos = append(repos, r)
+		}
 	}
 
 	return repos, nil
 }
+
+// LoadScheduleStates reads all objects below schedules/
+func (f S3Storage) LoadScheduleStates() ([]ScheduleState, error) {
+	svc, err := f.client()
+	if err != nil {
+		return nil, err
+	}
+
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(f.Bucket),
+		Prefix: aws.String("schedules/"),
+	}
+	var (
+		states  []ScheduleState
+		readErr error
+	)
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range page.Contents {
+			resp, err := svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(f.Bucket),
+				Key:    o.Key,
+			})
+			if err != nil {
+				readErr = err
+				return false
+			}
+
+			var state ScheduleState
+			err = json.NewDecoder(resp.Body).Decode(&state)
+			resp.Body.Close()
+			if err != nil {
+				readErr = err
+				return false
+			}
+			states = append(states, state)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects: %q", err)
+	}
+
+	return states, readErr
+}
+
+func scheduleStateKey(repositoryID, plugin string) string {
+	return fmt.Sprintf("schedules/%s/%s.json", repositoryID, url.QueryEscape(plugin))
+}
+
+// LoadScheduleState reads the object of a single repository and plugin
+func (f S3Storage) LoadScheduleState(repositoryID, plugin string) (ScheduleState, error) {
+	var state ScheduleState
+	svc, err := f.client()
+	if err != nil {
+		return state, err
+	}
+
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(scheduleStateKey(repositoryID, plugin)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			return state, ErrNotFound
+		}
+		return state, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+func (f S3Storage) StoreScheduleState(state ScheduleState) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(scheduleStateKey(state.RepositoryID, state.Plugin)),
+		Body:   bytes.NewReader(bs),
+	})
+
+	return err
+}
+
+func checkStateKey(repositoryID, entry string) string {
+	return fmt.Sprintf("checks/%s/%s.json", repositoryID, url.QueryEscape(entry))
+}
+
+// LoadCheckState reads the object of a single repository and entry
+func (f S3Storage) LoadCheckState(repositoryID, entry string) (CheckState, error) {
+	var state CheckState
+	svc, err := f.client()
+	if err != nil {
+		return state, err
+	}
+
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(checkStateKey(repositoryID, entry)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			return state, ErrNotFound
+		}
+		return state, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+func (f S3Storage) StoreCheckState(state CheckState) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(checkStateKey(state.RepositoryID, state.Entry)),
+		Body:   bytes.NewReader(bs),
+	})
+
+	return err
+}
+
+func pendingJobPrefix(queue string) string {
+	return fmt.Sprintf("jobs/%s/", url.QueryEscape(queue))
+}
+
+// StorePendingJob writes one object per job below jobs/<queue>/
+func (f S3Storage) StorePendingJob(job PendingJob) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(pendingJobPrefix(job.Queue) + job.ID + ".json"),
+		Body:   bytes.NewReader(bs),
+	})
+
+	return err
+}
+
+func (f S3Storage) DeletePendingJob(queue, id string) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(pendingJobPrefix(queue) + id + ".json"),
+	})
+	return err
+}
+
+// LoadPendingJobs reads all objects below jobs/<queue>/
+func (f S3Storage) LoadPendingJobs(queue string) ([]PendingJob, error) {
+	svc, err := f.client()
+	if err != nil {
+		return nil, err
+	}
+
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(f.Bucket),
+		Prefix: aws.String(pendingJobPrefix(queue)),
+	}
+	var (
+		jobs    []PendingJob
+		readErr error
+	)
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range page.Contents {
+			resp, err := svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(f.Bucket),
+				Key:    o.Key,
+			})
+			if err != nil {
+				readErr = err
+				return false
+			}
+
+			var job PendingJob
+			err = json.NewDecoder(resp.Body).Decode(&job)
+			resp.Body.Close()
+			if err != nil {
+				readErr = err
+				return false
+			}
+			jobs = append(jobs, job)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects: %q", err)
+	}
+
+	return jobs, readErr
+}
+
+// StoreRunEvent writes one object per event below runs/<repository id>/
+func (f S3Storage) StoreRunEvent(event RunEvent) error {
+	svc, err := f.client()
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(f.Bucket),
+		Key:    aws.String(fmt.Sprintf("runs/%s/%020d-%s-%s.json", event.RepositoryID, event.Time.UnixNano(), event.JobID, event.Type)),
+		Body:   bytes.NewReader(bs),
+	})
+
+	return err
+}
+
+// LoadRunEvents lists all events of the repository. Keys start with the
+// event time, so older events are skipped without reading them.
+func (f S3Storage) LoadRunEvents(repositoryID string, since time.Time) ([]RunEvent, error) {
+	svc, err := f.client()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("runs/%s/", repositoryID)
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(f.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	if !since.IsZero() {
+		params.Marker = aws.String(fmt.Sprintf("%s%020d", prefix, since.UnixNano()))
+	}
+	var (
+		events  []RunEvent
+		readErr error
+	)
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range page.Contents {
+			resp, err := svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(f.Bucket),
+				Key:    o.Key,
+			})
+			if err != nil {
+				readErr = err
+				return false
+			}
+
+			var event RunEvent
+			err = json.NewDecoder(resp.Body).Decode(&event)
+			resp.Body.Close()
+			if err != nil {
+				readErr = err
+				return false
+			}
+			events = append(events, event)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects: %q", err)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	sortRunEvents(events)
+	return events, nil
+}
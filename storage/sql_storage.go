@@ -0,0 +1,572 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations are applied in order; a migration must never be changed once it
+// was released, append a new one instead.
+var migrations = []string{
+	`CREATE TABLE repositories (
+		id           TEXT NOT NULL PRIMARY KEY,
+		full_name    TEXT NOT NULL,
+		access_token TEXT NOT NULL,
+		git_url      TEXT NOT NULL
+	)`,
+	`CREATE INDEX repositories_full_name ON repositories (full_name)`,
+	`CREATE TABLE repository_plugins (
+		repository_id TEXT NOT NULL REFERENCES repositories (id),
+		plugin        TEXT NOT NULL,
+		PRIMARY KEY (repository_id, plugin)
+	)`,
+	`CREATE INDEX repository_plugins_plugin ON repository_plugins (plugin)`,
+	`ALTER TABLE repositories ADD COLUMN schedules TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE schedule_states (
+		repository_id TEXT NOT NULL,
+		plugin        TEXT NOT NULL,
+		last_run      BIGINT NOT NULL,
+		next_run      BIGINT NOT NULL,
+		PRIMARY KEY (repository_id, plugin)
+	)`,
+	`CREATE TABLE run_events (
+		repository_id  TEXT NOT NULL,
+		job_id         TEXT NOT NULL,
+		correlation_id TEXT NOT NULL,
+		type           TEXT NOT NULL,
+		time           BIGINT NOT NULL,
+		plugin         TEXT NOT NULL,
+		path           TEXT NOT NULL,
+		language       TEXT NOT NULL,
+		dependencies   TEXT NOT NULL,
+		branch         TEXT NOT NULL,
+		pull_request   INTEGER NOT NULL,
+		error          TEXT NOT NULL
+	)`,
+	`CREATE INDEX run_events_repository_time ON run_events (repository_id, time)`,
+	`ALTER TABLE repositories ADD COLUMN default_branch TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE check_states (
+		repository_id TEXT NOT NULL,
+		entry         TEXT NOT NULL,
+		fingerprint   TEXT NOT NULL,
+		time          BIGINT NOT NULL,
+		PRIMARY KEY (repository_id, entry)
+	)`,
+	`CREATE TABLE pending_jobs (
+		queue   TEXT NOT NULL,
+		id      TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		job     TEXT NOT NULL,
+		PRIMARY KEY (queue, id)
+	)`,
+}
+
+// SQLStorage stores repositories in a relational database. The sqlite3 and
+// postgres drivers are supported; the driver itself must be registered by
+// the caller, e.g. via a blank import.
+type SQLStorage struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// NewSQLStorage opens the database and migrates the schema to the latest version
+func NewSQLStorage(driverName, dataSourceName string) (SQLStorage, error) {
+	if driverName != "sqlite3" && driverName != "postgres" {
+		return SQLStorage{}, fmt.Errorf("unsupported sql driver %q", driverName)
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return SQLStorage{}, err
+	}
+
+	s := SQLStorage{
+		db:       db,
+		postgres: driverName == "postgres",
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return SQLStorage{}, err
+	}
+
+	return s, nil
+}
+
+// Close closes the underlying database
+func (s SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders into the $n form postgres expects
+func (s SQLStorage) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrationLock is the postgres advisory lock serializing migrations of
+// replicas starting at the same time
+const migrationLock = 7262012
+
+// begin starts a transaction holding the migration lock. sqlite serializes
+// writing transactions anyway.
+func (s SQLStorage) begin() (*sql.Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if s.postgres {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+func (s SQLStorage) migrate() error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		if err := s.apply(version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply runs a single migration, unless another replica applied it while
+// this one was waiting for the lock
+func (s SQLStorage) apply(version int) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	var applied int
+	if err := tx.QueryRow(s.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if applied > 0 {
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec(migrations[version-1]); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d failed: %v", version, err)
+	}
+	if _, err := tx.Exec(s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Store inserts or updates the repository and its plugins in one transaction.
+// Like all other backends, a repository without plugins is removed.
+func (s SQLStorage) Store(r Repository) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := s.store(tx, r); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s SQLStorage) store(tx *sql.Tx, r Repository) error {
+	if _, err := tx.Exec(s.rebind(`DELETE FROM repository_plugins WHERE repository_id = ?`), r.ID); err != nil {
+		return err
+	}
+
+	if len(r.Plugins) == 0 {
+		_, err := tx.Exec(s.rebind(`DELETE FROM repositories WHERE id = ?`), r.ID)
+		return err
+	}
+
+	var schedules []byte
+	if len(r.Schedules) > 0 {
+		var err error
+		if schedules, err = json.Marshal(r.Schedules); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(s.rebind(`
+		INSERT INTO repositories (id, full_name, access_token, git_url, schedules, default_branch) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			full_name = excluded.full_name,
+			access_token = excluded.access_token,
+			git_url = excluded.git_url,
+			schedules = excluded.schedules,
+			default_branch = excluded.default_branch`),
+		r.ID, r.FullName, r.AccessToken, r.GitURL, string(schedules), r.DefaultBranch,
+	); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, plugin := range r.Plugins {
+		// plugins listed twice would violate the primary key
+		if seen[plugin] {
+			continue
+		}
+		seen[plugin] = true
+		if _, err := tx.Exec(s.rebind(`INSERT INTO repository_plugins (repository_id, plugin) VALUES (?, ?)`), r.ID, plugin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load returns all repositories, ordered by ID
+func (s SQLStorage) Load() ([]Repository, error) {
+	return s.query(`SELECT id, full_name, access_token, git_url, schedules, default_branch FROM repositories ORDER BY id`)
+}
+
+// query loads all repositories matching the query, including their plugins.
+// The query must select id, full_name, access_token, git_url, schedules and
+// default_branch.
+func (s SQLStorage) query(query string, args ...interface{}) ([]Repository, error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var repos []Repository
+	for rows.Next() {
+		var (
+			r         Repository
+			schedules string
+		)
+		if err := rows.Scan(&r.ID, &r.FullName, &r.AccessToken, &r.GitURL, &schedules, &r.DefaultBranch); err != nil {
+			return nil, err
+		}
+		if schedules != "" {
+			if err := json.Unmarshal([]byte(schedules), &r.Schedules); err != nil {
+				return nil, err
+			}
+		}
+		repos = append(repos, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for start := 0; start < len(repos); start += maxPluginBatch {
+		end := start + maxPluginBatch
+		if end > len(repos) {
+			end = len(repos)
+		}
+		if err := s.loadPlugins(repos[start:end]); err != nil {
+			return nil, err
+		}
+	}
+
+	return repos, nil
+}
+
+// maxPluginBatch bounds the number of placeholders used by loadPlugins
+const maxPluginBatch = 500
+
+// loadPlugins fills in the plugins of all given repositories with a single query
+func (s SQLStorage) loadPlugins(repos []Repository) error {
+	var (
+		index        = make(map[string]int, len(repos))
+		args         = make([]interface{}, 0, len(repos))
+		placeholders = make([]string, 0, len(repos))
+	)
+	for i, r := range repos {
+		index[r.ID] = i
+		args = append(args, r.ID)
+		placeholders = append(placeholders, "?")
+	}
+
+	rows, err := s.db.Query(s.rebind(fmt.Sprintf(
+		`SELECT repository_id, plugin FROM repository_plugins WHERE repository_id IN (%s) ORDER BY repository_id, plugin`,
+		strings.Join(placeholders, ", "),
+	)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var repositoryID, plugin string
+		if err := rows.Scan(&repositoryID, &plugin); err != nil {
+			return err
+		}
+		i := index[repositoryID]
+		repos[i].Plugins = append(repos[i].Plugins, plugin)
+	}
+
+	return rows.Err()
+}
+
+// Get uses the primary key
+func (s SQLStorage) Get(id string) (Repository, error) {
+	repos, err := s.query(`SELECT id, full_name, access_token, git_url, schedules, default_branch FROM repositories WHERE id = ?`, id)
+	if err != nil {
+		return Repository{}, err
+	}
+	if len(repos) == 0 {
+		return Repository{}, ErrNotFound
+	}
+
+	return repos[0], nil
+}
+
+// GetByFullName uses the full_name index
+func (s SQLStorage) GetByFullName(fullName string) (Repository, error) {
+	repos, err := s.query(`SELECT id, full_name, access_token, git_url, schedules, default_branch FROM repositories WHERE full_name = ? ORDER BY id LIMIT 1`, fullName)
+	if err != nil {
+		return Repository{}, err
+	}
+	if len(repos) == 0 {
+		return Repository{}, ErrNotFound
+	}
+
+	return repos[0], nil
+}
+
+// ListByPlugin uses the plugin index
+func (s SQLStorage) ListByPlugin(plugin string) ([]Repository, error) {
+	return s.query(`
+		SELECT id, full_name, access_token, git_url, schedules, default_branch FROM repositories
+		WHERE id IN (SELECT repository_id FROM repository_plugins WHERE plugin = ?)
+		ORDER BY id`, plugin)
+}
+
+func (s SQLStorage) LoadScheduleStates() ([]ScheduleState, error) {
+	rows, err := s.db.Query(`SELECT repository_id, plugin, last_run, next_run FROM schedule_states`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []ScheduleState
+	for rows.Next() {
+		var (
+			state            ScheduleState
+			lastRun, nextRun int64
+		)
+		if err := rows.Scan(&state.RepositoryID, &state.Plugin, &lastRun, &nextRun); err != nil {
+			return nil, err
+		}
+		state.LastRun = fromUnix(lastRun)
+		state.NextRun = fromUnix(nextRun)
+		states = append(states, state)
+	}
+
+	return states, rows.Err()
+}
+
+// LoadScheduleState uses the primary key of schedule_states
+func (s SQLStorage) LoadScheduleState(repositoryID, plugin string) (ScheduleState, error) {
+	state := ScheduleState{RepositoryID: repositoryID, Plugin: plugin}
+	var lastRun, nextRun int64
+	err := s.db.QueryRow(s.rebind(`SELECT last_run, next_run FROM schedule_states WHERE repository_id = ? AND plugin = ?`),
+		repositoryID, plugin,
+	).Scan(&lastRun, &nextRun)
+	if err == sql.ErrNoRows {
+		return ScheduleState{}, ErrNotFound
+	}
+	if err != nil {
+		return ScheduleState{}, err
+	}
+	state.LastRun = fromUnix(lastRun)
+	state.NextRun = fromUnix(nextRun)
+	return state, nil
+}
+
+func (s SQLStorage) StoreScheduleState(state ScheduleState) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO schedule_states (repository_id, plugin, last_run, next_run) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repository_id, plugin) DO UPDATE SET
+			last_run = excluded.last_run,
+			next_run = excluded.next_run`),
+		state.RepositoryID, state.Plugin, toUnix(state.LastRun), toUnix(state.NextRun),
+	)
+	return err
+}
+
+// LoadCheckState uses the primary key of check_states
+func (s SQLStorage) LoadCheckState(repositoryID, entry string) (CheckState, error) {
+	state := CheckState{RepositoryID: repositoryID, Entry: entry}
+	var checked int64
+	err := s.db.QueryRow(s.rebind(`SELECT fingerprint, time FROM check_states WHERE repository_id = ? AND entry = ?`),
+		repositoryID, entry,
+	).Scan(&state.Fingerprint, &checked)
+	if err == sql.ErrNoRows {
+		return CheckState{}, ErrNotFound
+	}
+	if err != nil {
+		return CheckState{}, err
+	}
+	state.Time = fromUnix(checked)
+	return state, nil
+}
+
+func (s SQLStorage) StoreCheckState(state CheckState) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO check_states (repository_id, entry, fingerprint, time) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repository_id, entry) DO UPDATE SET
+			fingerprint = excluded.fingerprint,
+			time = excluded.time`),
+		state.RepositoryID, state.Entry, state.Fingerprint, toUnix(state.Time),
+	)
+	return err
+}
+
+func (s SQLStorage) StorePendingJob(job PendingJob) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO pending_jobs (queue, id, subject, attempt, job) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (queue, id) DO UPDATE SET
+			subject = excluded.subject,
+			attempt = excluded.attempt,
+			job = excluded.job`),
+		job.Queue, job.ID, job.Subject, job.Attempt, string(job.Job),
+	)
+	return err
+}
+
+func (s SQLStorage) DeletePendingJob(queue, id string) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM pending_jobs WHERE queue = ? AND id = ?`), queue, id)
+	return err
+}
+
+func (s SQLStorage) LoadPendingJobs(queue string) ([]PendingJob, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT id, subject, attempt, job FROM pending_jobs WHERE queue = ? ORDER BY id`), queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []PendingJob
+	for rows.Next() {
+		job := PendingJob{Queue: queue}
+		var data string
+		if err := rows.Scan(&job.ID, &job.Subject, &job.Attempt, &data); err != nil {
+			return nil, err
+		}
+		job.Job = json.RawMessage(data)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// StoreRunEvent stores the time with nanosecond precision, so events of a
+// single job keep their order
+func (s SQLStorage) StoreRunEvent(event RunEvent) error {
+	dependencies, err := json.Marshal(event.Dependencies)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.rebind(`
+		INSERT INTO run_events (repository_id, job_id, correlation_id, type, time, plugin, path, language, dependencies, branch, pull_request, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		event.RepositoryID, event.JobID, event.CorrelationID, string(event.Type), event.Time.UnixNano(),
+		event.Plugin, event.Path, event.Language, string(dependencies), event.Branch, event.PullRequest, event.Error,
+	)
+	return err
+}
+
+// LoadRunEvents uses the repository and time index
+func (s SQLStorage) LoadRunEvents(repositoryID string, since time.Time) ([]RunEvent, error) {
+	var from int64
+	if !since.IsZero() {
+		from = since.UnixNano()
+	}
+	rows, err := s.db.Query(s.rebind(`
+		SELECT repository_id, job_id, correlation_id, type, time, plugin, path, language, dependencies, branch, pull_request, error
+		FROM run_events WHERE repository_id = ? AND time >= ? ORDER BY time`),
+		repositoryID, from,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []RunEvent
+	for rows.Next() {
+		var (
+			event        RunEvent
+			eventType    string
+			at           int64
+			dependencies string
+		)
+		if err := rows.Scan(
+			&event.RepositoryID, &event.JobID, &event.CorrelationID, &eventType, &at,
+			&event.Plugin, &event.Path, &event.Language, &dependencies, &event.Branch, &event.PullRequest, &event.Error,
+		); err != nil {
+			return nil, err
+		}
+		event.Type = RunEventType(eventType)
+		event.Time = time.Unix(0, at).UTC()
+		if err := json.Unmarshal([]byte(dependencies), &event.Dependencies); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// toUnix stores the zero time as 0 instead of a large negative number
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newSQLiteStorage(t *testing.T) (SQLStorage, func()) {
+	dir, err := ioutil.TempDir("", "sisyphus-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLStorage("sqlite3", filepath.Join(dir, "sisyphus.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_SQLStorage_StoreAndLoad(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	repos := []Repository{
+		{ID: "1", FullName: "nicolai86/sisyphus", AccessToken: "a", Plugins: []string{"greenkeep"}, GitURL: "git://a"},
+		{ID: "2", FullName: "nicolai86/other", AccessToken: "b", Plugins: []string{"greenkeep", "lint"}, GitURL: "git://b", DefaultBranch: "develop"},
+	}
+	for _, r := range repos {
+		if err := s.Store(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, repos) {
+		t.Fatalf("Expected %#v, but got %#v", repos, loaded)
+	}
+
+	updated := repos[1]
+	updated.Plugins = []string{"lint"}
+	updated.AccessToken = "c"
+	if err := s.Store(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(Repository{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, []Repository{updated}) {
+		t.Fatalf("Expected only %#v, but got %#v", updated, loaded)
+	}
+}
+
+func Test_SQLStorage_MigrationsAreIdempotent(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	if err := s.migrate(); err != nil {
+		t.Fatalf("Expected a second migration run to be a no-op, but got %q", err)
+	}
+}
+
+func Test_SQLStorage_Finder(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	a := Repository{ID: "1", FullName: "nicolai86/sisyphus", Plugins: []string{"greenkeep"}}
+	b := Repository{ID: "2", FullName: "nicolai86/other", Plugins: []string{"lint"}}
+	for _, r := range []Repository{a, b} {
+		if err := s.Store(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r, err := s.Get("2"); err != nil || !reflect.DeepEqual(r, b) {
+		t.Fatalf("Expected %#v, but got %#v (%v)", b, r, err)
+	}
+	if _, err := s.Get("3"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+	if r, err := s.GetByFullName("nicolai86/sisyphus"); err != nil || !reflect.DeepEqual(r, a) {
+		t.Fatalf("Expected %#v, but got %#v (%v)", a, r, err)
+	}
+	if repos, err := s.ListByPlugin("lint"); err != nil || !reflect.DeepEqual(repos, []Repository{b}) {
+		t.Fatalf("Expected only %#v, but got %#v (%v)", b, repos, err)
+	}
+}
+
+func Test_SQLStorage_RunEvents(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+	events := []RunEvent{
+		{RepositoryID: "1", JobID: "a", Type: RunStarted, Time: now.Add(-8 * 24 * time.Hour)},
+		{RepositoryID: "1", JobID: "b", Type: RunStarted, Time: now.Add(-time.Hour)},
+		{RepositoryID: "1", JobID: "b", Type: RunOutdatedFound, Time: now.Add(-time.Hour + time.Nanosecond), Dependencies: []string{"rails"}},
+		{RepositoryID: "1", JobID: "b", Type: RunPRCreated, Time: now, Branch: "greenkeep/abc", PullRequest: 42},
+		{RepositoryID: "2", JobID: "c", Type: RunFailed, Time: now, Error: "no Gemfile"},
+	}
+	for _, event := range events {
+		if err := s.StoreRunEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	week, err := s.LoadRunEvents("1", now.Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(week, events[1:4]) {
+		t.Fatalf("Expected %#v, but got %#v", events[1:4], week)
+	}
+}
+
+func Test_SQLStorage_LoadScheduleState(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	testScheduleStateStore(t, s)
+}
+
+func Test_SQLStorage_CheckState(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	testCheckStateStore(t, s)
+}
+
+func Test_SQLStorage_JobQueue(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	testJobQueueStore(t, s)
+}
+
+func Test_SQLStorage_DuplicatePlugins(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	if err := s.Store(Repository{ID: "1", FullName: "nicolai86/sisyphus", Plugins: []string{"greenkeep", "greenkeep"}}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	r, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Plugins, []string{"greenkeep"}) {
+		t.Fatalf("Expected greenkeep once, but got %q", r.Plugins)
+	}
+}
+
+func Test_SQLStorage_SkipsAppliedMigrations(t *testing.T) {
+	s, cleanup := newSQLiteStorage(t)
+	defer cleanup()
+
+	// like a replica which applied the migration while waiting for the lock
+	if err := s.apply(1); err != nil {
+		t.Fatalf("Expected an applied migration to be skipped, but got %q", err)
+	}
+}
@@ -1,11 +1,45 @@
 package storage
 
+import (
+	"errors"
+	"time"
+
+	"github.com/nicolai86/sisyphus/schedule"
+)
+
+// ErrNotFound is returned by a RepositoryFinder if no repository matches, and
+// by state stores for entries which never ran
+var ErrNotFound = errors.New("repository not found")
+
 type Repository struct {
 	ID          string
 	FullName    string
 	AccessToken string
 	Plugins     []string
 	GitURL      string
+	// DefaultBranch is the branch .sisyphus is read from and PRs target
+	DefaultBranch string `json:",omitempty"`
+	// Schedules maps plugins to their schedule; plugins without an entry use
+	// the scheduler's default
+	Schedules map[string]schedule.Spec
+}
+
+// HasPlugin reports whether the plugin is enabled for the repository
+func (r Repository) HasPlugin(plugin string) bool {
+	for _, p := range r.Plugins {
+		if p == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedule returns the schedule of the plugin, or fallback if there is none
+func (r Repository) Schedule(plugin string, fallback schedule.Spec) schedule.Spec {
+	if spec, ok := r.Schedules[plugin]; ok {
+		return spec
+	}
+	return fallback
 }
 
 type RepositoryWriter interface {
@@ -16,7 +50,55 @@ type RepositoryReader interface {
 	Load() ([]Repository, error)
 }
 
+// RepositoryFinder looks up repositories without loading the entire store
+type RepositoryFinder interface {
+	Get(id string) (Repository, error)
+	GetByFullName(fullName string) (Repository, error)
+	ListByPlugin(plugin string) ([]Repository, error)
+}
+
 type RepositoryReaderWriter interface {
 	RepositoryReader
 	RepositoryWriter
 }
+
+// RepositoryStore is implemented by all storage backends
+type RepositoryStore interface {
+	RepositoryReaderWriter
+	RepositoryFinder
+}
+
+// ScheduleState tracks the runs of a plugin for a repository, so restarts
+// of the scheduler continue where it left off
+type ScheduleState struct {
+	RepositoryID string
+	Plugin       string
+	LastRun      time.Time
+	NextRun      time.Time
+}
+
+// CheckState is the last successful dependency check of a .sisyphus entry,
+// so workers can skip entries whose manifests did not change since
+type CheckState struct {
+	RepositoryID string
+	// Entry identifies the entry including its settings, like ignores
+	Entry string
+	// Fingerprint is a hash of the manifests checked
+	Fingerprint string
+	Time        time.Time
+}
+
+// CheckStateStore persists CheckStates
+type CheckStateStore interface {
+	// LoadCheckState returns ErrNotFound for entries never checked
+	LoadCheckState(repositoryID, entry string) (CheckState, error)
+	StoreCheckState(CheckState) error
+}
+
+// ScheduleStateStore persists ScheduleStates
+type ScheduleStateStore interface {
+	LoadScheduleStates() ([]ScheduleState, error)
+	// LoadScheduleState returns the state of a single plugin of a repository
+	LoadScheduleState(repositoryID, plugin string) (ScheduleState, error)
+	StoreScheduleState(ScheduleState) error
+}
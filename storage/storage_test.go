@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testScheduleStateStore checks the point lookup against the states stored
+func testScheduleStateStore(t *testing.T, store ScheduleStateStore) {
+	if _, err := store.LoadScheduleState("1", "greenkeep:ruby:/"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	states := []ScheduleState{
+		{RepositoryID: "1", Plugin: "greenkeep:ruby:/", LastRun: now, NextRun: now.Add(time.Hour)},
+		{RepositoryID: "1", Plugin: "greenkeep:javascript:/web", LastRun: now, NextRun: now.Add(2 * time.Hour)},
+		{RepositoryID: "2", Plugin: "greenkeep:ruby:/", LastRun: now, NextRun: now.Add(3 * time.Hour)},
+	}
+	for _, state := range states {
+		if err := store.StoreScheduleState(state); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+
+	for _, expected := range states {
+		state, err := store.LoadScheduleState(expected.RepositoryID, expected.Plugin)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if state.RepositoryID != expected.RepositoryID || state.Plugin != expected.Plugin ||
+			!state.LastRun.Equal(expected.LastRun) || !state.NextRun.Equal(expected.NextRun) {
+			t.Fatalf("Expected %#v, but got %#v", expected, state)
+		}
+	}
+
+	if _, err := store.LoadScheduleState("2", "greenkeep:javascript:/web"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+}
+
+func Test_FileStorage_LoadScheduleState(t *testing.T) {
+	store, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testScheduleStateStore(t, store)
+}
+
+// testCheckStateStore checks the states of entries are kept apart
+func testCheckStateStore(t *testing.T, store CheckStateStore) {
+	if _, err := store.LoadCheckState("1", "a"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, but got %v", err)
+	}
+
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	states := []CheckState{
+		{RepositoryID: "1", Entry: "a", Fingerprint: "f1", Time: now},
+		{RepositoryID: "1", Entry: "b", Fingerprint: "f2", Time: now},
+		{RepositoryID: "2", Entry: "a", Fingerprint: "f3", Time: now},
+		{RepositoryID: "1", Entry: "a", Fingerprint: "f4", Time: now.Add(time.Hour)},
+	}
+	for _, state := range states {
+		if err := store.StoreCheckState(state); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+
+	for _, expected := range states[1:] {
+		state, err := store.LoadCheckState(expected.RepositoryID, expected.Entry)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if state.RepositoryID != expected.RepositoryID || state.Entry != expected.Entry ||
+			state.Fingerprint != expected.Fingerprint || !state.Time.Equal(expected.Time) {
+			t.Fatalf("Expected %#v, but got %#v", expected, state)
+		}
+	}
+}
+
+func Test_FileStorage_CheckState(t *testing.T) {
+	store, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testCheckStateStore(t, store)
+}
+
+// testJobQueueStore checks pending jobs are replaced, deleted and kept per queue
+func testJobQueueStore(t *testing.T, store JobQueueStore) {
+	jobs := []PendingJob{
+		{Queue: "master", ID: "1", Subject: "greenkeep-ruby", Attempt: 1, Job: json.RawMessage(`{"JobID":"1"}`)},
+		{Queue: "master", ID: "2", Subject: "greenkeep-javascript", Attempt: 1, Job: json.RawMessage(`{"JobID":"2"}`)},
+		{Queue: "scheduler", ID: "3", Subject: "greenkeep", Attempt: 1, Job: json.RawMessage(`{"JobID":"3"}`)},
+		{Queue: "master", ID: "1", Subject: "greenkeep-ruby", Attempt: 2, Job: json.RawMessage(`{"JobID":"1","Attempt":2}`)},
+	}
+	for _, job := range jobs {
+		if err := store.StorePendingJob(job); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+	if err := store.DeletePendingJob("master", "2"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := store.DeletePendingJob("master", "unknown"); err != nil {
+		t.Fatalf("Expected deleting a missing job to succeed, but got %v", err)
+	}
+
+	loaded, err := store.LoadPendingJobs("master")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !reflect.DeepEqual(loaded, jobs[3:]) {
+		t.Fatalf("Expected %#v, but got %#v", jobs[3:], loaded)
+	}
+	loaded, err = store.LoadPendingJobs("unknown")
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("Expected no jobs, but got %#v, %v", loaded, err)
+	}
+}
+
+func Test_FileStorage_JobQueue(t *testing.T) {
+	store, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	testJobQueueStore(t, store)
+}
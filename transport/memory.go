@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory delivers messages between subscribers of the same process. Like
+// nats, it supports * and > wildcards, and every subscription handles its
+// messages in order on a goroutine of its own.
+type Memory struct {
+	mu      sync.Mutex
+	subs    []*memorySubscription
+	queues  map[string]int
+	inboxes int
+	closed  bool
+}
+
+// NewMemory returns a transport which is not shared with anyone
+func NewMemory() *Memory {
+	return &Memory{queues: map[string]int{}}
+}
+
+func (m *Memory) Publish(subject string, data []byte) error {
+	return m.PublishRequest(subject, "", data)
+}
+
+func (m *Memory) PublishRequest(subject, reply string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	groups := map[string][]*memorySubscription{}
+	for _, sub := range m.subs {
+		if !matches(sub.subject, subject) {
+			continue
+		}
+		if sub.queue == "" {
+			sub.push(subject, reply, data)
+			continue
+		}
+		groups[sub.queue] = append(groups[sub.queue], sub)
+	}
+	for queue, members := range groups {
+		key := queue + " " + subject
+		members[m.queues[key]%len(members)].push(subject, reply, data)
+		m.queues[key]++
+	}
+
+	return nil
+}
+
+func (m *Memory) Subscribe(subject string, handler Handler) (Subscription, error) {
+	return m.QueueSubscribe(subject, "", handler)
+}
+
+func (m *Memory) QueueSubscribe(subject, queue string, handler Handler) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &memorySubscription{
+		transport: m,
+		subject:   subject,
+		queue:     queue,
+		handler:   handler,
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+	m.subs = append(m.subs, sub)
+	go sub.run()
+
+	return sub, nil
+}
+
+func (m *Memory) Request(subject string, data []byte, timeout time.Duration) (*Msg, error) {
+	replies := make(chan *Msg, 1)
+	inbox := m.NewInbox()
+	sub, err := m.Subscribe(inbox, func(msg *Msg) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := m.PublishRequest(subject, inbox, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-replies:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (m *Memory) NewInbox() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inboxes++
+	return fmt.Sprintf("_INBOX.%p.%d", m, m.inboxes)
+}
+
+// Flush is a no-op, messages are handed to subscribers immediately
+func (m *Memory) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (m *Memory) Close() {
+	m.mu.Lock()
+	subs := m.subs
+	m.subs = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.stop()
+	}
+}
+
+func (m *Memory) remove(sub *memorySubscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, s := range m.subs {
+		if s == sub {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+type memorySubscription struct {
+	transport *Memory
+	subject   string
+	queue     string
+	handler   Handler
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*Msg
+	stopped bool
+}
+
+func (s *memorySubscription) push(subject, reply string, data []byte) {
+	// subscribers must not be able to modify each others data
+	msg := &Msg{Subject: subject, Reply: reply, Data: append([]byte(nil), data...)}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, msg)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *memorySubscription) run() {
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.stopped {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		msg := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		s.handler(msg)
+	}
+}
+
+func (s *memorySubscription) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.pending = nil
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.transport.remove(s)
+	s.stop()
+	return nil
+}
+
+// matches reports whether subject is matched by pattern. * matches a single
+// token, a trailing > matches one or more tokens.
+func matches(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, token := range p {
+		if token == ">" && i == len(p)-1 {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
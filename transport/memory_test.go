@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan *Msg) *Msg {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a message, but got none")
+	}
+	return nil
+}
+
+func Test_Memory_Subscribe(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	received := make(chan *Msg, 10)
+	m.Subscribe("greenkeep.*", func(msg *Msg) { received <- msg })
+
+	m.Publish("greenkeep.ruby", []byte("a"))
+	m.Publish("greenkeep", []byte("b"))
+	m.Publish("greenkeep.ruby.extra", []byte("c"))
+	m.Publish("greenkeep.javascript", []byte("d"))
+
+	for _, expected := range []string{"a", "d"} {
+		if msg := receive(t, received); string(msg.Data) != expected {
+			t.Fatalf("Expected %q, but got %q", expected, msg.Data)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("Expected no further message, but got %q on %q", msg.Data, msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_Memory_QueueSubscribe(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	var (
+		mu     sync.Mutex
+		counts = map[string]int{}
+		wg     sync.WaitGroup
+	)
+	count := func(name string) Handler {
+		return func(*Msg) {
+			mu.Lock()
+			counts[name]++
+			mu.Unlock()
+			wg.Done()
+		}
+	}
+	m.QueueSubscribe("greenkeep-ruby", "workers", count("a"))
+	m.QueueSubscribe("greenkeep-ruby", "workers", count("b"))
+	m.Subscribe("greenkeep-ruby", count("audit"))
+
+	wg.Add(20)
+	for i := 0; i < 10; i++ {
+		m.Publish("greenkeep-ruby", nil)
+	}
+	wg.Wait()
+
+	if counts["a"]+counts["b"] != 10 || counts["a"] == 0 || counts["b"] == 0 {
+		t.Fatalf("Expected 10 messages shared by the queue group, but got %v", counts)
+	}
+	if counts["audit"] != 10 {
+		t.Fatalf("Expected 10 messages for the plain subscription, but got %d", counts["audit"])
+	}
+}
+
+func Test_Memory_Request(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	m.Subscribe("echo", func(msg *Msg) { m.Publish(msg.Reply, msg.Data) })
+
+	msg, err := m.Request("echo", []byte("ping"), time.Second)
+	if err != nil || string(msg.Data) != "ping" {
+		t.Fatalf("Expected %q, but got %v (%v)", "ping", msg, err)
+	}
+	if _, err := m.Request("nobody", nil, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, but got %v", err)
+	}
+}
+
+func Test_Memory_Unsubscribe(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	received := make(chan *Msg, 1)
+	sub, _ := m.Subscribe("toggle-repository", func(msg *Msg) { received <- msg })
+	sub.Unsubscribe()
+	m.Publish("toggle-repository", []byte("1"))
+
+	select {
+	case msg := <-received:
+		t.Fatalf("Expected no message after unsubscribing, but got %q", msg.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_Connect_RejectsMemory(t *testing.T) {
+	// every command would end up with a transport of its own
+	if _, err := Connect("mem://pipeline"); err == nil {
+		t.Fatalf("Expected an error for an in-memory URL, but got none")
+	}
+}
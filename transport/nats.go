@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// NATS sends messages through a nats server
+type NATS struct {
+	nc *nats.Conn
+}
+
+// ConnectNATS connects to the nats server at url
+func ConnectNATS(url string) (*NATS, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewNATS(nc), nil
+}
+
+// NewNATS wraps an existing connection
+func NewNATS(nc *nats.Conn) *NATS {
+	return &NATS{nc: nc}
+}
+
+func handle(handler Handler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		handler(&Msg{
+			Subject: msg.Subject,
+			Reply:   msg.Reply,
+			Data:    msg.Data,
+		})
+	}
+}
+
+func (t *NATS) Publish(subject string, data []byte) error {
+	return t.nc.Publish(subject, data)
+}
+
+func (t *NATS) PublishRequest(subject, reply string, data []byte) error {
+	return t.nc.PublishRequest(subject, reply, data)
+}
+
+func (t *NATS) Subscribe(subject string, handler Handler) (Subscription, error) {
+	return t.nc.Subscribe(subject, handle(handler))
+}
+
+func (t *NATS) QueueSubscribe(subject, queue string, handler Handler) (Subscription, error) {
+	return t.nc.QueueSubscribe(subject, queue, handle(handler))
+}
+
+func (t *NATS) Request(subject string, data []byte, timeout time.Duration) (*Msg, error) {
+	msg, err := t.nc.Request(subject, data, timeout)
+	if err == nats.ErrTimeout {
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Msg{Subject: msg.Subject, Reply: msg.Reply, Data: msg.Data}, nil
+}
+
+func (t *NATS) NewInbox() string {
+	return nats.NewInbox()
+}
+
+func (t *NATS) Flush() error {
+	return t.nc.Flush()
+}
+
+func (t *NATS) Close() {
+	t.nc.Close()
+}
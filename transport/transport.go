@@ -0,0 +1,60 @@
+// Package transport abstracts the message broker connecting the scheduler,
+// the master and the language workers. Besides nats, an in-memory transport
+// connects components running in the same process, like tests.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTimeout is returned by Request if no reply arrived in time
+var ErrTimeout = errors.New("transport: timeout")
+
+// ErrClosed is returned when using a closed transport
+var ErrClosed = errors.New("transport: closed")
+
+// Msg is a single message received from a subject
+type Msg struct {
+	Subject string
+	// Reply is the subject responses should be published to, if any
+	Reply string
+	Data  []byte
+}
+
+// Handler is invoked for every message of a subscription. Messages of a
+// single subscription are handled one after another.
+type Handler func(*Msg)
+
+// Subscription is an active subscription to a subject
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Transport publishes and receives messages
+type Transport interface {
+	Publish(subject string, data []byte) error
+	// PublishRequest publishes data, asking receivers to respond to reply
+	PublishRequest(subject, reply string, data []byte) error
+	Subscribe(subject string, handler Handler) (Subscription, error)
+	// QueueSubscribe delivers every message to a single member of queue
+	QueueSubscribe(subject, queue string, handler Handler) (Subscription, error)
+	// Request publishes data and waits for the first response
+	Request(subject string, data []byte, timeout time.Duration) (*Msg, error)
+	// NewInbox returns a unique subject to receive responses on
+	NewInbox() string
+	// Flush blocks until all published messages were handed to the broker
+	Flush() error
+	Close()
+}
+
+// Connect returns a nats connection. In-memory transports are not shared
+// between processes, so they can't be connected to by URL.
+func Connect(url string) (Transport, error) {
+	if strings.HasPrefix(url, "mem://") {
+		return nil, fmt.Errorf("transport: %s is in-memory, which only works within a single process", url)
+	}
+	return ConnectNATS(url)
+}